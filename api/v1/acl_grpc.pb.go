@@ -0,0 +1,289 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.11.2
+// source: api/v1/acl.proto
+
+package log_v1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ACLClient is the client API for ACL service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ACLClient interface {
+	AddPolicy(ctx context.Context, in *AddPolicyRequest, opts ...grpc.CallOption) (*AddPolicyResponse, error)
+	RemovePolicy(ctx context.Context, in *RemovePolicyRequest, opts ...grpc.CallOption) (*RemovePolicyResponse, error)
+	// returns the policies of the policy file and the acl log
+	ListPolicies(ctx context.Context, in *ListPoliciesRequest, opts ...grpc.CallOption) (*ListPoliciesResponse, error)
+	// grants a role to a subject
+	AddRoleBinding(ctx context.Context, in *AddRoleBindingRequest, opts ...grpc.CallOption) (*AddRoleBindingResponse, error)
+	RemoveRoleBinding(ctx context.Context, in *RemoveRoleBindingRequest, opts ...grpc.CallOption) (*RemoveRoleBindingResponse, error)
+	ListRoleBindings(ctx context.Context, in *ListRoleBindingsRequest, opts ...grpc.CallOption) (*ListRoleBindingsResponse, error)
+}
+
+type aCLClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewACLClient(cc grpc.ClientConnInterface) ACLClient {
+	return &aCLClient{cc}
+}
+
+func (c *aCLClient) AddPolicy(ctx context.Context, in *AddPolicyRequest, opts ...grpc.CallOption) (*AddPolicyResponse, error) {
+	out := new(AddPolicyResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.ACL/AddPolicy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aCLClient) RemovePolicy(ctx context.Context, in *RemovePolicyRequest, opts ...grpc.CallOption) (*RemovePolicyResponse, error) {
+	out := new(RemovePolicyResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.ACL/RemovePolicy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aCLClient) ListPolicies(ctx context.Context, in *ListPoliciesRequest, opts ...grpc.CallOption) (*ListPoliciesResponse, error) {
+	out := new(ListPoliciesResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.ACL/ListPolicies", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aCLClient) AddRoleBinding(ctx context.Context, in *AddRoleBindingRequest, opts ...grpc.CallOption) (*AddRoleBindingResponse, error) {
+	out := new(AddRoleBindingResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.ACL/AddRoleBinding", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aCLClient) RemoveRoleBinding(ctx context.Context, in *RemoveRoleBindingRequest, opts ...grpc.CallOption) (*RemoveRoleBindingResponse, error) {
+	out := new(RemoveRoleBindingResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.ACL/RemoveRoleBinding", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aCLClient) ListRoleBindings(ctx context.Context, in *ListRoleBindingsRequest, opts ...grpc.CallOption) (*ListRoleBindingsResponse, error) {
+	out := new(ListRoleBindingsResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.ACL/ListRoleBindings", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ACLServer is the server API for ACL service.
+// All implementations must embed UnimplementedACLServer
+// for forward compatibility
+type ACLServer interface {
+	AddPolicy(context.Context, *AddPolicyRequest) (*AddPolicyResponse, error)
+	RemovePolicy(context.Context, *RemovePolicyRequest) (*RemovePolicyResponse, error)
+	// returns the policies of the policy file and the acl log
+	ListPolicies(context.Context, *ListPoliciesRequest) (*ListPoliciesResponse, error)
+	// grants a role to a subject
+	AddRoleBinding(context.Context, *AddRoleBindingRequest) (*AddRoleBindingResponse, error)
+	RemoveRoleBinding(context.Context, *RemoveRoleBindingRequest) (*RemoveRoleBindingResponse, error)
+	ListRoleBindings(context.Context, *ListRoleBindingsRequest) (*ListRoleBindingsResponse, error)
+	mustEmbedUnimplementedACLServer()
+}
+
+// UnimplementedACLServer must be embedded to have forward compatible implementations.
+type UnimplementedACLServer struct {
+}
+
+func (UnimplementedACLServer) AddPolicy(context.Context, *AddPolicyRequest) (*AddPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddPolicy not implemented")
+}
+func (UnimplementedACLServer) RemovePolicy(context.Context, *RemovePolicyRequest) (*RemovePolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemovePolicy not implemented")
+}
+func (UnimplementedACLServer) ListPolicies(context.Context, *ListPoliciesRequest) (*ListPoliciesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPolicies not implemented")
+}
+func (UnimplementedACLServer) AddRoleBinding(context.Context, *AddRoleBindingRequest) (*AddRoleBindingResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddRoleBinding not implemented")
+}
+func (UnimplementedACLServer) RemoveRoleBinding(context.Context, *RemoveRoleBindingRequest) (*RemoveRoleBindingResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveRoleBinding not implemented")
+}
+func (UnimplementedACLServer) ListRoleBindings(context.Context, *ListRoleBindingsRequest) (*ListRoleBindingsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRoleBindings not implemented")
+}
+func (UnimplementedACLServer) mustEmbedUnimplementedACLServer() {}
+
+// UnsafeACLServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ACLServer will
+// result in compilation errors.
+type UnsafeACLServer interface {
+	mustEmbedUnimplementedACLServer()
+}
+
+func RegisterACLServer(s grpc.ServiceRegistrar, srv ACLServer) {
+	s.RegisterService(&ACL_ServiceDesc, srv)
+}
+
+func _ACL_AddPolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddPolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACLServer).AddPolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.ACL/AddPolicy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACLServer).AddPolicy(ctx, req.(*AddPolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ACL_RemovePolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemovePolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACLServer).RemovePolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.ACL/RemovePolicy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACLServer).RemovePolicy(ctx, req.(*RemovePolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ACL_ListPolicies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPoliciesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACLServer).ListPolicies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.ACL/ListPolicies",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACLServer).ListPolicies(ctx, req.(*ListPoliciesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ACL_AddRoleBinding_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddRoleBindingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACLServer).AddRoleBinding(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.ACL/AddRoleBinding",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACLServer).AddRoleBinding(ctx, req.(*AddRoleBindingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ACL_RemoveRoleBinding_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveRoleBindingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACLServer).RemoveRoleBinding(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.ACL/RemoveRoleBinding",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACLServer).RemoveRoleBinding(ctx, req.(*RemoveRoleBindingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ACL_ListRoleBindings_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRoleBindingsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ACLServer).ListRoleBindings(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.ACL/ListRoleBindings",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ACLServer).ListRoleBindings(ctx, req.(*ListRoleBindingsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ACL_ServiceDesc is the grpc.ServiceDesc for ACL service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ACL_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "log.v1.ACL",
+	HandlerType: (*ACLServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddPolicy",
+			Handler:    _ACL_AddPolicy_Handler,
+		},
+		{
+			MethodName: "RemovePolicy",
+			Handler:    _ACL_RemovePolicy_Handler,
+		},
+		{
+			MethodName: "ListPolicies",
+			Handler:    _ACL_ListPolicies_Handler,
+		},
+		{
+			MethodName: "AddRoleBinding",
+			Handler:    _ACL_AddRoleBinding_Handler,
+		},
+		{
+			MethodName: "RemoveRoleBinding",
+			Handler:    _ACL_RemoveRoleBinding_Handler,
+		},
+		{
+			MethodName: "ListRoleBindings",
+			Handler:    _ACL_ListRoleBindings_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "api/v1/acl.proto",
+}
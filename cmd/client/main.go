@@ -0,0 +1,591 @@
+//Command client produces records to and consumes records from a proglog cluster.
+//
+//	client [flags] produce [-framing line|length] < records
+//	client [flags] consume [-from offset] [-to offset] [-format json|raw] [-framing line|length]
+//	client [flags] tail [-from offset] [-format json|raw] [-framing line|length]
+//	client [flags] servers
+//	client [flags] offsets|size|segments|roll|sync
+//	client [flags] truncate -offset offset
+//	client [flags] acl policies|roles
+//	client [flags] acl add-policy|remove-policy -subject subject -object object -action action
+//	client [flags] acl add-role|remove-role -subject subject -role role
+//	client [flags] keyring list
+//	client [flags] keyring install|use|remove -key key
+//
+//The client authenticates with its tls cert, or with -token-file or -api-key-file when the servers
+//accept tokens or api keys.
+//
+//Unless -direct is set, the client discovers the servers in the cluster from -addr so that
+//records are produced to the leader and consumed from followers. The admin commands always
+//manage the log of the server at -addr, and the keyring commands rotate the gossip encryption keys
+//of the whole cluster through it. Changes to the acl are sent to the leader. With -log, the
+//commands read and write an internal log of the server at -addr instead, such as its audit log
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/config"
+	"github.com/krehermann/proglog/internal/loadbalance"
+	"github.com/krehermann/proglog/internal/log"
+	"go.opencensus.io/plugin/ocgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+//codeOffsetOutOfRange is the status code of api.ErrOffsetOutOfRange
+const codeOffsetOutOfRange = 404
+
+//maxValueBytes bounds the length framed values read from stdin, like the default message size of
+//the servers, so that a corrupt length can't allocate a buffer of any size
+const maxValueBytes = 4 << 20
+
+var enc = binary.BigEndian
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+//cli holds the connection to the cluster and where the commands read and write
+type cli struct {
+	client api.LogClient
+	admin  api.AdminClient
+	acl    api.ACLClient
+	in     io.Reader
+	out    io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *cli, args []string) error
+	//direct commands only talk to the server at -addr
+	direct bool
+}
+
+var commands = map[string]command{
+	"produce":  {"produce records read from stdin", produce, false},
+	"consume":  {"consume a range of records", consume, false},
+	"tail":     {"consume records as they are produced", tail, false},
+	"servers":  {"list the servers in the cluster", servers, false},
+	"offsets":  {"print the lowest and next offset of the server's log", offsets, true},
+	"size":     {"print the size of the server's log in bytes", size, true},
+	"segments": {"list the segments of the server's log", segments, true},
+	"truncate": {"remove the segments of the server's log below an offset", truncate, true},
+	"roll":     {"start a new segment in the server's log", roll, true},
+	"sync":     {"flush the server's log to stable storage", syncLog, true},
+	"acl":      {"list and change the policies and role bindings of the cluster", acl, false},
+	"keyring":  {"list and rotate the gossip encryption keys of the cluster", keyring, true},
+}
+
+func run(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:8400", "Address of a server in the cluster.")
+	direct := fs.Bool("direct", false, "Use only the server at -addr instead of discovering the cluster.")
+	logName := fs.String("log", "", "Internal log of the server at -addr to use instead of the log, such as audit. Implies -direct.")
+	tlsConfig := config.TLSConfig{}
+	fs.StringVar(&tlsConfig.CertFile, "tls-cert-file", "", "Path to client tls cert.")
+	fs.StringVar(&tlsConfig.KeyFile, "tls-key-file", "", "Path to client tls key.")
+	fs.StringVar(&tlsConfig.CAFile, "tls-ca-file", "", "Path to certificate authority of the servers.")
+	fs.StringVar(&tlsConfig.ServerAddress, "tls-server-name", "", "Name to verify the servers' certificates against.")
+	tokenFile := fs.String("token-file", "", "Path to a bearer token to authenticate with instead of a client cert.")
+	apiKeyFile := fs.String("api-key-file", "", "Path to an api key to authenticate with instead of a client cert.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: client [flags] <command> [command flags]\n\ncommands:\n")
+		for name, cmd := range commands {
+			fmt.Fprintf(fs.Output(), "  %-8s %s\n", name, cmd.usage)
+		}
+		fmt.Fprintf(fs.Output(), "\nflags:\n")
+		fs.PrintDefaults()
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	//sampled traces continue into the servers
+	opts := []grpc.DialOption{grpc.WithStatsHandler(&ocgrpc.ClientHandler{})}
+	secure := tlsConfig.CertFile != "" || tlsConfig.CAFile != ""
+	if secure {
+		tc, err := config.SetupTLSConfig(tlsConfig)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tc)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	creds, err := callCredentials(*tokenFile, *apiKeyFile, !secure)
+	if err != nil {
+		return err
+	}
+	if creds != nil {
+		//the resolver calls GetServers with the credentials too
+		opts = append(opts,
+			grpc.WithPerRPCCredentials(creds),
+			grpc.WithResolvers(&loadbalance.Resolver{CallCredentials: creds}),
+		)
+	}
+	if *logName != "" {
+		//internal logs such as the audit log are only on the server at -addr
+		*direct = true
+		md := metadata.Pairs(log.LogMetadataKey, *logName)
+		opts = append(opts,
+			grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				return invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+			}),
+			grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				return streamer(metadata.NewOutgoingContext(ctx, md), desc, cc, method, opts...)
+			}),
+		)
+	}
+	target := *addr
+	if !*direct && !cmd.direct {
+		target = fmt.Sprintf("%s:///%s", loadbalance.Name, *addr)
+	}
+	conn, err := grpc.DialContext(ctx, target, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := &cli{client: api.NewLogClient(conn), admin: api.NewAdminClient(conn), acl: api.NewACLClient(conn), in: in, out: out}
+	return cmd.run(ctx, c, fs.Args()[1:])
+}
+
+//callCredentials returns the credentials in the token or api key file, if one is set. Without TLS
+//they are sent in the clear, which is only meant for local testing
+func callCredentials(tokenFile, apiKeyFile string, insecure bool) (credentials.PerRPCCredentials, error) {
+	switch {
+	case tokenFile != "" && apiKeyFile != "":
+		return nil, fmt.Errorf("set only one of -token-file and -api-key-file")
+	case tokenFile != "":
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return auth.TokenCredentials{Token: strings.TrimSpace(string(b)), AllowInsecure: insecure}, nil
+	case apiKeyFile != "":
+		b, err := ioutil.ReadFile(apiKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return auth.APIKeyCredentials{Key: strings.TrimSpace(string(b)), AllowInsecure: insecure}, nil
+	}
+	return nil, nil
+}
+
+func produce(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("produce", flag.ContinueOnError)
+	framing := fs.String("framing", "line", "How records are separated on stdin: line or length (8 byte big endian prefix).")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	read, err := reader(*framing, c.in)
+	if err != nil {
+		return err
+	}
+	stream, err := c.client.ProduceStream(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		value, err := read()
+		if err == io.EOF {
+			return stream.CloseSend()
+		}
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&api.ProduceRequest{Record: &api.Record{Value: value}})
+		if err != nil {
+			return err
+		}
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, res.Offset)
+	}
+}
+
+func consume(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("consume", flag.ContinueOnError)
+	from := fs.Uint64("from", 0, "Offset of the first record.")
+	to := fs.Int64("to", -1, "Offset after the last record. Defaults to the end of the log.")
+	write := outputFlags(fs, c.out)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	w, err := write()
+	if err != nil {
+		return err
+	}
+	for off := *from; *to < 0 || off < uint64(*to); off++ {
+		res, err := c.client.Consume(ctx, &api.ConsumeRequest{Offset: off})
+		if status.Code(err) == codeOffsetOutOfRange && *to < 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = w(res.Record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tail(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	from := fs.Uint64("from", 0, "Offset of the first record.")
+	write := outputFlags(fs, c.out)
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	w, err := write()
+	if err != nil {
+		return err
+	}
+	stream, err := c.client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: *from})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if ctx.Err() != nil {
+			//interrupted
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = w(res.Record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func servers(ctx context.Context, c *cli, args []string) error {
+	res, err := c.client.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		return err
+	}
+	for _, s := range res.Servers {
+		leader := ""
+		if s.IsLeader {
+			leader = "leader"
+		}
+		fmt.Fprintf(c.out, "%s\t%s\t%s\n", s.Id, s.RpcAddr, leader)
+	}
+	return nil
+}
+
+func offsets(ctx context.Context, c *cli, args []string) error {
+	res, err := c.admin.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "lowest\t%d\nnext\t%d\n", res.LowestOffset, res.NextOffset)
+	return nil
+}
+
+func size(ctx context.Context, c *cli, args []string) error {
+	res, err := c.admin.GetSize(ctx, &api.GetSizeRequest{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, res.SizeBytes)
+	return nil
+}
+
+func segments(ctx context.Context, c *cli, args []string) error {
+	res, err := c.admin.ListSegments(ctx, &api.ListSegmentsRequest{})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BASE\tNEXT\tSTORE BYTES\tINDEX BYTES")
+	for _, s := range res.Segments {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\n", s.BaseOffset, s.NextOffset, s.StoreBytes, s.IndexBytes)
+	}
+	return w.Flush()
+}
+
+func truncate(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("truncate", flag.ContinueOnError)
+	offset := fs.Int64("offset", -1, "Remove the segments whose records are all below this offset.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *offset < 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	res, err := c.admin.Truncate(ctx, &api.TruncateRequest{Offset: uint64(*offset)})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "lowest\t%d\n", res.LowestOffset)
+	return nil
+}
+
+func roll(ctx context.Context, c *cli, args []string) error {
+	res, err := c.admin.RollSegment(ctx, &api.RollSegmentRequest{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "base\t%d\n", res.BaseOffset)
+	return nil
+}
+
+func syncLog(ctx context.Context, c *cli, args []string) error {
+	_, err := c.admin.Sync(ctx, &api.SyncRequest{})
+	return err
+}
+
+func acl(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("acl", flag.ContinueOnError)
+	policy := &api.Policy{}
+	binding := &api.RoleBinding{}
+	fs.StringVar(&policy.Subject, "subject", "", "Subject, or role, of the policy or role binding.")
+	fs.StringVar(&policy.Object, "object", "", "Resource of the policy. A trailing * matches any resource with the prefix.")
+	fs.StringVar(&policy.Action, "action", "", "Action of the policy: produce, consume, admin, replicate or *.")
+	fs.StringVar(&binding.Role, "role", "", "Role granted by the role binding.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: client acl policies|add-policy|remove-policy|roles|add-role|remove-role [flags]\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	binding.Subject = policy.Subject
+	switch args[0] {
+	case "policies":
+		res, err := c.acl.ListPolicies(ctx, &api.ListPoliciesRequest{})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SUBJECT\tOBJECT\tACTION")
+		for _, p := range res.Policies {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", p.Subject, p.Object, p.Action)
+		}
+		return w.Flush()
+	case "roles":
+		res, err := c.acl.ListRoleBindings(ctx, &api.ListRoleBindingsRequest{})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SUBJECT\tROLE")
+		for _, b := range res.RoleBindings {
+			fmt.Fprintf(w, "%s\t%s\n", b.Subject, b.Role)
+		}
+		return w.Flush()
+	case "add-policy":
+		_, err = c.acl.AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	case "remove-policy":
+		_, err = c.acl.RemovePolicy(ctx, &api.RemovePolicyRequest{Policy: policy})
+	case "add-role":
+		_, err = c.acl.AddRoleBinding(ctx, &api.AddRoleBindingRequest{RoleBinding: binding})
+	case "remove-role":
+		_, err = c.acl.RemoveRoleBinding(ctx, &api.RemoveRoleBindingRequest{RoleBinding: binding})
+	default:
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	return err
+}
+
+//keyring rotates gossip keys without downtime: install the new key, use it once every member has
+//it, then remove the old key
+func keyring(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("keyring", flag.ContinueOnError)
+	key := fs.String("key", "", "Base64 encoded AES key of 16, 24 or 32 bytes.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: client keyring list|install|use|remove [flags]\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if args[0] != "list" && *key == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	var res *api.KeyResponse
+	switch args[0] {
+	case "list":
+		res, err = c.admin.ListKeys(ctx, &api.ListKeysRequest{})
+	case "install":
+		res, err = c.admin.InstallKey(ctx, &api.KeyRequest{Key: *key})
+	case "use":
+		res, err = c.admin.UseKey(ctx, &api.KeyRequest{Key: *key})
+	case "remove":
+		res, err = c.admin.RemoveKey(ctx, &api.KeyRequest{Key: *key})
+	default:
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if err != nil {
+		return err
+	}
+	if args[0] == "list" {
+		keys := make([]string, 0, len(res.Keys))
+		for k := range res.Keys {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tMEMBERS\tPRIMARY")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", k, res.Keys[k], res.PrimaryKeys[k])
+		}
+		err = w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	members := make([]string, 0, len(res.Messages))
+	for m := range res.Messages {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	for _, m := range members {
+		fmt.Fprintf(c.out, "%s: %s\n", m, res.Messages[m])
+	}
+	if res.NumErr > 0 || res.NumResp < res.NumNodes {
+		return fmt.Errorf("%d of %d members failed and %d did not respond", res.NumErr, res.NumNodes, res.NumNodes-res.NumResp)
+	}
+	return nil
+}
+
+//outputFlags defines the flags that choose how records are written. The returned function
+//builds the writer once the flags are parsed
+func outputFlags(fs *flag.FlagSet, out io.Writer) func() (func(*api.Record) error, error) {
+	format := fs.String("format", "json", "How records are printed: json, one record per line, or raw values.")
+	framing := fs.String("framing", "line", "How raw values are separated: line or length (8 byte big endian prefix).")
+	return func() (func(*api.Record) error, error) {
+		switch *format {
+		case "json":
+			m := protojson.MarshalOptions{EmitUnpopulated: true}
+			return func(r *api.Record) error {
+				b, err := m.Marshal(r)
+				if err != nil {
+					return err
+				}
+				_, err = fmt.Fprintf(out, "%s\n", b)
+				return err
+			}, nil
+		case "raw":
+			return writer(*framing, out)
+		}
+		return nil, fmt.Errorf("unknown format %q", *format)
+	}
+}
+
+//reader returns a function that reads the next value framed by framing. It returns io.EOF
+//when there are no more values
+func reader(framing string, in io.Reader) (func() ([]byte, error), error) {
+	r := bufio.NewReader(in)
+	switch framing {
+	case "line":
+		return func() ([]byte, error) {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF && len(line) > 0 {
+				//the last line has no newline
+				return line, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return line[:len(line)-1], nil
+		}, nil
+	case "length":
+		return func() ([]byte, error) {
+			var n uint64
+			err := binary.Read(r, enc, &n)
+			if err != nil {
+				return nil, err
+			}
+			if n > maxValueBytes {
+				return nil, fmt.Errorf("value of %d bytes is larger than the limit of %d bytes", n, maxValueBytes)
+			}
+			value := make([]byte, n)
+			_, err = io.ReadFull(r, value)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return value, err
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown framing %q", framing)
+}
+
+//writer returns a function that writes the values of records framed by framing
+func writer(framing string, out io.Writer) (func(*api.Record) error, error) {
+	switch framing {
+	case "line":
+		return func(r *api.Record) error {
+			_, err := fmt.Fprintf(out, "%s\n", r.Value)
+			return err
+		}, nil
+	case "length":
+		return func(r *api.Record) error {
+			err := binary.Write(out, enc, uint64(len(r.Value)))
+			if err != nil {
+				return err
+			}
+			_, err = out.Write(r.Value)
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown framing %q", framing)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/agent"
+	"github.com/krehermann/proglog/internal/config"
+	"github.com/krehermann/proglog/internal/testconfig"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestClient(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, run runFunc){
+		"produce and consume lines":          testLines,
+		"produce and consume length framed":  testLengthFramed,
+		"consume a range as json":            testConsumeJSON,
+		"tail follows new records":           testTail,
+		"servers lists the cluster":          testServers,
+		"admin manages the log":              testAdmin,
+		"acl manages policies and roles":     testACL,
+		"keyring rotates gossip keys":        testKeyring,
+		"log reads the audit log":            testAuditLog,
+		"unknown commands print their usage": testUnknownCommand,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t, setupTest(t))
+		})
+	}
+}
+
+//runFunc runs the client with args and stdin and returns its stdout
+type runFunc func(ctx context.Context, in string, args ...string) (string, error)
+
+func setupTest(t *testing.T) runFunc {
+	t.Helper()
+	files := testconfig.New(t)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	dataDir, err := ioutil.TempDir("", "client-test")
+	require.NoError(t, err)
+	ports := dynaport.Get(2)
+	a, err := agent.New(agent.Config{
+		NodeName:        "0",
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCAddr:         fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		DataDir:         dataDir,
+		ACLModelFile:    files.ACLModelFile,
+		ACLPolicyFile:   files.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		EncryptKey:      testKey,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		a.Shutdown()
+		os.RemoveAll(dataDir)
+	})
+	flags := []string{
+		"-addr", a.RPCAddr,
+		"-tls-cert-file", files.RootClientCertFile,
+		"-tls-key-file", files.RootClientKeyFile,
+		"-tls-ca-file", files.CAFile,
+	}
+	return func(ctx context.Context, in string, args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := run(ctx, append(flags, args...), strings.NewReader(in), out)
+		return out.String(), err
+	}
+}
+
+func testLines(t *testing.T, run runFunc) {
+	ctx := context.Background()
+	out, err := run(ctx, "foo\nbar\nbaz", "produce")
+	require.NoError(t, err)
+	require.Equal(t, "0\n1\n2\n", out)
+
+	out, err = run(ctx, "", "consume", "-format", "raw")
+	require.NoError(t, err)
+	require.Equal(t, "foo\nbar\nbaz\n", out)
+}
+
+func testLengthFramed(t *testing.T, run runFunc) {
+	ctx := context.Background()
+	values := [][]byte{[]byte("multi\nline"), {0, 1, 2}, {}}
+	in := &bytes.Buffer{}
+	for _, v := range values {
+		require.NoError(t, binary.Write(in, enc, uint64(len(v))))
+		in.Write(v)
+	}
+	out, err := run(ctx, in.String(), "produce", "-framing", "length")
+	require.NoError(t, err)
+	require.Equal(t, "0\n1\n2\n", out)
+
+	out, err = run(ctx, "", "consume", "-format", "raw", "-framing", "length")
+	require.NoError(t, err)
+	require.Equal(t, in.String(), out)
+
+	//a truncated frame is an error
+	_, err = run(ctx, in.String()[:in.Len()-1], "produce", "-framing", "length")
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	//so is a length over the limit, which is not allocated
+	huge := &bytes.Buffer{}
+	require.NoError(t, binary.Write(huge, enc, uint64(1)<<62))
+	_, err = run(ctx, huge.String(), "produce", "-framing", "length")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "larger than the limit")
+}
+
+func testConsumeJSON(t *testing.T, run runFunc) {
+	ctx := context.Background()
+	_, err := run(ctx, "foo\nbar\nbaz", "produce")
+	require.NoError(t, err)
+
+	out, err := run(ctx, "", "consume", "-from", "1", "-to", "2")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"value":"YmFy","offset":"1","metadata":{}}`, out)
+
+	_, err = run(ctx, "", "consume", "-from", "1", "-to", "4")
+	require.Error(t, err, "the range must exist")
+}
+
+func testTail(t *testing.T, run runFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		out, err := run(ctx, "", "tail", "-format", "raw")
+		done <- result{out, err}
+	}()
+	_, err := run(context.Background(), "foo\nbar", "produce")
+	require.NoError(t, err)
+	//give the tail time to catch up before interrupting it
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	res := <-done
+	require.NoError(t, res.err)
+	require.Equal(t, "foo\nbar\n", res.out)
+}
+
+func testServers(t *testing.T, run runFunc) {
+	out, err := run(context.Background(), "", "servers")
+	require.NoError(t, err)
+	require.Regexp(t, "^0\t127.0.0.1:[0-9]+\tleader\n$", out)
+}
+
+func testAdmin(t *testing.T, run runFunc) {
+	ctx := context.Background()
+	_, err := run(ctx, "foo\nbar", "produce")
+	require.NoError(t, err)
+	out, err := run(ctx, "", "roll")
+	require.NoError(t, err)
+	require.Equal(t, "base\t2\n", out)
+	_, err = run(ctx, "baz", "produce")
+	require.NoError(t, err)
+	_, err = run(ctx, "", "sync")
+	require.NoError(t, err)
+
+	out, err = run(ctx, "", "offsets")
+	require.NoError(t, err)
+	require.Equal(t, "lowest\t0\nnext\t3\n", out)
+	out, err = run(ctx, "", "segments")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	require.Regexp(t, "^2 +3 ", lines[2])
+
+	out, err = run(ctx, "", "truncate", "-offset", "2")
+	require.NoError(t, err)
+	require.Equal(t, "lowest\t2\n", out)
+	out, err = run(ctx, "", "size")
+	require.NoError(t, err)
+	require.Regexp(t, "^[1-9][0-9]*\n$", out)
+}
+
+func testACL(t *testing.T, run runFunc) {
+	ctx := context.Background()
+	_, err := run(ctx, "", "acl", "add-policy", "-subject", "auditor", "-object", "log/*", "-action", "consume")
+	require.NoError(t, err)
+	_, err = run(ctx, "", "acl", "add-role", "-subject", "nobody", "-role", "auditor")
+	require.NoError(t, err)
+	out, err := run(ctx, "", "acl", "policies")
+	require.NoError(t, err)
+	require.Contains(t, out, "SUBJECT")
+	require.Regexp(t, `auditor\s+log/\*\s+consume`, out)
+	out, err = run(ctx, "", "acl", "roles")
+	require.NoError(t, err)
+	require.Regexp(t, `nobody\s+auditor`, out)
+
+	_, err = run(ctx, "", "acl", "remove-role", "-subject", "nobody", "-role", "auditor")
+	require.NoError(t, err)
+	out, err = run(ctx, "", "acl", "roles")
+	require.NoError(t, err)
+	require.NotContains(t, out, "nobody")
+
+	_, err = run(ctx, "", "acl", "add-policy", "-subject", "auditor")
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = run(ctx, "", "acl", "bogus")
+	require.ErrorIs(t, err, flag.ErrHelp)
+}
+
+//testKey and rotatedKey are base64 encoded AES-128 keys
+const (
+	testKey    = "MDEyMzQ1Njc4OWFiY2RlZg=="
+	rotatedKey = "ZmVkY2JhOTg3NjU0MzIxMA=="
+)
+
+func testKeyring(t *testing.T, run runFunc) {
+	ctx := context.Background()
+	_, err := run(ctx, "", "keyring", "install", "-key", rotatedKey)
+	require.NoError(t, err)
+	out, err := run(ctx, "", "keyring", "list")
+	require.NoError(t, err)
+	require.Regexp(t, testKey+`\s+1\s+1\n`, out)
+	require.Regexp(t, rotatedKey+`\s+1\s+0\n`, out)
+
+	_, err = run(ctx, "", "keyring", "use", "-key", rotatedKey)
+	require.NoError(t, err)
+	_, err = run(ctx, "", "keyring", "remove", "-key", testKey)
+	require.NoError(t, err)
+	out, err = run(ctx, "", "keyring", "list")
+	require.NoError(t, err)
+	require.NotContains(t, out, testKey)
+	require.Regexp(t, rotatedKey+`\s+1\s+1\n`, out)
+
+	//the primary key can't be removed
+	out, err = run(ctx, "", "keyring", "remove", "-key", rotatedKey)
+	require.Error(t, err)
+	require.Contains(t, out, "primary key")
+	_, err = run(ctx, "", "keyring", "install", "-key", "not a key")
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = run(ctx, "", "keyring", "install")
+	require.ErrorIs(t, err, flag.ErrHelp)
+}
+
+func testAuditLog(t *testing.T, run runFunc) {
+	ctx := context.Background()
+	_, err := run(ctx, "foo", "produce")
+	require.NoError(t, err)
+	methods := func() []string {
+		out, err := run(ctx, "", "-log", "audit", "consume", "-format", "raw", "-framing", "length")
+		require.NoError(t, err)
+		var methods []string
+		for b := []byte(out); len(b) > 0; {
+			n := enc.Uint64(b[:8])
+			event := &api.AuditEvent{}
+			require.NoError(t, proto.Unmarshal(b[8:8+n], event))
+			require.Equal(t, "root", event.Subject)
+			methods = append(methods, event.Method)
+			b = b[8+n:]
+		}
+		return methods
+	}
+	//the events of the stream of produced records are written as the server sees them
+	require.Eventually(t, func() bool {
+		for _, m := range methods() {
+			if m == "/log.v1.Log/ProduceStream" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
+
+func testUnknownCommand(t *testing.T, run runFunc) {
+	_, err := run(context.Background(), "", "frobnicate")
+	require.Error(t, err)
+}
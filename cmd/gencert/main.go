@@ -0,0 +1,217 @@
+//Command gencert creates the CA and the certificates of a development or test deployment.
+//
+//	gencert [-dir dir] init [-server-cn cn] [-hosts hosts] [-clients cns] [-valid-for d] [-new-ca]
+//	gencert [-dir dir] issue -cn cn [-hosts hosts] [-ou units] [-server] [-client] [-name name]
+//	gencert [-dir dir] crl [-revoke names] [-valid-for d]
+//
+//init writes ca.pem, server.pem and a <cn>-client.pem for each client, with their keys, the way
+//the server and the tests expect them. The CA already in the directory is kept unless -new-ca.
+//issue signs another certificate with that CA. crl writes ca.crl, revoking the certificates of
+//the named files, for the server's -server-tls-crl-file
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/krehermann/proglog/internal/ca"
+	"github.com/krehermann/proglog/internal/config"
+)
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type command struct {
+	usage string
+	run   func(dir string, args []string, out io.Writer) error
+}
+
+var commands = map[string]command{
+	"init":  {"create the CA and the server and client certificates", initCerts},
+	"issue": {"sign a certificate with the CA", issue},
+	"crl":   {"write a certificate revocation list", crl},
+}
+
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("gencert", flag.ContinueOnError)
+	dir := fs.String("dir", filepath.Dir(config.CAFile), "Directory of the certificates.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gencert [-dir <dir>] <command> [command flags]\n\ncommands:\n")
+		for name, cmd := range commands {
+			fmt.Fprintf(fs.Output(), "  %-6s %s\n", name, cmd.usage)
+		}
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	return cmd.run(*dir, fs.Args()[1:], out)
+}
+
+func initCerts(dir string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	serverCN := fs.String("server-cn", "127.0.0.1", "Common name of the server certificate.")
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "Comma separated DNS names and IP addresses of the server.")
+	clients := fs.String("clients", "root,nobody", "Comma separated common names of the client certificates.")
+	validFor := fs.Duration("valid-for", ca.DefaultValidFor, "How long the certificates are valid for.")
+	newCA := fs.Bool("new-ca", false, "Create a new CA even if the directory has one.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	opts := ca.Options{
+		ServerCommonName: *serverCN,
+		ServerHosts:      split(*hosts),
+		Clients:          split(*clients),
+		ValidFor:         *validFor,
+	}
+	files := ca.FilesIn(dir)
+	if !*newCA {
+		opts.CA, err = ca.Load(files.CAFile, files.CAKeyFile)
+		if errors.Is(err, os.ErrNotExist) {
+			opts.CA, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = ca.Generate(dir, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "wrote %s, %s", files.CAFile, files.ServerCertFile)
+	for _, cn := range opts.Clients {
+		certFile, _ := ca.ClientFiles(dir, cn)
+		fmt.Fprintf(out, ", %s", certFile)
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+func issue(dir string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("issue", flag.ContinueOnError)
+	cn := fs.String("cn", "", "Common name of the certificate.")
+	hosts := fs.String("hosts", "", "Comma separated DNS names, IP addresses and URIs of the certificate.")
+	ous := fs.String("ou", "", "Comma separated organizational units of the certificate.")
+	server := fs.Bool("server", false, "Issue a server certificate.")
+	client := fs.Bool("client", false, "Issue a client certificate. The default unless -server.")
+	name := fs.String("name", "", "Name of the files, <name>.pem and <name>-key.pem. Defaults to <cn>-client or <cn>-server.")
+	validFor := fs.Duration("valid-for", ca.DefaultValidFor, "How long the certificate is valid for.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	//a certificate without a common name needs hosts to identify it and a name for its files
+	if *cn == "" && (*hosts == "" || *name == "") {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if !*server {
+		*client = true
+	}
+	if *name == "" {
+		*name = *cn + "-client"
+		if !*client {
+			*name = *cn + "-server"
+		}
+	}
+	files := ca.FilesIn(dir)
+	authority, err := ca.Load(files.CAFile, files.CAKeyFile)
+	if err != nil {
+		return fmt.Errorf("loading the CA, run init first: %w", err)
+	}
+	cert, err := authority.Issue(ca.Request{
+		CommonName:          *cn,
+		Hosts:               split(*hosts),
+		OrganizationalUnits: split(*ous),
+		Server:              *server,
+		Client:              *client,
+		ValidFor:            *validFor,
+	})
+	if err != nil {
+		return err
+	}
+	certFile := filepath.Join(dir, *name+".pem")
+	err = cert.Write(certFile, filepath.Join(dir, *name+"-key.pem"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "wrote %s, valid until %s\n", certFile, cert.Cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func crl(dir string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("crl", flag.ContinueOnError)
+	revoke := fs.String("revoke", "", "Comma separated names of the certificates to revoke, such as nobody-client for nobody-client.pem.")
+	validFor := fs.Duration("valid-for", 7*24*time.Hour, "How long until the CRL has to be replaced.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	files := ca.FilesIn(dir)
+	authority, err := ca.Load(files.CAFile, files.CAKeyFile)
+	if err != nil {
+		return fmt.Errorf("loading the CA, run init first: %w", err)
+	}
+	var revoked []*x509.Certificate
+	for _, name := range split(*revoke) {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name+".pem"))
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return fmt.Errorf("%s.pem has no certificate", name)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s.pem: %w", name, err)
+		}
+		revoked = append(revoked, cert)
+	}
+	b, err := authority.CRL(revoked, *validFor)
+	if err != nil {
+		return err
+	}
+	crlFile := filepath.Join(dir, "ca.crl")
+	err = ioutil.WriteFile(crlFile, b, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "wrote %s revoking %d certificates\n", crlFile, len(revoked))
+	return nil
+}
+
+//split splits a comma separated list, dropping empty elements
+func split(list string) []string {
+	elems := []string{}
+	for _, elem := range strings.Split(list, ",") {
+		elem = strings.TrimSpace(elem)
+		if elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return elems
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGencert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gencert-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	gencert := func(args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := run(append([]string{"-dir", dir}, args...), out)
+		return out.String(), err
+	}
+	load := func(name string) *x509.Certificate {
+		pair, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem"))
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		require.NoError(t, err)
+		return cert
+	}
+
+	_, err = gencert("issue", "-cn", "alice")
+	require.Error(t, err)
+
+	out, err := gencert("init", "-hosts", "proglog.example.org,10.0.0.1", "-clients", "root,nobody,alice")
+	require.NoError(t, err)
+	require.Contains(t, out, filepath.Join(dir, "alice-client.pem"))
+	ca := load("ca")
+	server := load("server")
+	require.Equal(t, []string{"proglog.example.org"}, server.DNSNames)
+	require.Equal(t, "10.0.0.1", server.IPAddresses[0].String())
+	require.NoError(t, server.CheckSignatureFrom(ca))
+	require.Equal(t, "alice", load("alice-client").Subject.CommonName)
+
+	//init keeps the CA unless told otherwise
+	_, err = gencert("init")
+	require.NoError(t, err)
+	require.Equal(t, ca.Raw, load("ca").Raw)
+	_, err = gencert("init", "-new-ca")
+	require.NoError(t, err)
+	require.NotEqual(t, ca.Raw, load("ca").Raw)
+	ca = load("ca")
+
+	out, err = gencert("issue", "-name", "spiffe", "-hosts", "spiffe://example.org/ns/prod/sa/root", "-ou", "prod")
+	require.NoError(t, err)
+	require.Contains(t, out, "valid until")
+	spiffe := load("spiffe")
+	require.Empty(t, spiffe.Subject.CommonName)
+	require.Equal(t, []string{"prod"}, spiffe.Subject.OrganizationalUnit)
+	require.Equal(t, "spiffe://example.org/ns/prod/sa/root", spiffe.URIs[0].String())
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, spiffe.ExtKeyUsage)
+	require.NoError(t, spiffe.CheckSignatureFrom(ca))
+
+	_, err = gencert("issue", "-cn", "node-1", "-server", "-hosts", "node-1.internal")
+	require.NoError(t, err)
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, load("node-1-server").ExtKeyUsage)
+
+	out, err = gencert("crl", "-revoke", "spiffe,nobody-client")
+	require.NoError(t, err)
+	require.Contains(t, out, "revoking 2 certificates")
+	b, err := ioutil.ReadFile(filepath.Join(dir, "ca.crl"))
+	require.NoError(t, err)
+	crl, err := x509.ParseCRL(b)
+	require.NoError(t, err)
+	require.NoError(t, ca.CheckCRLSignature(crl))
+	require.Len(t, crl.TBSCertList.RevokedCertificates, 2)
+	require.Equal(t, spiffe.SerialNumber, crl.TBSCertList.RevokedCertificates[0].SerialNumber)
+	_, err = gencert("crl", "-revoke", "missing")
+	require.Error(t, err)
+}
@@ -0,0 +1,262 @@
+//Command logtool inspects and repairs the log directory of a stopped server.
+//
+//	logtool -dir <data dir>/log segments
+//	logtool -dir <data dir>/log dump [-from offset] [-to offset]
+//	logtool -dir <data dir>/log verify
+//	logtool -dir <data dir>/log repair [-truncate-from offset]
+//	logtool -dir <data dir>/log export [-from offset] [-to offset] [-out file]
+//	logtool -dir <data dir>/log import [-in file] [-segment-max-store-bytes n] [-segment-max-index-bytes n]
+//
+//Only repair and import change the directory
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/log"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+//errProblems is returned by verify and repair when problems remain
+var errProblems = errors.New("the log has problems")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type command struct {
+	usage string
+	run   func(dir string, args []string, out io.Writer) error
+}
+
+var commands = map[string]command{
+	"segments": {"list the segments with their offsets and sizes", segments},
+	"dump":     {"print records as JSON, one per line", dump},
+	"verify":   {"check that stores and indexes are consistent", verify},
+	"repair":   {"cut off corrupted tails and rebuild indexes", repair},
+	"export":   {"write a range of records to an archive", export},
+	"import":   {"append the records of an archive, creating the log if needed", importArchive},
+}
+
+func run(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("logtool", flag.ContinueOnError)
+	dir := fs.String("dir", "", "Directory of the log, the log directory in the server's data dir.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: logtool -dir <dir> <command> [command flags]\n\ncommands:\n")
+		for name, cmd := range commands {
+			fmt.Fprintf(fs.Output(), "  %-9s %s\n", name, cmd.usage)
+		}
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok || *dir == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	return cmd.run(*dir, fs.Args()[1:], out)
+}
+
+func segments(dir string, args []string, out io.Writer) error {
+	infos, err := log.Inspect(dir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BASE\tNEXT\tSTORE BYTES\tINDEX BYTES\tPROBLEMS")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\n",
+			info.BaseOffset, info.NextOffset, info.StoreBytes, info.IndexBytes, len(info.Problems))
+	}
+	return w.Flush()
+}
+
+func dump(dir string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	from := fs.Uint64("from", 0, "Offset of the first record.")
+	to := fs.Int64("to", -1, "Offset after the last record. Defaults to the end of the log.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	m := protojson.MarshalOptions{EmitUnpopulated: true}
+	for off := *from; *to < 0 || off < uint64(*to); off++ {
+		r, err := log.ReadRecord(dir, off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok && *to < 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b, err := m.Marshal(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\n", b)
+	}
+	return nil
+}
+
+func verify(dir string, args []string, out io.Writer) error {
+	infos, err := log.Inspect(dir)
+	if err != nil {
+		return err
+	}
+	if !report(infos, out) {
+		return errProblems
+	}
+	return nil
+}
+
+func repair(dir string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	truncateFrom := fs.Int64("truncate-from", -1, "Also remove the records from this offset on.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	infos, err := log.Repair(dir)
+	if err != nil {
+		return err
+	}
+	if *truncateFrom >= 0 {
+		err = log.TruncateFrom(dir, uint64(*truncateFrom))
+		if err != nil {
+			return err
+		}
+		infos, err = log.Inspect(dir)
+		if err != nil {
+			return err
+		}
+	}
+	if !report(infos, out) {
+		return errProblems
+	}
+	return nil
+}
+
+func export(dir string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	from := fs.Uint64("from", 0, "Offset of the first record. Defaults to the start of the log.")
+	to := fs.Int64("to", -1, "Offset after the last record. Defaults to the end of the log.")
+	file := fs.String("out", "", "File to write the archive to. Defaults to stdout.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	infos, err := log.Inspect(dir)
+	if err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		return fmt.Errorf("no log in %s", dir)
+	}
+	fromSet := false
+	fs.Visit(func(f *flag.Flag) {
+		fromSet = fromSet || f.Name == "from"
+	})
+	if !fromSet {
+		*from = infos[0].BaseOffset
+	}
+	if *to < 0 {
+		*to = int64(infos[len(infos)-1].NextOffset)
+	}
+	if *file == "" {
+		return log.Export(out, dirReader(dir), *from, uint64(*to))
+	}
+	return writeFile(*file, func(w io.Writer) error {
+		return log.Export(w, dirReader(dir), *from, uint64(*to))
+	})
+}
+
+//writeFile writes name with write through a temporary file next to it, so that name is only
+//replaced once write succeeds
+func writeFile(name string, write func(io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func importArchive(dir string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := fs.String("in", "", "File to read the archive from. Defaults to stdin.")
+	cfg := log.Config{}
+	fs.Uint64Var(&cfg.Segment.MaxStoreBytes, "segment-max-store-bytes", 0, "Size at which a segment's store is full.")
+	fs.Uint64Var(&cfg.Segment.MaxIndexBytes, "segment-max-index-bytes", 0, "Size at which a segment's index is full.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	header, err := log.Import(r, dir, cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "imported %d records from offset %d\n", header.Count, header.FirstOffset)
+	return nil
+}
+
+//dirReader reads records from a log directory without opening the log
+type dirReader string
+
+func (d dirReader) Read(off uint64) (*api.Record, error) {
+	return log.ReadRecord(string(d), off)
+}
+
+//report prints the problems of the segments and returns true if there are none
+func report(infos []*log.SegmentInfo, out io.Writer) bool {
+	ok := true
+	for _, info := range infos {
+		for _, p := range info.Problems {
+			ok = false
+			fmt.Fprintf(out, "segment %d: %s\n", info.BaseOffset, p)
+		}
+	}
+	if ok {
+		fmt.Fprintf(out, "%d segments ok\n", len(infos))
+	}
+	return ok
+}
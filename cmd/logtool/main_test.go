@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogtool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logtool-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	for _, v := range []string{"foo", "bar"} {
+		_, err = l.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	logtool := func(args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := run(append([]string{"-dir", dir}, args...), out)
+		return out.String(), err
+	}
+	out, err := logtool("segments")
+	require.NoError(t, err)
+	require.Regexp(t, `(?m)^0\s+2\s+\d+\s+24\s+0$`, out)
+
+	out, err = logtool("dump", "-from", "1")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"value":"YmFy","offset":"1","metadata":{}}`, out)
+
+	out, err = logtool("verify")
+	require.NoError(t, err)
+	require.Equal(t, "1 segments ok\n", out)
+
+	//simulate an unclean shutdown
+	require.NoError(t, os.Truncate(filepath.Join(dir, "0.index"), 1024))
+	out, err = logtool("verify")
+	require.Equal(t, errProblems, err)
+	require.Contains(t, out, "segment 0: index has 1000 bytes of empty entries")
+
+	out, err = logtool("repair", "-truncate-from", "1")
+	require.NoError(t, err)
+	require.Equal(t, "1 segments ok\n", out)
+	out, err = logtool("dump")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"value":"Zm9v","offset":"0","metadata":{}}`, out)
+
+	_, err = logtool("frobnicate")
+	require.Error(t, err)
+}
+
+func TestLogtoolArchive(t *testing.T) {
+	src, err := ioutil.TempDir("", "logtool-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	l, err := log.NewLog(src, log.Config{})
+	require.NoError(t, err)
+	for _, v := range []string{"foo", "bar", "baz"} {
+		_, err = l.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+	dst, err := ioutil.TempDir("", "logtool-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dst)
+	archive := filepath.Join(dst, "archive")
+
+	out := &bytes.Buffer{}
+	err = run([]string{"-dir", src, "export", "-from", "1", "-out", archive}, out)
+	require.NoError(t, err)
+	err = run([]string{"-dir", filepath.Join(dst, "log"), "import", "-in", archive}, out)
+	require.NoError(t, err)
+	require.Equal(t, "imported 2 records from offset 1\n", out.String())
+
+	out.Reset()
+	err = run([]string{"-dir", filepath.Join(dst, "log"), "dump", "-from", "1"}, out)
+	require.NoError(t, err)
+	require.Equal(t, 2, bytes.Count(out.Bytes(), []byte("\n")))
+	require.Contains(t, out.String(), `"offset":"2"`)
+
+	//an explicit offset before the log is not replaced by its start, and the failed export leaves
+	//the archive as it was
+	before, err := ioutil.ReadFile(archive)
+	require.NoError(t, err)
+	err = run([]string{"-dir", filepath.Join(dst, "log"), "export", "-from", "0", "-out", archive}, out)
+	require.Error(t, err)
+	after, err := ioutil.ReadFile(archive)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	entries, err := ioutil.ReadDir(dst)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
@@ -1,12 +1,208 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/krehermann/proglog/internal/server"
+	"github.com/krehermann/proglog/internal/agent"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/config"
+	grpcserver "github.com/krehermann/proglog/internal/server"
+	"github.com/krehermann/proglog/internal/tracing"
+	"go.uber.org/multierr"
 )
 
 func main() {
-	srv := server.NewHTTPServer(":8099")
-	log.Fatal(srv.ListenAndServe())
+	c, err := config.LoadServer("proglog", os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	s, err := setupServer(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigc {
+		if sig == syscall.SIGHUP {
+			log.Printf("received %s, reloading", sig)
+			err = s.reload()
+			if err != nil {
+				log.Printf("failed to reload: %v", err)
+			}
+			continue
+		}
+		log.Printf("received %s, shutting down", sig)
+		err = s.shutdown()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+}
+
+//server is a running agent, the tls configurations and keys it reloads and the file it exports
+//spans to
+type server struct {
+	agent     *agent.Agent
+	serverTLS *config.ReloadableTLS
+	peerTLS   *config.ReloadableTLS
+	tokens    *auth.TokenAuthenticator
+	apiKeys   *auth.APIKeyAuthenticator
+	spans     *tracing.JSONExporter
+}
+
+//setupServer loads the tls files and starts the agent. Servers and peers are not secured
+//when none of their tls files are given
+func setupServer(c *config.Server) (*server, error) {
+	s := &server{}
+	var err error
+	s.serverTLS, err = setupTLSConfig(c.ServerTLS, true, c.ClientCertOptional())
+	if err != nil {
+		return nil, err
+	}
+	s.peerTLS, err = setupTLSConfig(c.PeerTLS, false, false)
+	if err != nil {
+		return nil, err
+	}
+	//clients with a certificate are authenticated by it, then by a token and then by an api key
+	identity, err := auth.NewCertIdentity(c.CertIdentity())
+	if err != nil {
+		return nil, err
+	}
+	authenticators := []grpcserver.Authenticator{grpcserver.TLSAuthenticator{Identity: identity}}
+	if c.Token().Enabled() {
+		s.tokens, err = auth.NewTokenAuthenticator(c.Token())
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, s.tokens)
+	}
+	if c.Auth.APIKeysFile != "" {
+		s.apiKeys, err = auth.NewAPIKeyAuthenticator(c.Auth.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, s.apiKeys)
+	}
+	tracingConfig := tracing.Config{SampleRate: c.Tracing.SampleRate}
+	if c.Tracing.File != "" {
+		s.spans, err = tracing.NewFileExporter(c.Tracing.File)
+		if err != nil {
+			return nil, err
+		}
+		tracingConfig.Exporter = s.spans
+	}
+	s.agent, err = agent.New(agent.Config{
+		ServerTLSConfig:     tlsConfig(s.serverTLS),
+		PeerTLSConfig:       tlsConfig(s.peerTLS),
+		DataDir:             c.DataDir,
+		BindAddr:            c.BindAddr,
+		RPCAddr:             c.RPCAddr,
+		HTTPAddr:            c.HTTPAddr,
+		NodeName:            c.NodeName,
+		StartJoinAddrs:      c.StartJoinAddrs,
+		ACLModelFile:        c.ACL.ModelFile,
+		ACLPolicyFile:       c.ACL.PolicyFile,
+		Authenticators:      authenticators,
+		Quotas:              quotas(c),
+		Log:                 c.Log(),
+		FailedGracePeriod:   c.Gossip.FailedGracePeriod,
+		EncryptKey:          c.Gossip.EncryptKey,
+		KeyringFile:         c.Gossip.KeyringFile,
+		HealthCheckInterval: c.Health.CheckInterval,
+		MaxReplicationLag:   c.Health.MaxReplicationLag,
+		MetricsAddr:         c.MetricsAddr,
+		Tracing:             tracingConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//quotas returns the quotas of the configuration
+func quotas(c *config.Server) grpcserver.Quotas {
+	quota := func(r config.QuotaRates) grpcserver.Quota {
+		return grpcserver.Quota{
+			ProduceBytesPerSecond:   r.ProduceBytesPerSecond,
+			ProduceRecordsPerSecond: r.ProduceRecordsPerSecond,
+			ConsumeBytesPerSecond:   r.ConsumeBytesPerSecond,
+		}
+	}
+	q := grpcserver.Quotas{Default: quota(c.Quota.QuotaRates), ThrottleStreams: c.Quota.ThrottleStreams}
+	for subject, r := range c.Quota.Subjects {
+		if q.Subjects == nil {
+			q.Subjects = make(map[string]grpcserver.Quota)
+		}
+		q.Subjects[subject] = quota(r)
+	}
+	return q
+}
+
+//shutdown shuts the agent down and then closes the span file
+func (s *server) shutdown() error {
+	err := s.agent.Shutdown()
+	if err != nil {
+		return err
+	}
+	if s.spans != nil {
+		return s.spans.Close()
+	}
+	return nil
+}
+
+//reload reads the configuration again and reloads the tls files, the token and api key files, the
+//acl files and the log settings that can change while running. Changes to other settings need a
+//restart
+func (s *server) reload() error {
+	c, err := config.LoadServer("proglog", os.Args[1:], os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	//a file that fails to reload doesn't keep the others from being reloaded
+	var errs error
+	for _, r := range []*config.ReloadableTLS{s.serverTLS, s.peerTLS} {
+		if r != nil {
+			errs = multierr.Append(errs, r.Reload())
+		}
+	}
+	if s.tokens != nil {
+		errs = multierr.Append(errs, s.tokens.Reload())
+	}
+	if s.apiKeys != nil {
+		errs = multierr.Append(errs, s.apiKeys.Reload())
+	}
+	return multierr.Append(errs, s.agent.Reload(c.Log()))
+}
+
+func setupTLSConfig(files config.TLSFiles, server, clientCertOptional bool) (*config.ReloadableTLS, error) {
+	if !files.Enabled() {
+		return nil, nil
+	}
+	return config.NewReloadableTLS(config.TLSConfig{
+		CertFile:           files.CertFile,
+		KeyFile:            files.KeyFile,
+		CAFile:             files.CAFile,
+		Server:             server,
+		ClientCertOptional: clientCertOptional,
+		CRLFile:            files.CRLFile,
+		RevokedSerialsFile: files.RevokedSerialsFile,
+		ServerAddress:      files.ServerName,
+	})
+}
+
+func tlsConfig(r *config.ReloadableTLS) *tls.Config {
+	if r == nil {
+		return nil
+	}
+	return r.Config()
 }
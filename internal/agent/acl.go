@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/discovery"
+	"github.com/krehermann/proglog/internal/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//aclLogName is the name of the internal log of acl changes. Its records are the resource acl/records
+const aclLogName = "acl"
+
+//aclCatchUpInterval is how often the authorizer applies the acl changes replicated from the leader
+var aclCatchUpInterval = 100 * time.Millisecond
+
+//acl makes acl changes on the leader only, as the acl log of the other servers is replicated from it
+type acl struct {
+	*auth.Authorizer
+	membership *discovery.Membership
+	replicator *log.Replicator
+}
+
+//Change makes the change once the server has joined the cluster and knows that it leads it. A
+//server that has not learned of the other members yet would otherwise take itself for the leader,
+//and its acl log would diverge from the replicated one
+func (a *acl) Change(c *api.ACLChange) error {
+	if a.membership == nil || a.replicator == nil || !a.membership.Joined() {
+		return status.Error(codes.FailedPrecondition, "acl changes are made once the server has joined the cluster")
+	}
+	var peers []string
+	for _, member := range a.membership.Members() {
+		if member.Status == serf.StatusAlive && member.Name != a.replicator.LocalName {
+			peers = append(peers, member.Name)
+		}
+	}
+	if !a.replicator.Leads(peers) {
+		return status.Error(codes.FailedPrecondition, "acl changes are made on the leader")
+	}
+	return a.Authorizer.Change(c)
+}
+
+//aclLogWriter is the local server of the acl replicator. The server denies produces to internal
+//logs, so the changes replicated from the leader are appended to the acl log in process instead.
+//The replicator only calls Produce
+type aclLogWriter struct {
+	api.LogClient
+	log *log.Log
+}
+
+func (w *aclLogWriter) Produce(ctx context.Context, req *api.ProduceRequest, opts ...grpc.CallOption) (*api.ProduceResponse, error) {
+	offset, err := w.log.Append(req.Record)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: offset}, nil
+}
+
+//setupACL opens the acl log and creates the authorizer, which applies the changes in the log and
+//keeps applying the changes replicated to it until shutdown
+func (a *Agent) setupACL() error {
+	dir := filepath.Join(a.DataDir, aclLogName)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	a.aclLog, err = log.NewLog(dir, log.Config{DisableMetrics: true})
+	if err != nil {
+		return err
+	}
+	a.authorizer = auth.New(a.ACLModelFile, a.ACLPolicyFile)
+	err = a.authorizer.UseChangeLog(a.aclLog)
+	if err != nil {
+		return err
+	}
+	a.acl = &acl{Authorizer: a.authorizer}
+	a.aclStop = make(chan struct{})
+	a.aclDone = make(chan struct{})
+	go func() {
+		defer close(a.aclDone)
+		ticker := time.NewTicker(aclCatchUpInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.aclStop:
+				return
+			case <-ticker.C:
+				err := a.authorizer.CatchUp()
+				if err != nil {
+					a.logger.Error("failed to apply acl changes", zap.Error(err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) stopACL() error {
+	if a.aclStop != nil {
+		close(a.aclStop)
+		<-a.aclDone
+	}
+	return a.aclLog.Close()
+}
@@ -0,0 +1,415 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/discovery"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/krehermann/proglog/internal/metrics"
+	"github.com/krehermann/proglog/internal/server"
+	"github.com/krehermann/proglog/internal/tracing"
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+//Config is the configuration of an agent
+type Config struct {
+	//ServerTLSConfig secures the rpc and http servers. PeerTLSConfig secures the connections the agent
+	//makes to servers, including its own, to replicate
+	ServerTLSConfig *tls.Config
+	PeerTLSConfig   *tls.Config
+	//DataDir is where the log and the acl log are stored
+	DataDir string
+	//BindAddr is the address serf gossips on and RPCAddr is the address the rpc server listens on
+	BindAddr string
+	RPCAddr  string
+	//HTTPAddr is the address the HTTP/JSON API listens on, secured by ServerTLSConfig. The API is
+	//not served when it is empty
+	HTTPAddr string
+	NodeName string
+	//StartJoinAddrs are the serf addresses of members of the cluster to join
+	StartJoinAddrs []string
+	ACLModelFile   string
+	ACLPolicyFile  string
+	//Authenticators resolve the subjects of rpcs. See server.Config
+	Authenticators []server.Authenticator
+	//Quotas limit the rate each subject produces and consumes at
+	Quotas server.Quotas
+	Log    log.Config
+	//FailedGracePeriod, EncryptKey and KeyringFile configure membership. See discovery.Config
+	FailedGracePeriod time.Duration
+	EncryptKey        string
+	KeyringFile       string
+	//HealthCheckInterval is how often the readiness of the agent is checked, a second by default.
+	//MaxReplicationLag is how many records a follower may be behind the leader and still serve
+	//produces. See checkHealth
+	HealthCheckInterval time.Duration
+	MaxReplicationLag   uint64
+	//ShutdownTimeout is how long Shutdown lets in flight rpcs and http requests finish before it
+	//cancels them, ten seconds by default. Streams such as tails only finish when they are canceled
+	ShutdownTimeout time.Duration
+	//Tracing configures sampling and exporting spans for the whole process
+	Tracing tracing.Config
+	//MetricsAddr is the address metrics are served on in the Prometheus format, at /metrics.
+	//Metrics are not collected when it is empty
+	MetricsAddr string
+}
+
+var defaultShutdownTimeout = 10 * time.Second
+
+//Agent runs the components of a node: the log, the rpc server, membership and replication
+type Agent struct {
+	Config
+
+	log          *log.Log
+	aclLog       *log.Log
+	auditLog     *log.Log
+	authorizer   *auth.Authorizer
+	acl          *acl
+	aclStop      chan struct{}
+	aclDone      chan struct{}
+	server       *grpc.Server
+	serverConfig *server.Config
+	listener     net.Listener
+	httpServer   *http.Server
+	httpListener net.Listener
+	membership   *discovery.Membership
+	//localConn is the connection the replicator writes to the local server with
+	localConn  *grpc.ClientConn
+	replicator *log.Replicator
+	//aclReplicator replicates the acl log
+	aclReplicator *log.Replicator
+	health        *health.Server
+	healthStatus  map[string]healthpb.HealthCheckResponse_ServingStatus
+	healthStop    chan struct{}
+	healthDone    chan struct{}
+	metrics       *http.Server
+	stopTracing   func()
+	logger        *zap.Logger
+
+	shutdown     bool
+	shutdownLock sync.Mutex
+}
+
+//New creates an agent and starts its components in dependency order. Components that were
+//started are shut down if a later one fails to start
+func New(config Config) (*Agent, error) {
+	a := &Agent{
+		Config: config,
+		logger: zap.L().Named("agent"),
+	}
+	setup := []func() error{
+		a.setupTracing,
+		a.setupMetrics,
+		a.setupLog,
+		a.setupACL,
+		a.setupServer,
+		a.setupHTTP,
+		a.setupMembership,
+		a.setupHealth,
+		a.serve,
+	}
+	for _, fn := range setup {
+		err := fn()
+		if err != nil {
+			return nil, multierr.Append(err, a.Shutdown())
+		}
+	}
+	return a, nil
+}
+
+func (a *Agent) setupTracing() error {
+	a.stopTracing = tracing.Apply(a.Tracing)
+	return nil
+}
+
+//setupMetrics registers the views of the log and serves them with the rpc views on MetricsAddr
+func (a *Agent) setupMetrics() error {
+	if a.MetricsAddr == "" {
+		return nil
+	}
+	err := view.Register(log.Views...)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", a.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.NewHandler())
+	a.metrics = &http.Server{Handler: mux}
+	go func() {
+		err := a.metrics.Serve(ln)
+		if err != http.ErrServerClosed {
+			a.logger.Error("failed to serve metrics", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+//setupLog opens the log and the audit log. The audit log is not replicated, as each server audits
+//the rpcs it serves
+func (a *Agent) setupLog() error {
+	dir := filepath.Join(a.DataDir, "log")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	a.log, err = log.NewLog(dir, a.Config.Log)
+	if err != nil {
+		return err
+	}
+	dir = filepath.Join(a.DataDir, server.AuditLogName)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	a.auditLog, err = log.NewLog(dir, log.Config{DisableMetrics: true})
+	return err
+}
+
+//setupServer creates the rpc server and its listener. It serves once membership is set up
+func (a *Agent) setupServer() error {
+	var err error
+	a.listener, err = net.Listen("tcp", a.RPCAddr)
+	if err != nil {
+		return err
+	}
+	a.health = newHealthServer()
+	a.serverConfig = &server.Config{
+		CommitLog:      a.log,
+		AdminLog:       a.log,
+		Authorizer:     a.authorizer,
+		Authenticators: a.Authenticators,
+		Health:         a.health,
+		Logs:           map[string]server.CommitLog{aclLogName: a.aclLog},
+		ACL:            a.acl,
+		AuditLog:       a.auditLog,
+		Quotas:         a.Quotas,
+	}
+	var opts []grpc.ServerOption
+	if a.ServerTLSConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(a.ServerTLSConfig)))
+	}
+	a.server, err = server.NewGRPCServer(a.serverConfig, opts...)
+	return err
+}
+
+//setupHTTP creates the http server of the JSON API and its listener, serving the same log with
+//the same checks as the rpc server
+func (a *Agent) setupHTTP() error {
+	if a.HTTPAddr == "" {
+		return nil
+	}
+	var err error
+	a.httpListener, err = net.Listen("tcp", a.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	if a.ServerTLSConfig != nil {
+		a.httpListener = tls.NewListener(a.httpListener, a.ServerTLSConfig)
+	}
+	a.httpServer, err = server.NewHTTPServer(a.serverConfig)
+	return err
+}
+
+//setupMembership joins the cluster and replicates from its leader
+func (a *Agent) setupMembership() error {
+	//replication continues the traces records were produced in
+	opts := []grpc.DialOption{grpc.WithStatsHandler(&ocgrpc.ClientHandler{})}
+	if a.PeerTLSConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(a.PeerTLSConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	rpcAddr := a.listener.Addr().String()
+	var err error
+	a.localConn, err = grpc.Dial(rpcAddr, opts...)
+	if err != nil {
+		return err
+	}
+	a.replicator = &log.Replicator{
+		DialOpts:    opts,
+		LocalServer: api.NewLogClient(a.localConn),
+		LocalName:   a.NodeName,
+		LocalLog:    a.log,
+	}
+	a.aclReplicator = &log.Replicator{
+		DialOpts:    opts,
+		LocalServer: &aclLogWriter{log: a.aclLog},
+		LocalName:   a.NodeName,
+		Log:         aclLogName,
+		LocalLog:    a.aclLog,
+	}
+	a.acl.replicator = a.replicator
+	handlers := discovery.Handlers{a.replicator, a.aclReplicator}
+	a.membership, err = discovery.NewMembership(handlers, discovery.Config{
+		NodeName: a.NodeName,
+		BindAddr: a.BindAddr,
+		Tags: map[string]string{
+			"rpc_addr": rpcAddr,
+		},
+		StartJoinAddrs:    a.StartJoinAddrs,
+		FailedGracePeriod: a.FailedGracePeriod,
+		EncryptKey:        a.EncryptKey,
+		KeyringFile:       a.KeyringFile,
+	})
+	if err != nil {
+		return err
+	}
+	a.serverConfig.GetServerer = a.replicator.Servers(a.membership)
+	a.acl.membership = a.membership
+	a.serverConfig.Keyring = a.membership
+	return nil
+}
+
+func (a *Agent) serve() error {
+	go func() {
+		err := a.server.Serve(a.listener)
+		if err != nil {
+			a.logger.Error("failed to serve", zap.Error(err))
+		}
+	}()
+	if a.httpServer != nil {
+		go func() {
+			err := a.httpServer.Serve(a.httpListener)
+			if err != http.ErrServerClosed {
+				a.logger.Error("failed to serve http", zap.Error(err))
+			}
+		}()
+	}
+	return nil
+}
+
+//Reload reloads the ACL model and policy files and applies the log settings that can change while
+//the agent runs. Other settings need a restart. TLS files are reloaded by the configurations
+//passed in, see config.ReloadableTLS
+func (a *Agent) Reload(logConfig log.Config) error {
+	errs := a.authorizer.Reload()
+	err := a.log.Reconfigure(logConfig)
+	if err != nil {
+		return multierr.Append(errs, err)
+	}
+	a.Config.Log = logConfig
+	return errs
+}
+
+//Shutdown stops the components in the reverse of the order they started. It reports that the
+//agent is not serving, leaves the cluster, stops replicating, lets in flight rpcs finish, closes
+//the log, flushing buffered writes, and finally stops serving metrics and exporting spans. Every
+//component is stopped even if stopping another failed, and the errors are returned together
+func (a *Agent) Shutdown() error {
+	a.shutdownLock.Lock()
+	defer a.shutdownLock.Unlock()
+	if a.shutdown {
+		return nil
+	}
+	a.shutdown = true
+
+	var shutdown []func() error
+	if a.health != nil {
+		shutdown = append(shutdown, a.stopHealth)
+	}
+	if a.membership != nil {
+		shutdown = append(shutdown, a.membership.Leave, a.membership.Shutdown)
+	}
+	if a.replicator != nil {
+		shutdown = append(shutdown, a.replicator.Close, a.aclReplicator.Close)
+	}
+	if a.localConn != nil {
+		shutdown = append(shutdown, a.localConn.Close)
+	}
+	if a.server != nil {
+		shutdown = append(shutdown, a.stopServer)
+	} else if a.listener != nil {
+		shutdown = append(shutdown, a.listener.Close)
+	}
+	if a.httpServer != nil {
+		shutdown = append(shutdown, a.stopHTTP)
+	} else if a.httpListener != nil {
+		shutdown = append(shutdown, a.httpListener.Close)
+	}
+	if a.log != nil {
+		shutdown = append(shutdown, a.log.Close)
+	}
+	if a.auditLog != nil {
+		shutdown = append(shutdown, a.auditLog.Close)
+	}
+	if a.aclLog != nil {
+		shutdown = append(shutdown, a.stopACL)
+	}
+	if a.metrics != nil {
+		shutdown = append(shutdown, a.metrics.Close)
+	}
+	if a.stopTracing != nil {
+		shutdown = append(shutdown, func() error {
+			a.stopTracing()
+			return nil
+		})
+	}
+	var errs error
+	for _, fn := range shutdown {
+		errs = multierr.Append(errs, fn())
+	}
+	if errs != nil {
+		return fmt.Errorf("failed to shut down agent: %w", errs)
+	}
+	return nil
+}
+
+func (a *Agent) shutdownTimeout() time.Duration {
+	if a.ShutdownTimeout == 0 {
+		return defaultShutdownTimeout
+	}
+	return a.ShutdownTimeout
+}
+
+//stopHTTP lets in flight http requests finish for up to ShutdownTimeout and then closes the
+//connections left
+func (a *Agent) stopHTTP() error {
+	timeout := a.shutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := a.httpServer.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		a.logger.Warn("closing http requests that did not finish in time", zap.Duration("timeout", timeout))
+		return a.httpServer.Close()
+	}
+	return err
+}
+
+//stopServer lets in flight rpcs finish for up to ShutdownTimeout and then cancels the ones left
+func (a *Agent) stopServer() error {
+	timeout := a.shutdownTimeout()
+	stopped := make(chan struct{})
+	go func() {
+		a.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		a.logger.Warn("canceling rpcs that did not finish in time", zap.Duration("timeout", timeout))
+		a.server.Stop()
+		<-stopped
+	}
+	return nil
+}
@@ -0,0 +1,681 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/config"
+	"github.com/krehermann/proglog/internal/discovery"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/krehermann/proglog/internal/server"
+	"github.com/krehermann/proglog/internal/testconfig"
+	"github.com/krehermann/proglog/internal/tracing"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestAgent(t *testing.T) {
+	files := testconfig.New(t)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      files.ServerCertFile,
+		KeyFile:       files.ServerKeyFile,
+		CAFile:        files.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      files.RootClientCertFile,
+		KeyFile:       files.RootClientKeyFile,
+		CAFile:        files.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		bindAddr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+		rpcAddr := fmt.Sprintf("127.0.0.1:%d", ports[1])
+		dataDir, err := ioutil.TempDir("", "agent-test")
+		require.NoError(t, err)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].BindAddr)
+		}
+		agent, err := New(Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        bindAddr,
+			RPCAddr:         rpcAddr,
+			DataDir:         dataDir,
+			ACLModelFile:    files.ACLModelFile,
+			ACLPolicyFile:   files.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.DataDir))
+		}
+	}()
+
+	//agent 0 has the lowest name so it leads and the others replicate from it
+	leader := client(t, agents[0], peerTLSConfig)
+	ctx := context.Background()
+	produce, err := leader.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	require.NoError(t, err)
+	consume, err := leader.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), consume.Record.Value)
+
+	for _, agent := range agents[1:] {
+		follower := client(t, agent, peerTLSConfig)
+		require.Eventually(t, func() bool {
+			consume, err := follower.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+			return err == nil && string(consume.Record.Value) == "foo"
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+
+	//the leader is reported once agent 0 has compared its log with the others'
+	require.Eventually(t, func() bool {
+		servers, err := leader.GetServers(ctx, &api.GetServersRequest{})
+		return err == nil && len(servers.Servers) == 3 && servers.Servers[0].IsLeader
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestAgentShutdownIsIdempotent(t *testing.T) {
+	files := testconfig.New(t)
+	ports := dynaport.Get(2)
+	dataDir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	agent, err := New(Config{
+		NodeName:      "0",
+		BindAddr:      fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCAddr:       fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		DataDir:       dataDir,
+		ACLModelFile:  files.ACLModelFile,
+		ACLPolicyFile: files.ACLPolicyFile,
+	})
+	require.NoError(t, err)
+	require.NoError(t, agent.Shutdown())
+	require.NoError(t, agent.Shutdown())
+}
+
+func TestAgentShutdownCancelsStreams(t *testing.T) {
+	files := testconfig.New(t)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      files.RootClientCertFile,
+		KeyFile:       files.RootClientKeyFile,
+		CAFile:        files.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	ports := dynaport.Get(3)
+	dataDir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	agent, err := New(Config{
+		NodeName:        "0",
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCAddr:         fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		HTTPAddr:        fmt.Sprintf("127.0.0.1:%d", ports[2]),
+		DataDir:         dataDir,
+		ACLModelFile:    files.ACLModelFile,
+		ACLPolicyFile:   files.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+		ShutdownTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	//a tail waits for the next record until it is canceled, over rpcs and over http
+	c := client(t, agent, peerTLSConfig)
+	_, err = c.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}})
+	require.NoError(t, err)
+	stream, err := c.ConsumeStream(context.Background(), &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: peerTLSConfig}}
+	res, err := httpClient.Get(fmt.Sprintf("https://%s/records/events", agent.HTTPAddr))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	done := make(chan error)
+	go func() {
+		done <- agent.Shutdown()
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown waited for the tail")
+	}
+	_, err = stream.Recv()
+	require.Error(t, err)
+	_, err = ioutil.ReadAll(res.Body)
+	require.Error(t, err)
+}
+
+func TestAgentHTTP(t *testing.T) {
+	files := testconfig.New(t)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	rootTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      files.RootClientCertFile,
+		KeyFile:       files.RootClientKeyFile,
+		CAFile:        files.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	ports := dynaport.Get(3)
+	dataDir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	agent, err := New(Config{
+		ServerTLSConfig: serverTLSConfig,
+		NodeName:        "0",
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCAddr:         fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		HTTPAddr:        fmt.Sprintf("127.0.0.1:%d", ports[2]),
+		DataDir:         dataDir,
+		ACLModelFile:    files.ACLModelFile,
+		ACLPolicyFile:   files.ACLPolicyFile,
+	})
+	require.NoError(t, err)
+	defer agent.Shutdown()
+
+	//records produced over http are consumed over rpcs
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: rootTLSConfig}}
+	res, err := httpClient.Post(fmt.Sprintf("https://%s/records", agent.HTTPAddr), "application/json",
+		strings.NewReader(`{"value":"Zm9v"}`))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	consumed, err := client(t, agent, rootTLSConfig).Consume(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), consumed.Record.Value)
+
+	//the api is only served over tls
+	res, err = http.Get(fmt.Sprintf("http://%s/records/0", agent.HTTPAddr))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
+	t.Helper()
+	conn, err := grpc.Dial(agent.RPCAddr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return api.NewLogClient(conn)
+}
+
+func TestAgentHealth(t *testing.T) {
+	files := testconfig.New(t)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	rootTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.RootClientCertFile,
+		KeyFile:  files.RootClientKeyFile,
+		CAFile:   files.CAFile,
+	})
+	require.NoError(t, err)
+	nobodyTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.NobodyClientCertFile,
+		KeyFile:  files.NobodyClientKeyFile,
+		CAFile:   files.CAFile,
+	})
+	require.NoError(t, err)
+
+	//agent 1 is not allowed to consume from the leader, so it cannot tell how far behind it is
+	var agents []*Agent
+	for i, peerTLSConfig := range []*tls.Config{rootTLSConfig, nobodyTLSConfig, rootTLSConfig} {
+		ports := dynaport.Get(2)
+		dataDir, err := ioutil.TempDir("", "agent-test")
+		require.NoError(t, err)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].BindAddr)
+		}
+		agent, err := New(Config{
+			NodeName:            fmt.Sprintf("%d", i),
+			StartJoinAddrs:      startJoinAddrs,
+			BindAddr:            fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCAddr:             fmt.Sprintf("127.0.0.1:%d", ports[1]),
+			DataDir:             dataDir,
+			ACLModelFile:        files.ACLModelFile,
+			ACLPolicyFile:       files.ACLPolicyFile,
+			ServerTLSConfig:     serverTLSConfig,
+			PeerTLSConfig:       peerTLSConfig,
+			HealthCheckInterval: 50 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.DataDir))
+		}
+	}()
+
+	_, err = client(t, agents[0], rootTLSConfig).Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	require.NoError(t, err)
+
+	serving := healthpb.HealthCheckResponse_SERVING
+	notServing := healthpb.HealthCheckResponse_NOT_SERVING
+	for i, want := range []map[string]healthpb.HealthCheckResponse_ServingStatus{
+		{"": serving, server.ProduceHealthService: serving, server.ConsumeHealthService: serving},
+		{"": notServing, server.ProduceHealthService: notServing, server.ConsumeHealthService: serving},
+		{"": serving, server.ProduceHealthService: serving, server.ConsumeHealthService: serving},
+	} {
+		health := healthClient(t, agents[i], rootTLSConfig)
+		for service, status := range want {
+			require.Eventually(t, func() bool {
+				res, err := health.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+				return err == nil && res.Status == status
+			}, 5*time.Second, 50*time.Millisecond, "agent %d service %q", i, service)
+		}
+	}
+
+	//the follower that replicates is not lagging
+	lag, ok := agents[2].replicator.Lag()
+	require.True(t, ok)
+	require.Equal(t, uint64(0), lag)
+}
+
+func TestAgentMetrics(t *testing.T) {
+	files := testconfig.New(t)
+	ports := dynaport.Get(3)
+	dataDir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	agent, err := New(Config{
+		NodeName:      "0",
+		BindAddr:      fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCAddr:       fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		MetricsAddr:   fmt.Sprintf("127.0.0.1:%d", ports[2]),
+		DataDir:       dataDir,
+		ACLModelFile:  files.ACLModelFile,
+		ACLPolicyFile: files.ACLPolicyFile,
+	})
+	require.NoError(t, err)
+	defer agent.Shutdown()
+
+	conn, err := grpc.Dial(agent.RPCAddr, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = api.NewLogClient(conn).Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	//without tls the subject is empty and not authorized, which is counted as an error
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	for _, want := range []string{
+		"proglog_log_segments 1",
+		"proglog_log_next_offset 0",
+		`grpc_io_server_completed_rpcs_total{grpc_server_method="log.v1.Log/Produce",grpc_server_status="PERMISSION_DENIED"}`,
+		"# TYPE grpc_io_server_server_latency histogram",
+	} {
+		require.Eventually(t, func() bool {
+			res, err := http.Get(fmt.Sprintf("http://%s/metrics", agent.MetricsAddr))
+			if err != nil {
+				return false
+			}
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			return err == nil && strings.Contains(string(body), want)
+		}, 5*time.Second, 50*time.Millisecond, want)
+	}
+}
+
+func TestAgentTracing(t *testing.T) {
+	files := testconfig.New(t)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	rootTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.RootClientCertFile,
+		KeyFile:  files.RootClientKeyFile,
+		CAFile:   files.CAFile,
+	})
+	require.NoError(t, err)
+
+	exporter := &spanRecorder{}
+	var agents []*Agent
+	for i := 0; i < 2; i++ {
+		ports := dynaport.Get(2)
+		dataDir, err := ioutil.TempDir("", "agent-test")
+		require.NoError(t, err)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].BindAddr)
+		}
+		agent, err := New(Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCAddr:         fmt.Sprintf("127.0.0.1:%d", ports[1]),
+			DataDir:         dataDir,
+			ACLModelFile:    files.ACLModelFile,
+			ACLPolicyFile:   files.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   rootTLSConfig,
+			Tracing:         tracing.Config{Exporter: exporter},
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.DataDir))
+		}
+	}()
+
+	conn, err := grpc.Dial(agents[0].RPCAddr,
+		grpc.WithStatsHandler(&ocgrpc.ClientHandler{}),
+		grpc.WithTransportCredentials(credentials.NewTLS(rootTLSConfig)),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, span := trace.StartSpan(context.Background(), "client", trace.WithSampler(trace.AlwaysSample()))
+	produce, err := api.NewLogClient(conn).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	span.End()
+	require.NoError(t, err)
+	traceID := span.SpanContext().TraceID
+
+	//the follower keeps the trace context of the record it replicated
+	follower := client(t, agents[1], rootTLSConfig)
+	require.Eventually(t, func() bool {
+		res, err := follower.Consume(context.Background(), &api.ConsumeRequest{Offset: produce.Offset})
+		if err != nil {
+			return false
+		}
+		sc, ok := tracing.Extract(res.Record)
+		return ok && sc.TraceID == traceID
+	}, 5*time.Second, 50*time.Millisecond)
+
+	//the produce on the leader and the produce replicating it on the follower are in the same trace
+	require.Eventually(t, func() bool {
+		names := exporter.names(traceID)
+		return names["log.v1.Log.Produce"] >= 2 && names["log.Replicator.replicate"] >= 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+//spanRecorder is an exporter that keeps the spans it receives
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+//names counts the spans in the trace by name
+func (r *spanRecorder) names(traceID trace.TraceID) map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make(map[string]int)
+	for _, s := range r.spans {
+		if s.TraceID == traceID {
+			names[s.Name]++
+		}
+	}
+	return names
+}
+
+func TestAgentACL(t *testing.T) {
+	files := testconfig.New(t)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	rootTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.RootClientCertFile,
+		KeyFile:  files.RootClientKeyFile,
+		CAFile:   files.CAFile,
+	})
+	require.NoError(t, err)
+	nobodyTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.NobodyClientCertFile,
+		KeyFile:  files.NobodyClientKeyFile,
+		CAFile:   files.CAFile,
+	})
+	require.NoError(t, err)
+
+	var agents []*Agent
+	for i := 0; i < 2; i++ {
+		ports := dynaport.Get(2)
+		dataDir, err := ioutil.TempDir("", "agent-test")
+		require.NoError(t, err)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].BindAddr)
+		}
+		agent, err := New(Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+			RPCAddr:         fmt.Sprintf("127.0.0.1:%d", ports[1]),
+			DataDir:         dataDir,
+			ACLModelFile:    files.ACLModelFile,
+			ACLPolicyFile:   files.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   rootTLSConfig,
+		})
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+			require.NoError(t, os.RemoveAll(agent.DataDir))
+		}
+	}()
+	ctx := context.Background()
+	produce, err := client(t, agents[0], rootTLSConfig).Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	require.NoError(t, err)
+	follower := client(t, agents[1], nobodyTLSConfig)
+	_, err = follower.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	//changes are made on the leader and replicated to the followers
+	binding := &api.AddRoleBindingRequest{RoleBinding: &api.RoleBinding{Subject: "nobody", Role: "reader"}}
+	require.Eventually(t, func() bool {
+		return !agents[1].replicator.Leading()
+	}, 5*time.Second, 50*time.Millisecond)
+	_, err = aclClient(t, agents[1], rootTLSConfig).AddRoleBinding(ctx, binding)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Eventually(t, func() bool {
+		_, err := aclClient(t, agents[0], rootTLSConfig).AddRoleBinding(ctx, binding)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, err := follower.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	//changes outlive reloading the policy files
+	require.NoError(t, agents[1].Reload(agents[1].Config.Log))
+	_, err = follower.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+}
+
+func TestACLChangeBeforeJoining(t *testing.T) {
+	files := testconfig.New(t)
+	changeLog, err := log.NewLog(t.TempDir(), log.Config{DisableMetrics: true})
+	require.NoError(t, err)
+	defer changeLog.Close()
+	authorizer := auth.New(files.ACLModelFile, files.ACLPolicyFile)
+	require.NoError(t, authorizer.UseChangeLog(changeLog))
+	change := &api.ACLChange{Rule: &api.ACLChange_RoleBinding{
+		RoleBinding: &api.RoleBinding{Subject: "nobody", Role: "reader"},
+	}}
+
+	//a server that has not joined doesn't know who leads
+	a := &acl{Authorizer: authorizer}
+	require.Equal(t, codes.FailedPrecondition, status.Code(a.Change(change)))
+
+	//nor does one that has joined but not learned of the other members, though none has a lower name
+	ports := dynaport.Get(2)
+	other, err := discovery.NewMembership(discovery.Handlers{}, discovery.Config{
+		NodeName: "1",
+		BindAddr: fmt.Sprintf("127.0.0.1:%d", ports[0]),
+	})
+	require.NoError(t, err)
+	defer other.Leave()
+	a.membership, err = discovery.NewMembership(discovery.Handlers{}, discovery.Config{
+		NodeName:       "0",
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		StartJoinAddrs: []string{other.BindAddr},
+	})
+	require.NoError(t, err)
+	defer a.membership.Leave()
+	a.replicator = &log.Replicator{LocalName: "0", LocalLog: changeLog}
+	defer a.replicator.Close()
+	require.True(t, a.membership.Joined())
+	require.True(t, a.replicator.Leading())
+	require.Equal(t, codes.FailedPrecondition, status.Code(a.Change(change)))
+
+	//it leads once it has compared its log with the other member's
+	require.NoError(t, a.replicator.Join("1", "127.0.0.1:1"))
+	require.Eventually(t, func() bool {
+		return a.Change(change) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func aclClient(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.ACLClient {
+	t.Helper()
+	conn, err := grpc.Dial(agent.RPCAddr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return api.NewACLClient(conn)
+}
+
+func healthClient(t *testing.T, agent *Agent, tlsConfig *tls.Config) healthpb.HealthClient {
+	t.Helper()
+	conn, err := grpc.Dial(agent.RPCAddr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestAgentReload(t *testing.T) {
+	files := testconfig.New(t)
+	dataDir, err := ioutil.TempDir("", "agent-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	modelFile := filepath.Join(dataDir, "model.conf")
+	model, err := ioutil.ReadFile(files.ACLModelFile)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(modelFile, model, 0600))
+	policyFile := filepath.Join(dataDir, "policy.csv")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte("p, root, *, produce\n"), 0600))
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	nobodyTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.NobodyClientCertFile,
+		KeyFile:  files.NobodyClientKeyFile,
+		CAFile:   files.CAFile,
+	})
+	require.NoError(t, err)
+	ports := dynaport.Get(2)
+	agent, err := New(Config{
+		NodeName:        "0",
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		RPCAddr:         fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		DataDir:         dataDir,
+		ACLModelFile:    modelFile,
+		ACLPolicyFile:   policyFile,
+		ServerTLSConfig: serverTLSConfig,
+	})
+	require.NoError(t, err)
+	defer agent.Shutdown()
+
+	nobody := client(t, agent, nobodyTLSConfig)
+	produce := func() error {
+		_, err := nobody.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("foo")},
+		})
+		return err
+	}
+	require.Equal(t, codes.PermissionDenied, status.Code(produce()))
+
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte("p, nobody, *, produce\n"), 0600))
+	logConfig := log.Config{}
+	logConfig.Retention.MaxBytes = 1 << 20
+	require.NoError(t, agent.Reload(logConfig))
+	require.NoError(t, produce())
+	require.Equal(t, logConfig, agent.Config.Log)
+
+	//an invalid acl keeps the current one
+	require.NoError(t, os.Remove(modelFile))
+	require.Error(t, agent.Reload(logConfig))
+	require.NoError(t, produce())
+}
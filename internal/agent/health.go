@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/krehermann/proglog/internal/server"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var defaultHealthCheckInterval = time.Second
+
+//healthServices are the services whose status the agent reports, including the whole server
+var healthServices = []string{
+	"",
+	server.LogHealthService,
+	server.ProduceHealthService,
+	server.ConsumeHealthService,
+	server.AdminHealthService,
+}
+
+//newHealthServer returns a health server that reports that nothing is serving until the first check
+func newHealthServer() *health.Server {
+	hsrv := health.NewServer()
+	for _, service := range healthServices {
+		hsrv.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	return hsrv
+}
+
+//setupHealth checks the readiness of the agent and keeps checking it until shutdown
+func (a *Agent) setupHealth() error {
+	interval := a.HealthCheckInterval
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+	a.checkHealth()
+	a.healthStop = make(chan struct{})
+	a.healthDone = make(chan struct{})
+	go func() {
+		defer close(a.healthDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.healthStop:
+				return
+			case <-ticker.C:
+				a.checkHealth()
+			}
+		}
+	}()
+	return nil
+}
+
+//checkHealth sets the status of the health services from the conditions the agent needs to serve.
+//Consumes and admin rpcs need a readable log. Produces also need a writable data dir, membership of
+//the cluster and a replication lag of at most MaxReplicationLag, so that a follower that is catching up
+//or cannot reach its leader still serves consumes. The whole server and the Log service are serving
+//when produces are
+func (a *Agent) checkHealth() {
+	var consume, produce []string
+	err := a.log.Check()
+	if err != nil {
+		consume = append(consume, fmt.Sprintf("log is not readable: %v", err))
+	}
+	produce = append(produce, consume...)
+	err = a.checkDataDir()
+	if err != nil {
+		produce = append(produce, fmt.Sprintf("data dir is not writable: %v", err))
+	}
+	if !a.membership.Joined() {
+		produce = append(produce, "not a member of the cluster")
+	}
+	lag, ok := a.replicator.Lag()
+	if !ok {
+		produce = append(produce, "replication lag is unknown")
+	} else if lag > a.MaxReplicationLag {
+		produce = append(produce, fmt.Sprintf("replication lag of %d records is above %d", lag, a.MaxReplicationLag))
+	}
+	a.setHealth(server.ConsumeHealthService, consume)
+	a.setHealth(server.AdminHealthService, consume)
+	a.setHealth(server.ProduceHealthService, produce)
+	a.setHealth(server.LogHealthService, produce)
+	a.setHealth("", produce)
+}
+
+//setHealth reports service as serving when there are no problems, logging changes of its status
+func (a *Agent) setHealth(service string, problems []string) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if len(problems) > 0 {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	if a.healthStatus == nil {
+		a.healthStatus = make(map[string]healthpb.HealthCheckResponse_ServingStatus)
+	}
+	if a.healthStatus[service] != status && service != "" {
+		a.logger.Info("health changed",
+			zap.String("service", service),
+			zap.String("status", status.String()),
+			zap.String("problems", strings.Join(problems, "; ")),
+		)
+	}
+	a.healthStatus[service] = status
+	a.health.SetServingStatus(service, status)
+}
+
+//checkDataDir writes and syncs a file in the data dir
+func (a *Agent) checkDataDir() error {
+	path := filepath.Join(a.DataDir, ".health")
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(time.Now().Format(time.RFC3339))
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Remove(path)
+}
+
+//stopHealth stops checking health and reports that nothing is serving
+func (a *Agent) stopHealth() error {
+	if a.healthStop != nil {
+		close(a.healthStop)
+		<-a.healthDone
+	}
+	a.health.Shutdown()
+	return nil
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//APIKeyMetadataKey is the request metadata key that holds an API key
+const APIKeyMetadataKey = "x-api-key"
+
+//APIKeyAuthenticator authenticates requests that carry a static API key. The keys file has a line
+//for each key with the subject of the key and the hex SHA-256 digest of the key, separated by
+//whitespace. Blank lines and lines starting with # are ignored. Only digests are stored so that the
+//file does not hold the keys themselves, for example:
+//
+//	# printf %s "$key" | sha256sum
+//	backup-tool 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+type APIKeyAuthenticator struct {
+	file string
+	mu   sync.RWMutex
+	//subjects are the subjects of the keys by their digest
+	subjects map[[sha256.Size]byte]string
+}
+
+//NewAPIKeyAuthenticator reads the keys in file
+func NewAPIKeyAuthenticator(file string) (*APIKeyAuthenticator, error) {
+	a := &APIKeyAuthenticator{file: file}
+	err := a.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+//Reload reads the keys file again. If it is invalid the current keys are kept
+func (a *APIKeyAuthenticator) Reload() error {
+	f, err := os.Open(a.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	subjects := make(map[[sha256.Size]byte]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want a subject and a key digest", a.file, n)
+		}
+		b, err := hex.DecodeString(fields[1])
+		if err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("%s:%d: key digest is not a hex SHA-256 digest", a.file, n)
+		}
+		var digest [sha256.Size]byte
+		copy(digest[:], b)
+		subjects[digest] = fields[0]
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.subjects = subjects
+	return nil
+}
+
+//Authenticate returns the subject of the API key of the request. Requests without an API key are
+//left to other authenticators
+func (a *APIKeyAuthenticator) Authenticate(ctx context.Context) (string, bool, error) {
+	key, ok := credential(ctx, APIKeyMetadataKey, "")
+	if !ok {
+		return "", false, nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	subject, ok := a.subjects[sha256.Sum256([]byte(key))]
+	if !ok {
+		return "", false, status.Error(codes.Unauthenticated, "invalid api key")
+	}
+	return subject, true, nil
+}
+
+//APIKeyCredentials sends an API key with each rpc
+type APIKeyCredentials struct {
+	Key string
+	//AllowInsecure sends the key on connections without TLS, where it can be read off the network
+	AllowInsecure bool
+}
+
+func (c APIKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{APIKeyMetadataKey: c.Key}, nil
+}
+
+func (c APIKeyCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
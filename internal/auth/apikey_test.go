@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikey-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	digest := func(key string) string {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	file := filepath.Join(dir, "keys")
+	write := func(content string) {
+		require.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+	}
+	write(fmt.Sprintf("# backup keys\n\nbackup %s\n  ingest   %s  \n", digest("backup-key"), digest("ingest-key")))
+	a, err := NewAPIKeyAuthenticator(file)
+	require.NoError(t, err)
+
+	authenticate := func(md ...string) (string, bool, error) {
+		return a.Authenticate(metadata.NewIncomingContext(context.Background(), metadata.Pairs(md...)))
+	}
+
+	for scenario, fn := range map[string]func(t *testing.T){
+		"valid key": func(t *testing.T) {
+			subject, ok, err := authenticate(APIKeyMetadataKey, "backup-key")
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, "backup", subject)
+			subject, ok, err = authenticate(APIKeyMetadataKey, "ingest-key")
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, "ingest", subject)
+		},
+		"unknown key": func(t *testing.T) {
+			_, ok, err := authenticate(APIKeyMetadataKey, "other-key")
+			require.False(t, ok)
+			require.Equal(t, codes.Unauthenticated, status.Code(err))
+		},
+		"no key": func(t *testing.T) {
+			_, ok, err := authenticate()
+			require.NoError(t, err)
+			require.False(t, ok)
+		},
+		"malformed files": func(t *testing.T) {
+			for _, content := range []string{
+				"backup\n",
+				"backup " + digest("backup-key") + " extra\n",
+				"backup not-hex\n",
+				"backup abcd\n",
+			} {
+				path := filepath.Join(dir, "malformed")
+				require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+				_, err := NewAPIKeyAuthenticator(path)
+				require.Error(t, err, content)
+			}
+		},
+	} {
+		t.Run(scenario, fn)
+	}
+
+	//reload replaces the keys, and keeps them if the file is invalid
+	write("ingest " + digest("new-key") + "\n")
+	require.NoError(t, a.Reload())
+	_, _, err = authenticate(APIKeyMetadataKey, "backup-key")
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	write("ingest\n")
+	require.Error(t, a.Reload())
+	subject, ok, err := authenticate(APIKeyMetadataKey, "new-key")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "ingest", subject)
+}
@@ -2,25 +2,51 @@ package auth
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/casbin/casbin"
+	api "github.com/krehermann/proglog/api/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
+//Authorizer enforces the policy of the model and policy files, with the changes of its change log
+//applied on top
 type Authorizer struct {
+	model    string
+	policy   string
+	mu       sync.RWMutex
 	enforcer *casbin.Enforcer
+	//changes are the changes applied from the change log, in order, so that they can be applied
+	//again when the files are reloaded
+	changes []*api.ACLChange
+	//logMu serializes reading the change log. next is the offset of the next change to apply
+	logMu     sync.Mutex
+	changeLog ChangeLog
+	next      uint64
+}
+
+//ChangeLog is the log ACL changes are written to. Each server applies the changes in its own copy
+//of the log, so servers converge on the same policy as the log is replicated
+type ChangeLog interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
 }
 
 func New(model, policy string) *Authorizer {
 	enforcer := casbin.NewEnforcer(model, policy)
+	enforcer.EnableAutoSave(false)
 	return &Authorizer{
+		model:    model,
+		policy:   policy,
 		enforcer: enforcer,
 	}
 }
 
 func (a *Authorizer) Authorize(subject, object, action string) error {
-
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 	if !a.enforcer.Enforce(subject, object, action) {
 		msg := fmt.Sprintf("%s not permitted to %s to %s", subject, action, object)
 		st := status.New(codes.PermissionDenied, msg)
@@ -28,3 +54,166 @@ func (a *Authorizer) Authorize(subject, object, action string) error {
 	}
 	return nil
 }
+
+//Reload reads the model and policy files again and applies the changes from the change log on top.
+//If they are invalid the current policy is kept
+func (a *Authorizer) Reload() error {
+	enforcer, err := casbin.NewEnforcerSafe(a.model, a.policy)
+	if err != nil {
+		return fmt.Errorf("failed to reload acl from %s and %s: %w", a.model, a.policy, err)
+	}
+	enforcer.EnableAutoSave(false)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.changes {
+		apply(enforcer, c)
+	}
+	a.enforcer = enforcer
+	return nil
+}
+
+//UseChangeLog applies the changes in l and makes Change write to it
+func (a *Authorizer) UseChangeLog(l ChangeLog) error {
+	a.logMu.Lock()
+	a.changeLog = l
+	a.next = 0
+	a.logMu.Unlock()
+	return a.CatchUp()
+}
+
+//Change writes c to the change log and applies it
+func (a *Authorizer) Change(c *api.ACLChange) error {
+	err := a.validate(c)
+	if err != nil {
+		return err
+	}
+	value, err := proto.Marshal(c)
+	if err != nil {
+		return err
+	}
+	a.logMu.Lock()
+	l := a.changeLog
+	a.logMu.Unlock()
+	if l == nil {
+		return status.Error(codes.Unimplemented, "acl has no change log")
+	}
+	_, err = l.Append(&api.Record{Value: value})
+	if err != nil {
+		return err
+	}
+	return a.CatchUp()
+}
+
+//CatchUp applies the changes written to the change log since it last caught up, such as the
+//changes replicated from the leader. Records that are not valid changes are skipped
+func (a *Authorizer) CatchUp() error {
+	a.logMu.Lock()
+	defer a.logMu.Unlock()
+	if a.changeLog == nil {
+		return nil
+	}
+	for {
+		record, err := a.changeLog.Read(a.next)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		a.next++
+		c := &api.ACLChange{}
+		if proto.Unmarshal(record.Value, c) != nil || a.validate(c) != nil {
+			continue
+		}
+		a.mu.Lock()
+		apply(a.enforcer, c)
+		a.changes = append(a.changes, c)
+		a.mu.Unlock()
+	}
+}
+
+//Policies returns the policies in effect
+func (a *Authorizer) Policies() []*api.Policy {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var policies []*api.Policy
+	for _, p := range a.enforcer.GetPolicy() {
+		if len(p) != 3 {
+			continue
+		}
+		policies = append(policies, &api.Policy{Subject: p[0], Object: p[1], Action: p[2]})
+	}
+	return policies
+}
+
+//RoleBindings returns the role bindings in effect
+func (a *Authorizer) RoleBindings() []*api.RoleBinding {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !hasRoles(a.enforcer) {
+		return nil
+	}
+	var bindings []*api.RoleBinding
+	for _, g := range a.enforcer.GetGroupingPolicy() {
+		if len(g) != 2 {
+			continue
+		}
+		bindings = append(bindings, &api.RoleBinding{Subject: g[0], Role: g[1]})
+	}
+	return bindings
+}
+
+//validate checks that c has every field of its rule, and that the model has roles if it binds one
+func (a *Authorizer) validate(c *api.ACLChange) error {
+	switch rule := c.Rule.(type) {
+	case *api.ACLChange_Policy:
+		p := rule.Policy
+		if p == nil || p.Subject == "" || p.Object == "" || p.Action == "" {
+			return status.Error(codes.InvalidArgument, "policy needs a subject, object and action")
+		}
+	case *api.ACLChange_RoleBinding:
+		b := rule.RoleBinding
+		if b == nil || b.Subject == "" || b.Role == "" {
+			return status.Error(codes.InvalidArgument, "role binding needs a subject and role")
+		}
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		if !hasRoles(a.enforcer) {
+			return status.Error(codes.FailedPrecondition, "acl model has no role definition")
+		}
+	default:
+		return status.Error(codes.InvalidArgument, "acl change has no policy or role binding")
+	}
+	return nil
+}
+
+//apply adds or removes the rule of c
+func apply(e *casbin.Enforcer, c *api.ACLChange) {
+	remove := c.Op == api.ACLChange_REMOVE
+	switch rule := c.Rule.(type) {
+	case *api.ACLChange_Policy:
+		p := rule.Policy
+		if remove {
+			e.RemovePolicy(p.Subject, p.Object, p.Action)
+		} else {
+			e.AddPolicy(p.Subject, p.Object, p.Action)
+		}
+	case *api.ACLChange_RoleBinding:
+		//the model of a reload may no longer define roles
+		if !hasRoles(e) {
+			return
+		}
+		b := rule.RoleBinding
+		if remove {
+			e.RemoveGroupingPolicy(b.Subject, b.Role)
+		} else {
+			e.AddGroupingPolicy(b.Subject, b.Role)
+		}
+	}
+}
+
+//hasRoles reports whether the model of e defines roles with a g section
+func hasRoles(e *casbin.Enforcer) bool {
+	_, ok := e.GetModel()["g"]["g"]
+	return ok
+}
@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const model = `[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = g(r.sub, p.sub) && keyMatch(r.obj, p.obj) && (r.act == p.act || p.act == "*")
+`
+
+const policy = `p, reader, log/records, consume
+p, operator, log/*, admin
+p, superuser, *, *
+g, alice, reader
+g, bob, operator
+g, operator, reader
+g, carol, superuser
+p, dave, log/records, produce
+`
+
+func TestAuthorizer(t *testing.T) {
+	a := setupTest(t)
+
+	for _, tc := range []struct {
+		subject, object, action string
+		allowed                 bool
+	}{
+		{"alice", "log/records", "consume", true},
+		{"alice", "log/records", "produce", false},
+		{"alice", "log/segments", "admin", false},
+		//operators inherit the reader role
+		{"bob", "log/records", "consume", true},
+		{"bob", "log/segments", "admin", true},
+		{"bob", "log/records", "admin", true},
+		{"bob", "cluster/servers", "admin", false},
+		{"carol", "cluster/servers", "replicate", true},
+		{"dave", "log/records", "produce", true},
+		{"dave", "log/records", "consume", false},
+		{"nobody", "log/records", "consume", false},
+	} {
+		err := a.Authorize(tc.subject, tc.object, tc.action)
+		if tc.allowed {
+			require.NoError(t, err, "%s %s %s", tc.subject, tc.action, tc.object)
+		} else {
+			require.Equal(t, codes.PermissionDenied, status.Code(err), "%s %s %s", tc.subject, tc.action, tc.object)
+		}
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	changes := &changeLog{}
+	leader := setupTest(t)
+	require.NoError(t, leader.UseChangeLog(changes))
+	require.Equal(t, codes.PermissionDenied, status.Code(leader.Authorize("erin", "log/records", "produce")))
+
+	require.NoError(t, leader.Change(&api.ACLChange{
+		Rule: &api.ACLChange_Policy{Policy: &api.Policy{Subject: "writer", Object: "log/*", Action: "produce"}},
+	}))
+	require.NoError(t, leader.Change(&api.ACLChange{
+		Rule: &api.ACLChange_RoleBinding{RoleBinding: &api.RoleBinding{Subject: "erin", Role: "writer"}},
+	}))
+	require.NoError(t, leader.Change(&api.ACLChange{
+		Op:   api.ACLChange_REMOVE,
+		Rule: &api.ACLChange_Policy{Policy: &api.Policy{Subject: "dave", Object: "log/records", Action: "produce"}},
+	}))
+	require.NoError(t, leader.Authorize("erin", "log/records", "produce"))
+	require.Error(t, leader.Authorize("dave", "log/records", "produce"))
+	require.Contains(t, leader.Policies(), &api.Policy{Subject: "writer", Object: "log/*", Action: "produce"})
+	require.Contains(t, leader.RoleBindings(), &api.RoleBinding{Subject: "erin", Role: "writer"})
+
+	//invalid changes are not written
+	for _, c := range []*api.ACLChange{
+		{},
+		{Rule: &api.ACLChange_Policy{Policy: &api.Policy{Subject: "erin"}}},
+		{Rule: &api.ACLChange_RoleBinding{RoleBinding: &api.RoleBinding{Role: "writer"}}},
+	} {
+		require.Equal(t, codes.InvalidArgument, status.Code(leader.Change(c)))
+	}
+	require.Len(t, changes.records, 3)
+
+	//a follower with a copy of the log converges on the same policy, skipping records that are not changes
+	follower := setupTest(t)
+	replica := &changeLog{records: append([]*api.Record{{Value: []byte("garbage")}}, changes.records...)}
+	require.NoError(t, follower.UseChangeLog(replica))
+	require.NoError(t, follower.Authorize("erin", "log/records", "produce"))
+	replica.records = append(replica.records, leaderChange(t, leader, &api.ACLChange{
+		Op:   api.ACLChange_REMOVE,
+		Rule: &api.ACLChange_RoleBinding{RoleBinding: &api.RoleBinding{Subject: "erin", Role: "writer"}},
+	}))
+	require.NoError(t, follower.Authorize("erin", "log/records", "produce"))
+	require.NoError(t, follower.CatchUp())
+	require.Error(t, follower.Authorize("erin", "log/records", "produce"))
+	require.Error(t, leader.Authorize("erin", "log/records", "produce"))
+
+	//changes survive reloading the files
+	require.NoError(t, leader.Reload())
+	require.NoError(t, leader.Authorize("writer", "log/segments", "produce"))
+	require.Error(t, leader.Authorize("dave", "log/records", "produce"))
+}
+
+func TestChangeWithoutLog(t *testing.T) {
+	a := setupTest(t)
+	err := a.Change(&api.ACLChange{
+		Rule: &api.ACLChange_Policy{Policy: &api.Policy{Subject: "erin", Object: "*", Action: "*"}},
+	})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+//leaderChange makes c on the leader and returns the record it wrote
+func leaderChange(t *testing.T, leader *Authorizer, c *api.ACLChange) *api.Record {
+	t.Helper()
+	require.NoError(t, leader.Change(c))
+	records := leader.changeLog.(*changeLog).records
+	return records[len(records)-1]
+}
+
+func setupTest(t *testing.T) *Authorizer {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "auth-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	modelFile := filepath.Join(dir, "model.conf")
+	require.NoError(t, ioutil.WriteFile(modelFile, []byte(model), 0600))
+	policyFile := filepath.Join(dir, "policy.csv")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte(policy), 0600))
+	return New(modelFile, policyFile)
+}
+
+//changeLog is a ChangeLog in memory
+type changeLog struct {
+	records []*api.Record
+}
+
+func (l *changeLog) Append(record *api.Record) (uint64, error) {
+	l.records = append(l.records, record)
+	return uint64(len(l.records) - 1), nil
+}
+
+func (l *changeLog) Read(offset uint64) (*api.Record, error) {
+	if offset >= uint64(len(l.records)) {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	return l.records[offset], nil
+}
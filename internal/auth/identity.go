@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"regexp"
+)
+
+//IdentitySource names the part of a client certificate that identities are read from
+type IdentitySource string
+
+const (
+	//CommonName is the common name of the certificate subject
+	CommonName IdentitySource = "cn"
+	//URISAN are the URI subject alternative names, which hold SPIFFE IDs such as
+	//spiffe://example.org/ns/prod/sa/ingest
+	URISAN IdentitySource = "uri"
+	//DNSSAN are the DNS subject alternative names
+	DNSSAN IdentitySource = "dns"
+	//OrganizationalUnit are the organizational units of the certificate subject, which often
+	//name a role rather than a client
+	OrganizationalUnit IdentitySource = "ou"
+)
+
+//IdentityRule rewrites an identity to a policy subject
+type IdentityRule struct {
+	//Source limits the rule to identities from one source. Empty matches every source
+	Source IdentitySource
+	//Match is a regular expression that must match the whole identity
+	Match string
+	//Subject is the policy subject of a matched identity. It may refer to submatches of Match as
+	//$1 or ${name}. Empty keeps the identity
+	Subject string
+}
+
+//IdentityConfig configures how the subject of a client certificate is found
+type IdentityConfig struct {
+	//Sources are the parts of the certificate identities are read from, in order. Defaults to
+	//the common name
+	Sources []IdentitySource
+	//Rules are tried in order on each identity. Without rules the first identity is the subject.
+	//With rules the subject is the rewrite of the first identity that a rule matches, and
+	//identities that match no rule are ignored
+	Rules []IdentityRule
+}
+
+//CertIdentity maps client certificates to policy subjects
+type CertIdentity struct {
+	sources []IdentitySource
+	rules   []identityRule
+}
+
+type identityRule struct {
+	source  IdentitySource
+	match   *regexp.Regexp
+	subject string
+}
+
+//NewCertIdentity checks the sources and compiles the rules of cfg
+func NewCertIdentity(cfg IdentityConfig) (*CertIdentity, error) {
+	c := &CertIdentity{sources: cfg.Sources}
+	if len(c.sources) == 0 {
+		c.sources = []IdentitySource{CommonName}
+	}
+	for _, s := range c.sources {
+		if !s.valid() {
+			return nil, fmt.Errorf("unknown identity source %q", s)
+		}
+	}
+	for i, r := range cfg.Rules {
+		if r.Source != "" && !r.Source.valid() {
+			return nil, fmt.Errorf("identity rule %d: unknown identity source %q", i, r.Source)
+		}
+		//anchor the expression so that it has to match the whole identity
+		match, err := regexp.Compile(`^(?:` + r.Match + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("identity rule %d: %w", i, err)
+		}
+		subject := r.Subject
+		if subject == "" {
+			subject = "$0"
+		}
+		c.rules = append(c.rules, identityRule{source: r.Source, match: match, subject: subject})
+	}
+	return c, nil
+}
+
+//Subject returns the policy subject of cert, or false if none of its identities map to one
+func (c *CertIdentity) Subject(cert *x509.Certificate) (string, bool) {
+	for _, source := range c.sources {
+		for _, id := range source.identities(cert) {
+			if id == "" {
+				continue
+			}
+			if len(c.rules) == 0 {
+				return id, true
+			}
+			for _, r := range c.rules {
+				if r.source != "" && r.source != source {
+					continue
+				}
+				m := r.match.FindStringSubmatchIndex(id)
+				if m == nil {
+					continue
+				}
+				subject := string(r.match.ExpandString(nil, r.subject, id, m))
+				if subject != "" {
+					return subject, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+func (s IdentitySource) valid() bool {
+	switch s {
+	case CommonName, URISAN, DNSSAN, OrganizationalUnit:
+		return true
+	}
+	return false
+}
+
+//identities returns the identities of cert from s
+func (s IdentitySource) identities(cert *x509.Certificate) []string {
+	switch s {
+	case CommonName:
+		return []string{cert.Subject.CommonName}
+	case URISAN:
+		var ids []string
+		for _, u := range cert.URIs {
+			ids = append(ids, u.String())
+		}
+		return ids
+	case DNSSAN:
+		return cert.DNSNames
+	case OrganizationalUnit:
+		return cert.Subject.OrganizationalUnit
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertIdentity(t *testing.T) {
+	cert := newCert(t, func(c *x509.Certificate) {
+		c.Subject = pkix.Name{CommonName: "root", OrganizationalUnit: []string{"ops", "operators"}}
+		c.DNSNames = []string{"ingest-0.prod.example.com", "localhost"}
+		c.URIs = []*url.URL{
+			{Scheme: "https", Host: "example.com", Path: "/ingest"},
+			{Scheme: "spiffe", Host: "example.org", Path: "/ns/prod/sa/ingest"},
+		}
+	})
+	bare := newCert(t, nil)
+
+	for scenario, tc := range map[string]struct {
+		cfg     IdentityConfig
+		cert    *x509.Certificate
+		subject string
+		ok      bool
+	}{
+		"defaults to the common name": {
+			cert:    cert,
+			subject: "root",
+			ok:      true,
+		},
+		"spiffe id": {
+			cfg: IdentityConfig{
+				Sources: []IdentitySource{URISAN},
+				Rules:   []IdentityRule{{Match: `spiffe://example\.org/.*`}},
+			},
+			cert:    cert,
+			subject: "spiffe://example.org/ns/prod/sa/ingest",
+			ok:      true,
+		},
+		"spiffe id rewritten": {
+			cfg: IdentityConfig{
+				Sources: []IdentitySource{URISAN},
+				Rules: []IdentityRule{{
+					Match:   `spiffe://example\.org/ns/(?P<ns>\w+)/sa/(?P<sa>\w+)`,
+					Subject: "${sa}@${ns}",
+				}},
+			},
+			cert:    cert,
+			subject: "ingest@prod",
+			ok:      true,
+		},
+		"dns san": {
+			cfg: IdentityConfig{
+				Sources: []IdentitySource{DNSSAN},
+				Rules:   []IdentityRule{{Match: `(\w+)-\d+\.prod\.example\.com`, Subject: "$1"}},
+			},
+			cert:    cert,
+			subject: "ingest",
+			ok:      true,
+		},
+		"first dns san without rules": {
+			cfg:     IdentityConfig{Sources: []IdentitySource{DNSSAN}},
+			cert:    cert,
+			subject: "ingest-0.prod.example.com",
+			ok:      true,
+		},
+		"ou role": {
+			cfg: IdentityConfig{
+				Sources: []IdentitySource{OrganizationalUnit},
+				Rules:   []IdentityRule{{Match: "operators", Subject: "operator"}},
+			},
+			cert:    cert,
+			subject: "operator",
+			ok:      true,
+		},
+		"rules must match the whole identity": {
+			cfg: IdentityConfig{
+				Sources: []IdentitySource{DNSSAN},
+				Rules:   []IdentityRule{{Match: `prod\.example\.com`}},
+			},
+			cert: cert,
+		},
+		"rules limited to a source": {
+			cfg: IdentityConfig{
+				Sources: []IdentitySource{CommonName, OrganizationalUnit},
+				Rules:   []IdentityRule{{Source: OrganizationalUnit, Match: ".*"}},
+			},
+			cert:    cert,
+			subject: "ops",
+			ok:      true,
+		},
+		"sources in order": {
+			cfg:     IdentityConfig{Sources: []IdentitySource{URISAN, CommonName}},
+			cert:    bare,
+			subject: "bare",
+			ok:      true,
+		},
+		"no identity": {
+			cfg:  IdentityConfig{Sources: []IdentitySource{URISAN, DNSSAN, OrganizationalUnit}},
+			cert: bare,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			identity, err := NewCertIdentity(tc.cfg)
+			require.NoError(t, err)
+			subject, ok := identity.Subject(tc.cert)
+			require.Equal(t, tc.ok, ok)
+			require.Equal(t, tc.subject, subject)
+		})
+	}
+
+	for _, cfg := range []IdentityConfig{
+		{Sources: []IdentitySource{"email"}},
+		{Rules: []IdentityRule{{Source: "email", Match: ".*"}}},
+		{Rules: []IdentityRule{{Match: "("}}},
+	} {
+		_, err := NewCertIdentity(cfg)
+		require.Error(t, err)
+	}
+}
+
+//newCert returns a self-signed certificate with the common name bare, changed by change
+func newCert(t *testing.T, change func(*x509.Certificate)) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bare"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if change != nil {
+		change(template)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
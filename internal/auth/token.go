@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+//minHMACKeyBytes is the shortest HMAC key accepted, the size of a SHA-256 digest
+const minHMACKeyBytes = 32
+
+//TokenConfig configures a TokenAuthenticator
+type TokenConfig struct {
+	//HMACKeyFiles hold secrets that verify HS256, HS384 and HS512 tokens. A key is the content of
+	//its file without surrounding whitespace, and must be at least 32 bytes
+	HMACKeyFiles []string
+	//Ed25519KeyFiles hold PEM encoded public keys that verify EdDSA tokens
+	Ed25519KeyFiles []string
+	//Issuer and Audience, when set, must match the iss and aud claims of tokens
+	Issuer   string
+	Audience string
+}
+
+//Enabled returns true if any keys are configured
+func (c TokenConfig) Enabled() bool {
+	return len(c.HMACKeyFiles) != 0 || len(c.Ed25519KeyFiles) != 0
+}
+
+//TokenAuthenticator authenticates requests that carry a signed JWT as a bearer token in their
+//authorization metadata. The subject is the sub claim of the token, which must also expire
+type TokenAuthenticator struct {
+	cfg         TokenConfig
+	mu          sync.RWMutex
+	hmacKeys    [][]byte
+	ed25519Keys []ed25519.PublicKey
+}
+
+//NewTokenAuthenticator reads the keys of cfg
+func NewTokenAuthenticator(cfg TokenConfig) (*TokenAuthenticator, error) {
+	a := &TokenAuthenticator{cfg: cfg}
+	err := a.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+//Reload reads the key files again. If any are invalid the current keys are kept
+func (a *TokenAuthenticator) Reload() error {
+	var hmacKeys [][]byte
+	for _, path := range a.cfg.HMACKeyFiles {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key := bytes.TrimSpace(b)
+		if len(key) < minHMACKeyBytes {
+			return fmt.Errorf("hmac key in %s is %d bytes, shorter than %d", path, len(key), minHMACKeyBytes)
+		}
+		hmacKeys = append(hmacKeys, key)
+	}
+	var ed25519Keys []ed25519.PublicKey
+	for _, path := range a.cfg.Ed25519KeyFiles {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key, err := jwt.ParseEdPublicKeyFromPEM(b)
+		if err != nil {
+			return fmt.Errorf("failed to parse ed25519 public key in %s: %w", path, err)
+		}
+		ed25519Keys = append(ed25519Keys, key.(ed25519.PublicKey))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hmacKeys = hmacKeys
+	a.ed25519Keys = ed25519Keys
+	return nil
+}
+
+//Authenticate returns the subject of the bearer token of the request. Requests without a bearer
+//token are left to other authenticators
+func (a *TokenAuthenticator) Authenticate(ctx context.Context) (string, bool, error) {
+	raw, ok := credential(ctx, "authorization", "bearer ")
+	if !ok {
+		return "", false, nil
+	}
+	claims, err := a.verify(raw)
+	if err != nil {
+		return "", false, status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+	return claims["sub"].(string), true, nil
+}
+
+//verify checks the signature of the token against each key of its algorithm, then its claims
+func (a *TokenAuthenticator) verify(raw string) (jwt.MapClaims, error) {
+	parser := &jwt.Parser{ValidMethods: []string{"HS256", "HS384", "HS512", "EdDSA"}}
+	token, _, err := parser.ParseUnverified(raw, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	var keys []interface{}
+	a.mu.RLock()
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		for _, k := range a.hmacKeys {
+			keys = append(keys, k)
+		}
+	case *jwt.SigningMethodEd25519:
+		for _, k := range a.ed25519Keys {
+			keys = append(keys, k)
+		}
+	}
+	a.mu.RUnlock()
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys for algorithm %s", token.Method.Alg())
+	}
+	for _, key := range keys {
+		claims := jwt.MapClaims{}
+		_, err = parser.ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if err == nil {
+			return claims, a.validate(claims)
+		}
+	}
+	return nil, err
+}
+
+//validate checks the claims that ParseWithClaims does not
+func (a *TokenAuthenticator) validate(claims jwt.MapClaims) error {
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return fmt.Errorf("token has no subject")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return fmt.Errorf("token has no expiry")
+	}
+	if a.cfg.Issuer != "" && !claims.VerifyIssuer(a.cfg.Issuer, true) {
+		return fmt.Errorf("token is not issued by %s", a.cfg.Issuer)
+	}
+	if a.cfg.Audience != "" && !claims.VerifyAudience(a.cfg.Audience, true) {
+		return fmt.Errorf("token is not for %s", a.cfg.Audience)
+	}
+	return nil
+}
+
+//credential returns the value of the metadata key of the request after its case insensitive scheme
+//prefix, if it has one
+func credential(ctx context.Context, key, scheme string) (string, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(key) {
+		if len(v) > len(scheme) && strings.EqualFold(v[:len(scheme)], scheme) {
+			return v[len(scheme):], true
+		}
+	}
+	return "", false
+}
+
+//TokenCredentials sends a bearer token with each rpc
+type TokenCredentials struct {
+	Token string
+	//AllowInsecure sends the token on connections without TLS, where it can be read off the network
+	AllowInsecure bool
+}
+
+func (c TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.Token}, nil
+}
+
+func (c TokenCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
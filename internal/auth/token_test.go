@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestTokenAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	secret := randomSecret(t)
+	hmacFile := filepath.Join(dir, "hmac")
+	require.NoError(t, ioutil.WriteFile(hmacFile, append(secret, '\n'), 0600))
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	edFile := filepath.Join(dir, "ed25519.pem")
+	require.NoError(t, ioutil.WriteFile(edFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+
+	a, err := NewTokenAuthenticator(TokenConfig{
+		HMACKeyFiles:    []string{hmacFile},
+		Ed25519KeyFiles: []string{edFile},
+		Issuer:          "issuer",
+		Audience:        "proglog",
+	})
+	require.NoError(t, err)
+
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub": "alice",
+			"iss": "issuer",
+			"aud": "proglog",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	sign := func(method jwt.SigningMethod, key interface{}, c jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, c).SignedString(key)
+		require.NoError(t, err)
+		return token
+	}
+	authenticate := func(md ...string) (string, bool, error) {
+		return a.Authenticate(metadata.NewIncomingContext(context.Background(), metadata.Pairs(md...)))
+	}
+	bearer := func(token string) (string, bool, error) {
+		return authenticate("authorization", "Bearer "+token)
+	}
+	requireUnauthenticated := func(t *testing.T, token string) {
+		_, ok, err := bearer(token)
+		require.False(t, ok)
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+
+	for scenario, fn := range map[string]func(t *testing.T){
+		"hmac": func(t *testing.T) {
+			subject, ok, err := bearer(sign(jwt.SigningMethodHS256, secret, claims(nil)))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, "alice", subject)
+		},
+		"ed25519": func(t *testing.T) {
+			subject, ok, err := bearer(sign(jwt.SigningMethodEdDSA, priv, claims(nil)))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, "alice", subject)
+		},
+		"scheme is case insensitive": func(t *testing.T) {
+			subject, ok, err := authenticate("authorization", "bearer "+sign(jwt.SigningMethodHS256, secret, claims(nil)))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, "alice", subject)
+		},
+		"wrong key": func(t *testing.T) {
+			requireUnauthenticated(t, sign(jwt.SigningMethodHS256, randomSecret(t), claims(nil)))
+			_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+			require.NoError(t, err)
+			requireUnauthenticated(t, sign(jwt.SigningMethodEdDSA, otherPriv, claims(nil)))
+		},
+		"unsigned": func(t *testing.T) {
+			requireUnauthenticated(t, sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims(nil)))
+		},
+		"expired": func(t *testing.T) {
+			requireUnauthenticated(t, sign(jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) {
+				c["exp"] = time.Now().Add(-time.Minute).Unix()
+			})))
+		},
+		"no expiry": func(t *testing.T) {
+			requireUnauthenticated(t, sign(jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) {
+				delete(c, "exp")
+			})))
+		},
+		"no subject": func(t *testing.T) {
+			requireUnauthenticated(t, sign(jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) {
+				delete(c, "sub")
+			})))
+		},
+		"wrong issuer": func(t *testing.T) {
+			requireUnauthenticated(t, sign(jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) {
+				c["iss"] = "other"
+			})))
+		},
+		"wrong audience": func(t *testing.T) {
+			requireUnauthenticated(t, sign(jwt.SigningMethodHS256, secret, claims(func(c jwt.MapClaims) {
+				c["aud"] = "other"
+			})))
+		},
+		"malformed": func(t *testing.T) {
+			requireUnauthenticated(t, "not a token")
+		},
+		"no bearer token": func(t *testing.T) {
+			_, ok, err := authenticate()
+			require.NoError(t, err)
+			require.False(t, ok)
+			_, ok, err = authenticate("authorization", "Basic YWxpY2U6c2VjcmV0")
+			require.NoError(t, err)
+			require.False(t, ok)
+		},
+		"short hmac key": func(t *testing.T) {
+			short := filepath.Join(dir, "short")
+			require.NoError(t, ioutil.WriteFile(short, []byte("secret"), 0600))
+			_, err := NewTokenAuthenticator(TokenConfig{HMACKeyFiles: []string{short}})
+			require.Error(t, err)
+		},
+		"reload keeps keys on error": func(t *testing.T) {
+			b, err := NewTokenAuthenticator(TokenConfig{HMACKeyFiles: []string{hmacFile}})
+			require.NoError(t, err)
+			b.cfg.HMACKeyFiles = []string{filepath.Join(dir, "missing")}
+			require.Error(t, b.Reload())
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+				"authorization", "Bearer "+sign(jwt.SigningMethodHS256, secret, claims(nil)),
+			))
+			_, ok, err := b.Authenticate(ctx)
+			require.NoError(t, err)
+			require.True(t, ok)
+		},
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+//randomSecret returns a hex encoded random HMAC key. Raw random bytes could have whitespace at either
+//end, which is trimmed from key files
+func randomSecret(t *testing.T) []byte {
+	t.Helper()
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return []byte(hex.EncodeToString(b))
+}
@@ -0,0 +1,327 @@
+//Package ca creates a certificate authority and issues the server and client certificates of a
+//development or test deployment
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//DefaultValidFor is how long certificates are valid for unless requested otherwise
+const DefaultValidFor = 8760 * time.Hour
+
+//CA signs certificates
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+//New creates a self-signed CA
+func New(commonName string, validFor time.Duration) (*CA, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(commonName, validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+//Load reads a CA from PEM files, such as the ones written by Write. RSA keys, like the ones of
+//CAs made by cfssl, are supported
+func Load(certFile, keyFile string) (*CA, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", keyFile, pair.PrivateKey)
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+//Write writes the certificate and key of the CA as PEM files
+func (ca *CA) Write(certFile, keyFile string) error {
+	return write(ca.Cert, ca.Key, certFile, keyFile)
+}
+
+//CRL returns a PEM encoded certificate revocation list of the revoked certificates, valid for
+//validFor. A CRL lists every revoked certificate, so it replaces the CRLs made before
+func (ca *CA) CRL(revoked []*x509.Certificate, validFor time.Duration) ([]byte, error) {
+	now := time.Now()
+	list := &x509.RevocationList{
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(validFor),
+	}
+	for _, cert := range revoked {
+		list.RevokedCertificates = append(list.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: now,
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, list, ca.Cert, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
+
+//Request describes a certificate to issue
+type Request struct {
+	CommonName string
+	//Hosts are the DNS names, IP addresses and URIs, such as SPIFFE IDs, the certificate is for
+	Hosts               []string
+	OrganizationalUnits []string
+	//Server and Client are the uses of the certificate. At least one is required
+	Server bool
+	Client bool
+	//ValidFor defaults to DefaultValidFor
+	ValidFor time.Duration
+}
+
+//Certificate is an issued certificate and its key
+type Certificate struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+//Issue creates a key and a certificate for it signed by the CA
+func (ca *CA) Issue(req Request) (*Certificate, error) {
+	if !req.Server && !req.Client {
+		return nil, errors.New("certificate is for neither servers nor clients")
+	}
+	validFor := req.ValidFor
+	if validFor == 0 {
+		validFor = DefaultValidFor
+	}
+	template, err := newTemplate(req.CommonName, validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.Subject.OrganizationalUnit = req.OrganizationalUnits
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if req.Server {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
+	if req.Client {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	}
+	for _, host := range req.Hosts {
+		switch ip := net.ParseIP(host); {
+		case ip != nil:
+			template.IPAddresses = append(template.IPAddresses, ip)
+		case strings.Contains(host, "://"):
+			u, err := url.Parse(host)
+			if err != nil {
+				return nil, fmt.Errorf("host %q: %w", host, err)
+			}
+			template.URIs = append(template.URIs, u)
+		default:
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Certificate{Cert: cert, Key: key}, nil
+}
+
+//Write writes the certificate and its key as PEM files
+func (c *Certificate) Write(certFile, keyFile string) error {
+	return write(c.Cert, c.Key, certFile, keyFile)
+}
+
+//TLSCertificate returns the certificate for use in a tls.Config
+func (c *Certificate) TLSCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.Cert.Raw}, PrivateKey: c.Key, Leaf: c.Cert}
+}
+
+//Files are the paths of the files Generate writes, named the way internal/config expects them
+type Files struct {
+	CAFile               string
+	CAKeyFile            string
+	ServerCertFile       string
+	ServerKeyFile        string
+	RootClientCertFile   string
+	RootClientKeyFile    string
+	NobodyClientCertFile string
+	NobodyClientKeyFile  string
+}
+
+//FilesIn returns the paths of the files in dir
+func FilesIn(dir string) *Files {
+	certFile, keyFile := ClientFiles(dir, "root")
+	nobodyCertFile, nobodyKeyFile := ClientFiles(dir, "nobody")
+	return &Files{
+		CAFile:               filepath.Join(dir, "ca.pem"),
+		CAKeyFile:            filepath.Join(dir, "ca-key.pem"),
+		ServerCertFile:       filepath.Join(dir, "server.pem"),
+		ServerKeyFile:        filepath.Join(dir, "server-key.pem"),
+		RootClientCertFile:   certFile,
+		RootClientKeyFile:    keyFile,
+		NobodyClientCertFile: nobodyCertFile,
+		NobodyClientKeyFile:  nobodyKeyFile,
+	}
+}
+
+//ClientFiles returns the paths of the client certificate and key of commonName in dir
+func ClientFiles(dir, commonName string) (certFile, keyFile string) {
+	return filepath.Join(dir, commonName+"-client.pem"), filepath.Join(dir, commonName+"-client-key.pem")
+}
+
+//Options are the certificates Generate issues. The zero value issues the certificates the tests
+//and the ACL policy expect
+type Options struct {
+	//CA signs the certificates. A new CA is created if nil
+	CA *CA
+	//CACommonName is the common name of a new CA
+	CACommonName string
+	//ServerCommonName defaults to 127.0.0.1
+	ServerCommonName string
+	//ServerHosts default to localhost and 127.0.0.1
+	ServerHosts []string
+	//Clients are the common names of the client certificates, root and nobody by default
+	Clients []string
+	//ValidFor defaults to DefaultValidFor
+	ValidFor time.Duration
+}
+
+//Generate writes the CA, a server certificate and client certificates to dir, creating dir if
+//needed
+func Generate(dir string, opts Options) (*Files, error) {
+	if opts.CACommonName == "" {
+		opts.CACommonName = "proglog CA"
+	}
+	if opts.ServerCommonName == "" {
+		opts.ServerCommonName = "127.0.0.1"
+	}
+	if opts.ServerHosts == nil {
+		opts.ServerHosts = []string{"localhost", "127.0.0.1"}
+	}
+	if opts.Clients == nil {
+		opts.Clients = []string{"root", "nobody"}
+	}
+	if opts.ValidFor == 0 {
+		opts.ValidFor = DefaultValidFor
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	files := FilesIn(dir)
+	ca := opts.CA
+	if ca == nil {
+		ca, err = New(opts.CACommonName, opts.ValidFor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = ca.Write(files.CAFile, files.CAKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	server, err := ca.Issue(Request{
+		CommonName: opts.ServerCommonName,
+		Hosts:      opts.ServerHosts,
+		Server:     true,
+		ValidFor:   opts.ValidFor,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = server.Write(files.ServerCertFile, files.ServerKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, cn := range opts.Clients {
+		client, err := ca.Issue(Request{CommonName: cn, Client: true, ValidFor: opts.ValidFor})
+		if err != nil {
+			return nil, err
+		}
+		err = client.Write(ClientFiles(dir, cn))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func newKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+//newTemplate returns a certificate template with a random serial number, valid from a minute ago
+//to allow for clock skew
+func newTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validFor),
+	}, nil
+}
+
+//write writes cert and key as PEM files. The key is only readable by its owner
+func write(cert *x509.Certificate, key crypto.Signer, certFile, keyFile string) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+}
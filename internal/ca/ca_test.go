@@ -0,0 +1,131 @@
+package ca
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krehermann/proglog/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files, err := Generate(dir, Options{})
+	require.NoError(t, err)
+	for _, file := range []string{"ca.pem", "ca-key.pem", "server.pem", "server-key.pem",
+		"root-client.pem", "root-client-key.pem", "nobody-client.pem", "nobody-client-key.pem"} {
+		require.FileExists(t, filepath.Join(dir, file))
+	}
+	info, err := os.Stat(files.ServerKeyFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	//the files work with the TLS configs of the server and its clients
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	handshake := func(certFile, keyFile, serverName string) (*tls.ConnectionState, error) {
+		clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      certFile,
+			KeyFile:       keyFile,
+			CAFile:        files.CAFile,
+			ServerAddress: serverName,
+		})
+		require.NoError(t, err)
+		conn, err := tls.Dial("tcp", l.Addr().String(), clientTLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		state := conn.ConnectionState()
+		return &state, nil
+	}
+	for _, serverName := range []string{"127.0.0.1", "localhost"} {
+		state, err := handshake(files.RootClientCertFile, files.RootClientKeyFile, serverName)
+		require.NoError(t, err)
+		require.Equal(t, "127.0.0.1", state.PeerCertificates[0].Subject.CommonName)
+	}
+	_, err = handshake(files.RootClientCertFile, files.RootClientKeyFile, "example.org")
+	require.Error(t, err)
+
+	clientCert, err := tls.LoadX509KeyPair(files.NobodyClientCertFile, files.NobodyClientKeyFile)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(clientCert.Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, "nobody", cert.Subject.CommonName)
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, cert.ExtKeyUsage)
+
+	//regenerating with the loaded CA keeps issued certificates valid
+	ca, err := Load(files.CAFile, files.CAKeyFile)
+	require.NoError(t, err)
+	_, err = Generate(dir, Options{CA: ca, Clients: []string{"alice"}})
+	require.NoError(t, err)
+	certFile, keyFile := ClientFiles(dir, "alice")
+	_, err = handshake(certFile, keyFile, "127.0.0.1")
+	require.NoError(t, err)
+	_, err = handshake(files.NobodyClientCertFile, files.NobodyClientKeyFile, "127.0.0.1")
+	require.NoError(t, err)
+
+	_, err = Load(files.ServerCertFile, files.ServerKeyFile)
+	require.Error(t, err)
+}
+
+func TestIssue(t *testing.T) {
+	ca, err := New("test CA", time.Hour)
+	require.NoError(t, err)
+	cert, err := ca.Issue(Request{
+		CommonName:          "alice",
+		Hosts:               []string{"spiffe://example.org/ns/prod/sa/alice", "alice.example.org", "::1"},
+		OrganizationalUnits: []string{"payments"},
+		Server:              true,
+		Client:              true,
+		ValidFor:            time.Minute,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "alice", cert.Cert.Subject.CommonName)
+	require.Equal(t, []string{"payments"}, cert.Cert.Subject.OrganizationalUnit)
+	require.Equal(t, "spiffe://example.org/ns/prod/sa/alice", cert.Cert.URIs[0].String())
+	require.Equal(t, []string{"alice.example.org"}, cert.Cert.DNSNames)
+	require.True(t, cert.Cert.IPAddresses[0].Equal(net.ParseIP("::1")))
+	require.Equal(t, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, cert.Cert.ExtKeyUsage)
+	require.WithinDuration(t, time.Now().Add(time.Minute), cert.Cert.NotAfter, 5*time.Second)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	_, err = cert.Cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	require.NoError(t, err)
+	require.Equal(t, cert.Cert, cert.TLSCertificate().Leaf)
+
+	other, err := ca.Issue(Request{CommonName: "bob", Client: true})
+	require.NoError(t, err)
+	require.NotEqual(t, cert.Cert.SerialNumber, other.Cert.SerialNumber)
+
+	_, err = ca.Issue(Request{CommonName: "carol"})
+	require.Error(t, err)
+}
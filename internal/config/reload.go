@@ -0,0 +1,107 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+)
+
+//ReloadableTLS is a TLS configuration whose certificate and CA bundle are loaded from files again
+//on Reload. Connections made after a reload use the new files, established connections are kept
+type ReloadableTLS struct {
+	cfg     TLSConfig
+	mu      sync.RWMutex
+	current *tls.Config
+}
+
+//NewReloadableTLS loads the files of cfg
+func NewReloadableTLS(cfg TLSConfig) (*ReloadableTLS, error) {
+	r := &ReloadableTLS{cfg: cfg}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//Reload loads the files again. If they cannot be loaded the current configuration is kept
+func (r *ReloadableTLS) Reload() error {
+	current, err := SetupTLSConfig(r.cfg)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = current
+	return nil
+}
+
+func (r *ReloadableTLS) load() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+//Config returns a TLS configuration that always uses the most recently loaded files.
+//Servers pick the whole configuration per connection with GetConfigForClient. Clients
+//cannot swap their roots that way, so they present the current certificate with
+//GetClientCertificate and verify the server against the current roots in VerifyConnection.
+//The configuration picked per connection negotiates the protocols of the returned one, http/2
+//for grpc and http/1.1 for the http api
+func (r *ReloadableTLS) Config() *tls.Config {
+	if r.cfg.Server {
+		base := &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+		base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			current := r.load().Clone()
+			current.NextProtos = base.NextProtos
+			return current, nil
+		}
+		return base
+	}
+	return &tls.Config{
+		ServerName: r.cfg.ServerAddress,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			current := r.load()
+			if len(current.Certificates) == 0 {
+				//no certificate is sent
+				return &tls.Certificate{}, nil
+			}
+			return &current.Certificates[0], nil
+		},
+		//the default verification uses the roots the connection was configured with, so it is
+		//replaced by VerifyConnection, which performs the same checks against the current roots
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyServer(cs, r.load().RootCAs, r.cfg.ServerAddress)
+		},
+	}
+}
+
+//verifyServer verifies the server's certificate chain and name the way crypto/tls does. The
+//connection state has no server name for servers dialed by IP address, as IP addresses are not
+//sent in SNI, so the configured server address is verified. Without either name the server is
+//rejected, since any certificate the CA issued would pass
+func verifyServer(cs tls.ConnectionState, roots *x509.CertPool, serverAddress string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: server presented no certificates")
+	}
+	name := serverAddress
+	if name == "" {
+		name = cs.ServerName
+	}
+	if name == "" {
+		return errors.New("tls: no server name to verify the server's certificate against, configure the server address")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krehermann/proglog/internal/ca"
+	"github.com/krehermann/proglog/internal/testconfig"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadableTLS(t *testing.T) {
+	files := testconfig.New(t)
+	dir, err := ioutil.TempDir("", "reload-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	serverCert := filepath.Join(dir, "server.pem")
+	serverKey := filepath.Join(dir, "server-key.pem")
+	clientCert := filepath.Join(dir, "client.pem")
+	clientKey := filepath.Join(dir, "client-key.pem")
+	copyFile(t, files.ServerCertFile, serverCert)
+	copyFile(t, files.ServerKeyFile, serverKey)
+	copyFile(t, files.RootClientCertFile, clientCert)
+	copyFile(t, files.RootClientKeyFile, clientKey)
+
+	server, err := NewReloadableTLS(TLSConfig{
+		CertFile: serverCert,
+		KeyFile:  serverKey,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	client, err := NewReloadableTLS(TLSConfig{
+		CertFile:      clientCert,
+		KeyFile:       clientKey,
+		CAFile:        files.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server.Config())
+	require.NoError(t, err)
+	defer l.Close()
+	//the server reports the common name of each client it accepts
+	subjects := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tc := conn.(*tls.Conn)
+			if tc.Handshake() == nil {
+				subjects <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			tc.Close()
+		}
+	}()
+	dial := func() (string, error) {
+		conn, err := tls.Dial("tcp", l.Addr().String(), client.Config())
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return <-subjects, nil
+	}
+
+	subject, err := dial()
+	require.NoError(t, err)
+	require.Equal(t, "root", subject)
+
+	//rotate the client's certificate
+	copyFile(t, files.NobodyClientCertFile, clientCert)
+	copyFile(t, files.NobodyClientKeyFile, clientKey)
+	subject, err = dial()
+	require.NoError(t, err)
+	require.Equal(t, "root", subject, "files are only read on reload")
+	require.NoError(t, client.Reload())
+	subject, err = dial()
+	require.NoError(t, err)
+	require.Equal(t, "nobody", subject)
+
+	//replace the server's certificate with one that is not valid for a server
+	copyFile(t, files.RootClientCertFile, serverCert)
+	copyFile(t, files.RootClientKeyFile, serverKey)
+	require.NoError(t, server.Reload())
+	_, err = dial()
+	require.Error(t, err)
+	copyFile(t, files.ServerCertFile, serverCert)
+	copyFile(t, files.ServerKeyFile, serverKey)
+	require.NoError(t, server.Reload())
+	_, err = dial()
+	require.NoError(t, err)
+
+	//a broken file keeps the loaded configuration
+	require.NoError(t, ioutil.WriteFile(serverKey, []byte("garbage"), 0600))
+	require.Error(t, server.Reload())
+	_, err = dial()
+	require.NoError(t, err)
+}
+
+func TestReloadableTLSRejectsUnknownServers(t *testing.T) {
+	files := testconfig.New(t)
+	client, err := NewReloadableTLS(TLSConfig{
+		CertFile:      files.RootClientCertFile,
+		KeyFile:       files.RootClientKeyFile,
+		CAFile:        files.CAFile,
+		ServerAddress: "example.com",
+	})
+	require.NoError(t, err)
+	serverConfig, err := SetupTLSConfig(TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+	})
+	require.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	err = tls.Client(conn, client.Config()).Handshake()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "example.com")
+}
+
+func TestReloadableTLSVerifiesIPAddresses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload-ip-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	authority, err := ca.New("test CA", time.Hour)
+	require.NoError(t, err)
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, authority.Write(caFile, filepath.Join(dir, "ca-key.pem")))
+
+	//serve tries a handshake with a server presenting a certificate issued for req
+	serve := func(req ca.Request) func(serverAddress string) error {
+		cert, err := authority.Issue(req)
+		require.NoError(t, err)
+		l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert.TLSCertificate()}})
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+		return func(serverAddress string) error {
+			client, err := NewReloadableTLS(TLSConfig{CAFile: caFile, ServerAddress: serverAddress})
+			require.NoError(t, err)
+			//tls.Dial uses the dialed IP address as the server name, which is not sent in SNI
+			conn, err := tls.Dial("tcp", l.Addr().String(), client.Config())
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+	}
+
+	dial := serve(ca.Request{CommonName: "server", Hosts: []string{"127.0.0.1"}, Server: true})
+	require.NoError(t, dial("127.0.0.1"))
+	err = dial("")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no server name")
+
+	//certificates for other addresses, or for clients, are not the server's
+	dial = serve(ca.Request{CommonName: "server", Hosts: []string{"10.0.0.1"}, Server: true})
+	err = dial("127.0.0.1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "127.0.0.1")
+	dial = serve(ca.Request{CommonName: "nobody", Hosts: []string{"127.0.0.1"}, Client: true})
+	require.Error(t, dial("127.0.0.1"))
+}
+
+func TestReloadableTLSNegotiatesHTTP2(t *testing.T) {
+	files := testconfig.New(t)
+	server, err := NewReloadableTLS(TLSConfig{
+		CertFile: files.ServerCertFile,
+		KeyFile:  files.ServerKeyFile,
+		CAFile:   files.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	client, err := NewReloadableTLS(TLSConfig{
+		CertFile:      files.RootClientCertFile,
+		KeyFile:       files.RootClientKeyFile,
+		CAFile:        files.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server.Config())
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	//grpc clients refuse servers that don't negotiate http/2
+	clientConfig := client.Config()
+	clientConfig.NextProtos = []string{"h2"}
+	conn, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	b, err := ioutil.ReadFile(src)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(dst, b, 0600))
+}
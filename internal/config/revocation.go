@@ -0,0 +1,159 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+//revocation rejects client certificates that are listed by a CRL or whose serial numbers are
+//denied
+type revocation struct {
+	//crlIssuer is the CA that signed the CRL. Only the certificates it issued are checked against
+	//revoked, the hex serial numbers and revocation times of the CRL
+	crlIssuer *x509.Certificate
+	revoked   map[string]time.Time
+	//denied are the hex serial numbers of the deny list
+	denied map[string]bool
+	logger *zap.Logger
+}
+
+//loadRevocation reads the CRL file and the revoked serials file of cfg. The CRL must be signed by
+//a certificate of the CA file
+func loadRevocation(cfg TLSConfig) (*revocation, error) {
+	r := &revocation{
+		revoked: make(map[string]time.Time),
+		denied:  make(map[string]bool),
+		logger:  zap.L().Named("tls"),
+	}
+	if cfg.CRLFile != "" {
+		err := r.loadCRL(cfg.CRLFile, cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.RevokedSerialsFile != "" {
+		err := r.loadDenied(cfg.RevokedSerialsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *revocation) loadCRL(crlFile, caFile string) error {
+	if caFile == "" {
+		return fmt.Errorf("crl %s needs a ca file to verify it", crlFile)
+	}
+	b, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		return err
+	}
+	crl, err := x509.ParseCRL(b)
+	if err != nil {
+		return fmt.Errorf("parsing crl %s: %w", crlFile, err)
+	}
+	cas, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	for block, rest := pem.Decode(cas); block != nil && r.crlIssuer == nil; block, rest = pem.Decode(rest) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err == nil && ca.CheckCRLSignature(crl) == nil {
+			r.crlIssuer = ca
+		}
+	}
+	if r.crlIssuer == nil {
+		return fmt.Errorf("crl %s is not signed by a certificate of %s", crlFile, caFile)
+	}
+	if crl.HasExpired(time.Now()) {
+		r.logger.Warn("crl is past its next update, revocations since are not known",
+			zap.String("file", crlFile),
+			zap.Time("next_update", crl.TBSCertList.NextUpdate),
+		)
+	}
+	for _, c := range crl.TBSCertList.RevokedCertificates {
+		r.revoked[c.SerialNumber.Text(16)] = c.RevocationTime
+	}
+	return nil
+}
+
+//loadDenied reads serial numbers in hex, one per line, as printed by openssl x509 -serial. Colons
+//between bytes, blank lines and lines starting with # are allowed
+func (r *revocation) loadDenied(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(strings.ToLower(line), "serial=")
+		line = strings.ReplaceAll(strings.TrimPrefix(line, "0x"), ":", "")
+		serial, ok := new(big.Int).SetString(line, 16)
+		if !ok {
+			return fmt.Errorf("%s:%d: %q is not a hex serial number", file, n, scanner.Text())
+		}
+		r.denied[serial.Text(16)] = true
+	}
+	return scanner.Err()
+}
+
+//verify is the VerifyPeerCertificate of servers. It runs after the chain is verified and rejects
+//revoked client certificates
+func (r *revocation) verify(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		//no certificate, which ClientAuth allows or rejects
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	serial := leaf.SerialNumber.Text(16)
+	if r.denied[serial] {
+		return r.reject(leaf, "the revoked serials file", time.Time{})
+	}
+	if revokedAt, ok := r.revoked[serial]; ok && r.issuedByCRLIssuer(leaf, verifiedChains) {
+		return r.reject(leaf, "the crl", revokedAt)
+	}
+	return nil
+}
+
+//issuedByCRLIssuer returns true if the CA that signed the CRL issued leaf, as serial numbers are
+//only unique per CA
+func (r *revocation) issuedByCRLIssuer(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate) bool {
+	for _, chain := range verifiedChains {
+		if len(chain) > 1 && bytes.Equal(chain[1].Raw, r.crlIssuer.Raw) {
+			return true
+		}
+	}
+	return len(verifiedChains) == 0 && bytes.Equal(leaf.RawIssuer, r.crlIssuer.RawSubject)
+}
+
+func (r *revocation) reject(leaf *x509.Certificate, source string, revokedAt time.Time) error {
+	fields := []zap.Field{
+		zap.String("subject", leaf.Subject.String()),
+		zap.String("serial", leaf.SerialNumber.Text(16)),
+		zap.String("revoked_by", source),
+	}
+	if !revokedAt.IsZero() {
+		fields = append(fields, zap.Time("revoked_at", revokedAt))
+	}
+	r.logger.Warn("rejected revoked client certificate", fields...)
+	return fmt.Errorf("client certificate %q with serial %s is revoked by %s",
+		leaf.Subject.String(), leaf.SerialNumber.Text(16), source)
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krehermann/proglog/internal/ca"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	core, logs := observer.New(zapcore.WarnLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	authority, err := ca.New("test CA", time.Hour)
+	require.NoError(t, err)
+	files, err := ca.Generate(dir, ca.Options{CA: authority})
+	require.NoError(t, err)
+	load := func(certFile, keyFile string) (tls.Certificate, *x509.Certificate) {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		require.NoError(t, err)
+		return pair, cert
+	}
+	root, rootCert := load(files.RootClientCertFile, files.RootClientKeyFile)
+	nobody, nobodyCert := load(files.NobodyClientCertFile, files.NobodyClientKeyFile)
+
+	crlFile := filepath.Join(dir, "ca.crl")
+	crl, err := authority.CRL([]*x509.Certificate{nobodyCert}, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(crlFile, crl, 0600))
+	serialsFile := filepath.Join(dir, "revoked-serials")
+	require.NoError(t, ioutil.WriteFile(serialsFile, []byte("# none yet\n"), 0600))
+
+	server, err := NewReloadableTLS(TLSConfig{
+		CertFile:           files.ServerCertFile,
+		KeyFile:            files.ServerKeyFile,
+		CAFile:             files.CAFile,
+		Server:             true,
+		CRLFile:            crlFile,
+		RevokedSerialsFile: serialsFile,
+	})
+	require.NoError(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server.Config())
+	require.NoError(t, err)
+	defer l.Close()
+	//the server reports the result of each handshake, as clients of TLS 1.3 finish theirs before
+	//the server has verified their certificate
+	handshakes := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	clientTLSConfig, err := SetupTLSConfig(TLSConfig{CAFile: files.CAFile, ServerAddress: "127.0.0.1"})
+	require.NoError(t, err)
+	dial := func(cert tls.Certificate) error {
+		cfg := clientTLSConfig.Clone()
+		cfg.Certificates = []tls.Certificate{cert}
+		conn, err := tls.Dial("tcp", l.Addr().String(), cfg)
+		if err == nil {
+			conn.Close()
+		}
+		return <-handshakes
+	}
+
+	require.NoError(t, dial(root))
+	err = dial(nobody)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is revoked by the crl")
+	entries := logs.FilterMessage("rejected revoked client certificate").All()
+	require.Len(t, entries, 1)
+	require.Equal(t, "CN=nobody", entries[0].ContextMap()["subject"])
+
+	//serials are denied on reload
+	require.NoError(t, ioutil.WriteFile(serialsFile, []byte("serial="+rootCert.SerialNumber.Text(16)+"\n"), 0600))
+	require.NoError(t, dial(root), "files are only read on reload")
+	require.NoError(t, server.Reload())
+	err = dial(root)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is revoked by the revoked serials file")
+
+	//a broken or foreign revocation file keeps the loaded configuration
+	require.NoError(t, ioutil.WriteFile(serialsFile, []byte("not hex\n"), 0600))
+	require.Error(t, server.Reload())
+	other, err := ca.New("other CA", time.Hour)
+	require.NoError(t, err)
+	otherCRL, err := other.CRL(nil, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(serialsFile, nil, 0600))
+	require.NoError(t, ioutil.WriteFile(crlFile, otherCRL, 0600))
+	err = server.Reload()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not signed by")
+	require.Error(t, dial(root))
+}
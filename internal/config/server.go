@@ -0,0 +1,392 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/log"
+	"gopkg.in/yaml.v3"
+)
+
+//EnvPrefix prefixes the environment variables that override the server configuration.
+//The variable for a flag is the prefix followed by the flag name in upper case with dashes
+//replaced by underscores, for example PROGLOG_DATA_DIR for -data-dir
+const EnvPrefix = "PROGLOG_"
+
+//ConfigFileFlag names the flag, and with EnvPrefix the environment variable, that locates
+//the configuration file
+const ConfigFileFlag = "config-file"
+
+//Server is the configuration of a proglog server. It is read from a YAML file,
+//then overridden by environment variables and then by command line flags
+type Server struct {
+	DataDir        string   `yaml:"data_dir"`
+	NodeName       string   `yaml:"node_name"`
+	BindAddr       string   `yaml:"bind_addr"`
+	RPCAddr        string   `yaml:"rpc_addr"`
+	StartJoinAddrs []string `yaml:"start_join_addrs"`
+	ACL            struct {
+		ModelFile  string `yaml:"model_file"`
+		PolicyFile string `yaml:"policy_file"`
+	} `yaml:"acl"`
+	//Auth configures authenticating clients without certificates
+	Auth struct {
+		Token struct {
+			HMACKeyFiles    []string `yaml:"hmac_key_files"`
+			Ed25519KeyFiles []string `yaml:"ed25519_key_files"`
+			Issuer          string   `yaml:"issuer"`
+			Audience        string   `yaml:"audience"`
+		} `yaml:"token"`
+		APIKeysFile string `yaml:"api_keys_file"`
+		//CertIdentity configures how subjects are found in client certificates. Its rules are
+		//only read from the configuration file
+		CertIdentity struct {
+			Sources []string `yaml:"sources"`
+			Rules   []struct {
+				Source  string `yaml:"source"`
+				Match   string `yaml:"match"`
+				Subject string `yaml:"subject"`
+			} `yaml:"rules"`
+		} `yaml:"cert_identity"`
+	} `yaml:"auth"`
+	ServerTLS TLSFiles `yaml:"server_tls"`
+	PeerTLS   TLSFiles `yaml:"peer_tls"`
+	Segment   struct {
+		MaxStoreBytes uint64 `yaml:"max_store_bytes"`
+		MaxIndexBytes uint64 `yaml:"max_index_bytes"`
+		InitialOffset uint64 `yaml:"initial_offset"`
+	} `yaml:"segment"`
+	Retention struct {
+		MaxBytes uint64 `yaml:"max_bytes"`
+	} `yaml:"retention"`
+	Gossip struct {
+		FailedGracePeriod time.Duration `yaml:"failed_grace_period"`
+		EncryptKey        string        `yaml:"encrypt_key"`
+		KeyringFile       string        `yaml:"keyring_file"`
+	} `yaml:"gossip"`
+	MetricsAddr string `yaml:"metrics_addr"`
+	HTTPAddr    string `yaml:"http_addr"`
+	Tracing     struct {
+		SampleRate float64 `yaml:"sample_rate"`
+		File       string  `yaml:"file"`
+	} `yaml:"tracing"`
+	Health struct {
+		CheckInterval     time.Duration `yaml:"check_interval"`
+		MaxReplicationLag uint64        `yaml:"max_replication_lag"`
+	} `yaml:"health"`
+	//Quota is the quota of every subject, unless it has its own in Subjects. The quotas of
+	//subjects are only read from the configuration file. ThrottleStreams slows streams over quota
+	//down instead of failing them
+	Quota struct {
+		QuotaRates      `yaml:",inline"`
+		Subjects        map[string]QuotaRates `yaml:"subjects"`
+		ThrottleStreams bool                  `yaml:"throttle_streams"`
+	} `yaml:"quota"`
+}
+
+//QuotaRates limit the rate a subject produces and consumes at. Zero rates are unlimited
+type QuotaRates struct {
+	ProduceBytesPerSecond   float64 `yaml:"produce_bytes_per_second"`
+	ProduceRecordsPerSecond float64 `yaml:"produce_records_per_second"`
+	ConsumeBytesPerSecond   float64 `yaml:"consume_bytes_per_second"`
+}
+
+//TLSFiles are the paths of a certificate, its key and the certificate authority that verifies peers.
+//Servers also reject the client certificates revoked by the CRL file or listed in the revoked
+//serials file. Clients verify the certificates of servers against ServerName, which is required
+//to dial servers by IP address
+type TLSFiles struct {
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	CAFile             string `yaml:"ca_file"`
+	CRLFile            string `yaml:"crl_file"`
+	RevokedSerialsFile string `yaml:"revoked_serials_file"`
+	ServerName         string `yaml:"server_name"`
+}
+
+//Enabled returns true if the cert, key or ca file is set
+func (f TLSFiles) Enabled() bool {
+	return f.CertFile != "" || f.KeyFile != "" || f.CAFile != ""
+}
+
+//DefaultServer returns the configuration used for settings that are not configured
+func DefaultServer() *Server {
+	hostname, _ := os.Hostname()
+	s := &Server{
+		DataDir:  filepath.Join(os.TempDir(), "proglog"),
+		NodeName: hostname,
+		BindAddr: "127.0.0.1:8401",
+		RPCAddr:  "127.0.0.1:8400",
+	}
+	s.ACL.ModelFile = ACLModelFile
+	s.ACL.PolicyFile = ACLPolicyFile
+	s.Tracing.SampleRate = 0.01
+	s.Health.CheckInterval = time.Second
+	s.Health.MaxReplicationLag = 100
+	return s
+}
+
+//LoadServer builds the server configuration from the defaults, the configuration file, the
+//environment and args, in increasing order of precedence, and validates it. lookupEnv is
+//usually os.LookupEnv
+func LoadServer(name string, args []string, lookupEnv func(string) (string, bool)) (*Server, error) {
+	//parse once to find the configuration file and which flags were set. Flags are applied
+	//again after the file and environment so that they take precedence
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String(ConfigFileFlag, "", "Path to a YAML configuration file.")
+	DefaultServer().bindFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if *configFile == "" {
+		*configFile, _ = lookupEnv(envName(ConfigFileFlag))
+	}
+
+	s := DefaultServer()
+	if *configFile != "" {
+		err = s.readFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	overrides := flag.NewFlagSet(name, flag.ContinueOnError)
+	s.bindFlags(overrides)
+	overrides.VisitAll(func(f *flag.Flag) {
+		v, ok := lookupEnv(envName(f.Name))
+		if ok && err == nil {
+			err = overrides.Set(f.Name, v)
+			if err != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", v, envName(f.Name), err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != ConfigFileFlag && err == nil {
+			err = overrides.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//readFile reads the YAML file at path into s. Unknown keys are errors so typos are not ignored
+func (s *Server) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(s)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	return nil
+}
+
+//bindFlags defines a flag for every setting but the cert identity rules and the quotas of
+//subjects, defaulting to its current value
+func (s *Server) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&s.DataDir, "data-dir", s.DataDir, "Directory to store log data.")
+	fs.StringVar(&s.NodeName, "node-name", s.NodeName, "Unique server ID.")
+	fs.StringVar(&s.BindAddr, "bind-addr", s.BindAddr, "Address to bind serf on.")
+	fs.StringVar(&s.RPCAddr, "rpc-addr", s.RPCAddr, "Address to serve rpcs on.")
+	fs.Var((*listValue)(&s.StartJoinAddrs), "start-join-addrs", "Comma separated serf addresses to join.")
+	fs.StringVar(&s.ACL.ModelFile, "acl-model-file", s.ACL.ModelFile, "Path to ACL model.")
+	fs.StringVar(&s.ACL.PolicyFile, "acl-policy-file", s.ACL.PolicyFile, "Path to ACL policy.")
+	fs.Var((*listValue)(&s.Auth.Token.HMACKeyFiles), "auth-token-hmac-key-files", "Comma separated paths to secrets that verify HMAC signed tokens.")
+	fs.Var((*listValue)(&s.Auth.Token.Ed25519KeyFiles), "auth-token-ed25519-key-files", "Comma separated paths to PEM public keys that verify Ed25519 signed tokens.")
+	fs.StringVar(&s.Auth.Token.Issuer, "auth-token-issuer", s.Auth.Token.Issuer, "Issuer tokens must be issued by, when set.")
+	fs.StringVar(&s.Auth.Token.Audience, "auth-token-audience", s.Auth.Token.Audience, "Audience tokens must be for, when set.")
+	fs.StringVar(&s.Auth.APIKeysFile, "auth-api-keys-file", s.Auth.APIKeysFile, "Path to the subjects and SHA-256 digests of API keys.")
+	fs.Var((*listValue)(&s.Auth.CertIdentity.Sources), "auth-cert-identity-sources", "Comma separated parts of client certs that subjects are read from, in order: cn, uri, dns or ou. Defaults to cn.")
+	fs.StringVar(&s.ServerTLS.CertFile, "server-tls-cert-file", s.ServerTLS.CertFile, "Path to server tls cert.")
+	fs.StringVar(&s.ServerTLS.KeyFile, "server-tls-key-file", s.ServerTLS.KeyFile, "Path to server tls key.")
+	fs.StringVar(&s.ServerTLS.CAFile, "server-tls-ca-file", s.ServerTLS.CAFile, "Path to server certificate authority.")
+	fs.StringVar(&s.ServerTLS.CRLFile, "server-tls-crl-file", s.ServerTLS.CRLFile, "Path to a CRL of revoked client certs, signed by the server certificate authority.")
+	fs.StringVar(&s.ServerTLS.RevokedSerialsFile, "server-tls-revoked-serials-file", s.ServerTLS.RevokedSerialsFile, "Path to a file of revoked client cert serial numbers in hex, one per line.")
+	fs.StringVar(&s.PeerTLS.CertFile, "peer-tls-cert-file", s.PeerTLS.CertFile, "Path to peer tls cert.")
+	fs.StringVar(&s.PeerTLS.KeyFile, "peer-tls-key-file", s.PeerTLS.KeyFile, "Path to peer tls key.")
+	fs.StringVar(&s.PeerTLS.CAFile, "peer-tls-ca-file", s.PeerTLS.CAFile, "Path to peer certificate authority.")
+	fs.StringVar(&s.PeerTLS.ServerName, "peer-tls-server-name", s.PeerTLS.ServerName, "Name to verify the certs of peers against. Required to dial peers by IP address.")
+	fs.Uint64Var(&s.Segment.MaxStoreBytes, "segment-max-store-bytes", s.Segment.MaxStoreBytes, "Size at which a segment's store is full.")
+	fs.Uint64Var(&s.Segment.MaxIndexBytes, "segment-max-index-bytes", s.Segment.MaxIndexBytes, "Size at which a segment's index is full.")
+	fs.Uint64Var(&s.Segment.InitialOffset, "segment-initial-offset", s.Segment.InitialOffset, "Offset of the first record of a new log.")
+	fs.Uint64Var(&s.Retention.MaxBytes, "retention-max-bytes", s.Retention.MaxBytes, "Size of the log above which the oldest segments are removed.")
+	fs.DurationVar(&s.Gossip.FailedGracePeriod, "gossip-failed-grace-period", s.Gossip.FailedGracePeriod, "How long a failed member may recover before it is removed.")
+	fs.StringVar(&s.Gossip.EncryptKey, "gossip-encrypt-key", s.Gossip.EncryptKey, "Base64 key that encrypts gossip.")
+	fs.StringVar(&s.Gossip.KeyringFile, "gossip-keyring-file", s.Gossip.KeyringFile, "Path to the gossip keyring.")
+	fs.StringVar(&s.MetricsAddr, "metrics-addr", s.MetricsAddr, "Address to serve Prometheus metrics on at /metrics. Disabled when empty.")
+	fs.StringVar(&s.HTTPAddr, "http-addr", s.HTTPAddr, "Address to serve the HTTP/JSON API on, with the server tls. Disabled when empty.")
+	fs.Float64Var(&s.Tracing.SampleRate, "tracing-sample-rate", s.Tracing.SampleRate, "Fraction of traces started by the server that are sampled.")
+	fs.StringVar(&s.Tracing.File, "tracing-file", s.Tracing.File, "File to append sampled spans to as JSON lines. Spans are not exported when empty.")
+	fs.DurationVar(&s.Health.CheckInterval, "health-check-interval", s.Health.CheckInterval, "How often readiness is checked.")
+	fs.Uint64Var(&s.Health.MaxReplicationLag, "health-max-replication-lag", s.Health.MaxReplicationLag, "Records a follower may be behind the leader and still serve produces.")
+	fs.Float64Var(&s.Quota.ProduceBytesPerSecond, "quota-produce-bytes-per-second", s.Quota.ProduceBytesPerSecond, "Bytes of record values each subject may produce a second. Unlimited when zero.")
+	fs.Float64Var(&s.Quota.ProduceRecordsPerSecond, "quota-produce-records-per-second", s.Quota.ProduceRecordsPerSecond, "Records each subject may produce a second. Unlimited when zero.")
+	fs.Float64Var(&s.Quota.ConsumeBytesPerSecond, "quota-consume-bytes-per-second", s.Quota.ConsumeBytesPerSecond, "Bytes of record values each subject may consume a second. Unlimited when zero.")
+	fs.BoolVar(&s.Quota.ThrottleStreams, "quota-throttle-streams", s.Quota.ThrottleStreams, "Slow streams over quota down to the quota instead of failing them with ResourceExhausted.")
+}
+
+//Validate reports every invalid setting and combination of settings at once
+func (s *Server) Validate() error {
+	var errs []string
+	if s.DataDir == "" {
+		errs = append(errs, "data dir is required")
+	}
+	if s.NodeName == "" {
+		errs = append(errs, "node name is required")
+	}
+	addrs := map[string]string{"bind addr": s.BindAddr, "rpc addr": s.RPCAddr}
+	for i, addr := range s.StartJoinAddrs {
+		addrs[fmt.Sprintf("start join addr %d", i)] = addr
+	}
+	if s.MetricsAddr != "" {
+		addrs["metrics addr"] = s.MetricsAddr
+	}
+	if s.HTTPAddr != "" {
+		addrs["http addr"] = s.HTTPAddr
+	}
+	for name, addr := range addrs {
+		_, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %q is not a host:port address", name, addr))
+		}
+	}
+	if s.BindAddr != "" && s.BindAddr == s.RPCAddr {
+		errs = append(errs, fmt.Sprintf("bind addr and rpc addr are both %s", s.BindAddr))
+	}
+	if s.ACL.ModelFile == "" || s.ACL.PolicyFile == "" {
+		errs = append(errs, "acl model file and policy file are required")
+	}
+	if !(s.Tracing.SampleRate >= 0 && s.Tracing.SampleRate <= 1) {
+		errs = append(errs, fmt.Sprintf("tracing sample rate %v is not between 0 and 1", s.Tracing.SampleRate))
+	}
+	for name, files := range map[string]TLSFiles{"server tls": s.ServerTLS, "peer tls": s.PeerTLS} {
+		if (files.CertFile == "") != (files.KeyFile == "") {
+			errs = append(errs, fmt.Sprintf("%s cert file and key file must be set together", name))
+		}
+	}
+	if s.ServerTLS.Enabled() && s.ServerTLS.CertFile == "" {
+		errs = append(errs, "server tls needs a cert file and key file")
+	}
+	if (s.ServerTLS.CRLFile != "" || s.ServerTLS.RevokedSerialsFile != "") && s.ServerTLS.CAFile == "" {
+		errs = append(errs, "server tls revocation needs a ca file to verify clients")
+	}
+	if s.PeerTLS.CRLFile != "" || s.PeerTLS.RevokedSerialsFile != "" {
+		errs = append(errs, "peer tls has no revocation, peers are checked by the server tls of the nodes they join")
+	}
+	if s.ServerTLS.ServerName != "" {
+		errs = append(errs, "server tls has no server name, it is the name peers verify servers against")
+	}
+	if !s.Token().Enabled() && (s.Auth.Token.Issuer != "" || s.Auth.Token.Audience != "") {
+		errs = append(errs, "auth token issuer and audience need token key files")
+	}
+	_, err := auth.NewCertIdentity(s.CertIdentity())
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("auth cert identity: %v", err))
+	}
+	quotas := map[string]QuotaRates{"quota": s.Quota.QuotaRates}
+	for subject, rates := range s.Quota.Subjects {
+		quotas[fmt.Sprintf("quota of %s", subject)] = rates
+	}
+	for name, rates := range quotas {
+		if rates.ProduceBytesPerSecond < 0 || rates.ProduceRecordsPerSecond < 0 || rates.ConsumeBytesPerSecond < 0 {
+			errs = append(errs, fmt.Sprintf("%s has negative rates", name))
+		}
+	}
+	if s.Gossip.FailedGracePeriod < 0 {
+		errs = append(errs, fmt.Sprintf("gossip failed grace period %s is negative", s.Gossip.FailedGracePeriod))
+	}
+	err = s.Log().Validate()
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		//map iteration is random, keep the message stable
+		sort.Strings(errs)
+		return fmt.Errorf("invalid server config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//Log returns the configuration of the server's log
+func (s *Server) Log() log.Config {
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = s.Segment.MaxStoreBytes
+	c.Segment.MaxIndexBytes = s.Segment.MaxIndexBytes
+	c.Segment.InitialOffset = s.Segment.InitialOffset
+	c.Retention.MaxBytes = s.Retention.MaxBytes
+	return c
+}
+
+//Token returns the configuration of token authentication
+func (s *Server) Token() auth.TokenConfig {
+	return auth.TokenConfig{
+		HMACKeyFiles:    s.Auth.Token.HMACKeyFiles,
+		Ed25519KeyFiles: s.Auth.Token.Ed25519KeyFiles,
+		Issuer:          s.Auth.Token.Issuer,
+		Audience:        s.Auth.Token.Audience,
+	}
+}
+
+//CertIdentity returns the configuration of how subjects are found in client certificates
+func (s *Server) CertIdentity() auth.IdentityConfig {
+	c := auth.IdentityConfig{}
+	for _, source := range s.Auth.CertIdentity.Sources {
+		c.Sources = append(c.Sources, auth.IdentitySource(source))
+	}
+	for _, r := range s.Auth.CertIdentity.Rules {
+		c.Rules = append(c.Rules, auth.IdentityRule{
+			Source:  auth.IdentitySource(r.Source),
+			Match:   r.Match,
+			Subject: r.Subject,
+		})
+	}
+	return c
+}
+
+//ClientCertOptional returns true if clients may authenticate without a certificate
+func (s *Server) ClientCertOptional() bool {
+	return s.Token().Enabled() || s.Auth.APIKeysFile != ""
+}
+
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+//listValue is a flag.Value of comma separated strings
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(v string) error {
+	*l = nil
+	if v != "" {
+		*l = strings.Split(v, ",")
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfigFile = `
+data_dir: /var/lib/proglog
+node_name: file-node
+bind_addr: 127.0.0.1:9401
+rpc_addr: 127.0.0.1:9400
+start_join_addrs:
+  - 127.0.0.1:8401
+  - 127.0.0.1:8501
+acl:
+  model_file: /etc/proglog/model.conf
+  policy_file: /etc/proglog/policy.csv
+server_tls:
+  cert_file: /etc/proglog/server.pem
+  key_file: /etc/proglog/server-key.pem
+  ca_file: /etc/proglog/ca.pem
+segment:
+  max_store_bytes: 4096
+  max_index_bytes: 1200
+retention:
+  max_bytes: 65536
+gossip:
+  failed_grace_period: 30s
+health:
+  max_replication_lag: 10
+auth:
+  token:
+    ed25519_key_files:
+      - /etc/proglog/token.pub
+    issuer: https://issuer.example.com
+  cert_identity:
+    sources: [uri, cn]
+    rules:
+      - source: uri
+        match: spiffe://example\.org/ns/(\w+)/sa/(\w+)
+        subject: $1/$2
+quota:
+  produce_bytes_per_second: 1048576
+  subjects:
+    bulk:
+      produce_bytes_per_second: 10485760
+  throttle_streams: true
+`
+
+func TestLoadServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "proglog.yaml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(testConfigFile), 0600))
+
+	for scenario, tc := range map[string]struct {
+		args    []string
+		env     map[string]string
+		check   func(t *testing.T, s *Server)
+		wantErr string
+	}{
+		"defaults": {
+			check: func(t *testing.T, s *Server) {
+				require.Equal(t, DefaultServer(), s)
+			},
+		},
+		"file": {
+			args: []string{"-config-file", file},
+			check: func(t *testing.T, s *Server) {
+				require.Equal(t, "file-node", s.NodeName)
+				require.Equal(t, []string{"127.0.0.1:8401", "127.0.0.1:8501"}, s.StartJoinAddrs)
+				require.Equal(t, "/etc/proglog/ca.pem", s.ServerTLS.CAFile)
+				require.Equal(t, uint64(1200), s.Log().Segment.MaxIndexBytes)
+				require.Equal(t, uint64(65536), s.Log().Retention.MaxBytes)
+				require.Equal(t, 30*time.Second, s.Gossip.FailedGracePeriod)
+				require.Equal(t, uint64(10), s.Health.MaxReplicationLag)
+				require.Equal(t, time.Second, s.Health.CheckInterval, "defaults are kept")
+				require.Equal(t, []string{"/etc/proglog/token.pub"}, s.Token().Ed25519KeyFiles)
+				require.Equal(t, "https://issuer.example.com", s.Token().Issuer)
+				require.True(t, s.ClientCertOptional())
+				identity := s.CertIdentity()
+				require.Equal(t, []auth.IdentitySource{auth.URISAN, auth.CommonName}, identity.Sources)
+				require.Equal(t, float64(1048576), s.Quota.ProduceBytesPerSecond)
+				require.Equal(t, QuotaRates{ProduceBytesPerSecond: 10485760}, s.Quota.Subjects["bulk"])
+				require.True(t, s.Quota.ThrottleStreams)
+				require.Equal(t, []auth.IdentityRule{{
+					Source:  auth.URISAN,
+					Match:   `spiffe://example\.org/ns/(\w+)/sa/(\w+)`,
+					Subject: "$1/$2",
+				}}, identity.Rules)
+			},
+		},
+		"file from environment": {
+			env: map[string]string{"PROGLOG_CONFIG_FILE": file},
+			check: func(t *testing.T, s *Server) {
+				require.Equal(t, "file-node", s.NodeName)
+			},
+		},
+		"environment overrides file": {
+			args: []string{"-config-file", file},
+			env: map[string]string{
+				"PROGLOG_NODE_NAME":                  "env-node",
+				"PROGLOG_START_JOIN_ADDRS":           "127.0.0.1:8601",
+				"PROGLOG_GOSSIP_FAILED_GRACE_PERIOD": "1m",
+			},
+			check: func(t *testing.T, s *Server) {
+				require.Equal(t, "env-node", s.NodeName)
+				require.Equal(t, []string{"127.0.0.1:8601"}, s.StartJoinAddrs)
+				require.Equal(t, time.Minute, s.Gossip.FailedGracePeriod)
+				require.Equal(t, "/var/lib/proglog", s.DataDir)
+			},
+		},
+		"flags override environment": {
+			args: []string{"-config-file", file, "-node-name", "flag-node"},
+			env:  map[string]string{"PROGLOG_NODE_NAME": "env-node"},
+			check: func(t *testing.T, s *Server) {
+				require.Equal(t, "flag-node", s.NodeName)
+			},
+		},
+		"unknown file keys fail": {
+			args:    []string{"-config-file", writeFile(t, dir, "segments:\n  max_store_bytes: 1\n")},
+			wantErr: "field segments not found",
+		},
+		"invalid environment values fail": {
+			env:     map[string]string{"PROGLOG_SEGMENT_MAX_STORE_BYTES": "lots"},
+			wantErr: "PROGLOG_SEGMENT_MAX_STORE_BYTES",
+		},
+		"index smaller than an entry fails": {
+			args:    []string{"-segment-max-index-bytes", "4"},
+			wantErr: "segment max index bytes 4 is smaller than one index entry",
+		},
+		"tls key without cert fails": {
+			args:    []string{"-peer-tls-key-file", "key.pem"},
+			wantErr: "peer tls cert file and key file must be set together",
+		},
+		"revocation needs a ca file": {
+			args:    []string{"-server-tls-cert-file", "server.pem", "-server-tls-key-file", "server-key.pem", "-server-tls-crl-file", "ca.crl"},
+			wantErr: "server tls revocation needs a ca file to verify clients",
+		},
+		"peers verify servers against a name": {
+			args: []string{"-peer-tls-server-name", "proglog.internal"},
+			check: func(t *testing.T, s *Server) {
+				require.Equal(t, "proglog.internal", s.PeerTLS.ServerName)
+			},
+		},
+		"server tls has no server name": {
+			args:    []string{"-config-file", writeFile(t, dir, "server_tls:\n  server_name: proglog.internal\n")},
+			wantErr: "server tls has no server name",
+		},
+		"addresses must differ": {
+			args:    []string{"-bind-addr", "127.0.0.1:8400"},
+			wantErr: "bind addr and rpc addr are both 127.0.0.1:8400",
+		},
+		"join addresses need a port": {
+			args:    []string{"-start-join-addrs", "127.0.0.1"},
+			wantErr: `start join addr 0 "127.0.0.1" is not a host:port address`,
+		},
+		"api keys make client certs optional": {
+			args: []string{"-auth-api-keys-file", "keys"},
+			check: func(t *testing.T, s *Server) {
+				require.False(t, s.Token().Enabled())
+				require.True(t, s.ClientCertOptional())
+			},
+		},
+		"token audience needs keys": {
+			args:    []string{"-auth-token-audience", "proglog"},
+			wantErr: "auth token issuer and audience need token key files",
+		},
+		"unknown cert identity sources fail": {
+			args:    []string{"-auth-cert-identity-sources", "uri,email"},
+			wantErr: `auth cert identity: unknown identity source "email"`,
+		},
+		"quotas are flags": {
+			args: []string{"-quota-consume-bytes-per-second", "512"},
+			check: func(t *testing.T, s *Server) {
+				require.Equal(t, float64(512), s.Quota.ConsumeBytesPerSecond)
+			},
+		},
+		"quotas are not negative": {
+			args:    []string{"-quota-produce-records-per-second", "-1"},
+			wantErr: "quota has negative rates",
+		},
+		"sample rate is a fraction": {
+			args:    []string{"-tracing-sample-rate", "2"},
+			wantErr: "tracing sample rate 2 is not between 0 and 1",
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			lookupEnv := func(k string) (string, bool) {
+				v, ok := tc.env[k]
+				return v, ok
+			}
+			s, err := LoadServer("test", tc.args, lookupEnv)
+			if tc.wantErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			tc.check(t, s)
+		})
+	}
+}
+
+func writeFile(t *testing.T, dir, contents string) string {
+	t.Helper()
+	f, err := ioutil.TempFile(dir, "*.yaml")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	return f.Name()
+}
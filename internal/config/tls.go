@@ -13,6 +13,14 @@ type TLSConfig struct {
 	CAFile        string
 	ServerAddress string
 	Server        bool
+	//ClientCertOptional makes servers verify client certificates only when clients present one,
+	//for clients that authenticate with tokens instead
+	ClientCertOptional bool
+	//CRLFile and RevokedSerialsFile make servers reject revoked client certificates. The CRL is
+	//PEM or DER and must be signed by the CA. The serials file lists hex serial numbers, one per
+	//line
+	CRLFile            string
+	RevokedSerialsFile string
 }
 
 func SetupTLSConfig(cfg TLSConfig) (tlsConfig *tls.Config, err error) {
@@ -40,6 +48,16 @@ func SetupTLSConfig(cfg TLSConfig) (tlsConfig *tls.Config, err error) {
 		if cfg.Server {
 			tlsConfig.ClientCAs = ca
 			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if cfg.ClientCertOptional {
+				tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			if cfg.CRLFile != "" || cfg.RevokedSerialsFile != "" {
+				r, err := loadRevocation(cfg)
+				if err != nil {
+					return nil, err
+				}
+				tlsConfig.VerifyPeerCertificate = r.verify
+			}
 		} else {
 			tlsConfig.RootCAs = ca
 		}
@@ -1,7 +1,13 @@
 package discovery
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -23,6 +29,15 @@ func TestMembership(t *testing.T) {
 			0 == len(handler.leaves)
 	}, 3*time.Second, 250*time.Millisecond)
 
+	servers, err := m[1].GetServers()
+	assert.NoError(t, err)
+	assert.Equal(t, nMembers, len(servers))
+	for i, server := range servers {
+		assert.Equal(t, fmt.Sprintf("%d", i), server.Id)
+		assert.Equal(t, m[i].Tags["rpc_addr"], server.RpcAddr)
+		assert.Equal(t, i == 0, server.IsLeader)
+	}
+
 	assert.NoError(t, m[2].Leave())
 	time.Sleep(3)
 	//	log.Printf(" len joins %d, members %d, leaves %d", len(handler.joins), len(m[0].Members()), len(handler.leaves))
@@ -85,3 +100,174 @@ func (h *handler) Leave(name string) error {
 	h.leaves <- name
 	return nil
 }
+
+func TestMembershipFailedAndUpdated(t *testing.T) {
+	h := newEventHandler(nMembers * 10)
+	m, err := NewMembership(h, memberConfig("0", dynaport.Get(1)[0], nil, 10*time.Second))
+	assert.NoError(t, err)
+	port := dynaport.Get(1)[0]
+	failing, err := NewMembership(newHandler(nMembers*10), memberConfig("1", port, m, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, Event{Type: MemberJoined, Name: "1", Addr: failing.Tags["rpc_addr"]}, h.next(t))
+
+	//shutting down without leaving looks like a failure to the rest of the cluster
+	assert.NoError(t, failing.serf.Shutdown())
+	assert.Equal(t, Event{Type: MemberFailed, Name: "1", Addr: failing.Tags["rpc_addr"]}, h.next(t))
+
+	//coming back within the grace period recovers the member
+	recovered, err := NewMembership(newHandler(nMembers*10), memberConfig("1", port, m, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, Event{Type: MemberRecovered, Name: "1", Addr: failing.Tags["rpc_addr"]}, h.next(t))
+
+	//changing the rpc_addr is reported as an update
+	tags := map[string]string{"rpc_addr": "127.0.0.1:1"}
+	assert.NoError(t, recovered.serf.SetTags(tags))
+	assert.Equal(t, Event{Type: MemberUpdated, Name: "1", Addr: "127.0.0.1:1"}, h.next(t))
+
+	assert.NoError(t, recovered.Leave())
+	assert.Equal(t, Event{Type: MemberLeft, Name: "1", Addr: "127.0.0.1:1"}, h.next(t))
+}
+
+func TestMembershipFailedGracePeriodExpires(t *testing.T) {
+	h := newEventHandler(nMembers * 10)
+	m, err := NewMembership(h, memberConfig("0", dynaport.Get(1)[0], nil, 100*time.Millisecond))
+	assert.NoError(t, err)
+	failing, err := NewMembership(newHandler(nMembers*10), memberConfig("1", dynaport.Get(1)[0], m, 0))
+	assert.NoError(t, err)
+	addr := failing.Tags["rpc_addr"]
+	assert.Equal(t, Event{Type: MemberJoined, Name: "1", Addr: addr}, h.next(t))
+
+	assert.NoError(t, failing.serf.Shutdown())
+	assert.Equal(t, Event{Type: MemberFailed, Name: "1", Addr: addr}, h.next(t))
+	assert.Equal(t, Event{Type: MemberLeft, Name: "1", Addr: addr}, h.next(t))
+}
+
+func memberConfig(name string, port int, join *Membership, grace time.Duration) Config {
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", port)
+	config := Config{
+		NodeName:          name,
+		BindAddr:          addr,
+		Tags:              map[string]string{"rpc_addr": addr},
+		FailedGracePeriod: grace,
+	}
+	if join != nil {
+		config.StartJoinAddrs = []string{join.BindAddr}
+	}
+	return config
+}
+
+//eventHandler records the events reported to an EventHandler
+type eventHandler struct {
+	*handler
+	events chan Event
+}
+
+func newEventHandler(depth int) *eventHandler {
+	return &eventHandler{
+		handler: newHandler(depth),
+		events:  make(chan Event, depth),
+	}
+}
+
+func (h *eventHandler) HandleEvent(e Event) error {
+	h.events <- e
+	return nil
+}
+
+func (h *eventHandler) next(t *testing.T) Event {
+	t.Helper()
+	select {
+	case e := <-h.events:
+		return e
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out waiting for membership event")
+	}
+	return Event{}
+}
+
+func TestMembershipEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key := newKey(t)
+
+	m0, err := newEncryptedMember("0", key, dir, nil)
+	assert.NoError(t, err)
+	_, err = newEncryptedMember("1", key, dir, m0)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return 2 == len(m0.Members())
+	}, 3*time.Second, 250*time.Millisecond)
+
+	//members without the key cannot join
+	_, err = newEncryptedMember("2", newKey(t), dir, m0)
+	assert.Error(t, err)
+	_, err = newEncryptedMember("3", "", dir, m0)
+	assert.Error(t, err)
+	_, err = newEncryptedMember("4", "not a key", dir, m0)
+	assert.Error(t, err)
+
+	installed := newKey(t)
+	_, err = m0.InstallKey(installed)
+	assert.NoError(t, err)
+	res, err := m0.ListKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{key: 2, installed: 2}, res.Keys)
+	assert.Equal(t, map[string]int{key: 2}, res.PrimaryKeys)
+}
+
+func TestMembershipKeyRotation(t *testing.T) {
+	if raceEnabled {
+		//memberlist reads the keyring without holding its lock when using and removing keys
+		t.Skip("memberlist keyring is not race free")
+	}
+	dir, err := ioutil.TempDir("", "discovery-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	key := newKey(t)
+
+	m0, err := newEncryptedMember("0", key, dir, nil)
+	assert.NoError(t, err)
+	m1, err := newEncryptedMember("1", key, dir, m0)
+	assert.NoError(t, err)
+
+	rotated := newKey(t)
+	_, err = m0.InstallKey(rotated)
+	assert.NoError(t, err)
+	_, err = m1.UseKey(rotated)
+	assert.NoError(t, err)
+	_, err = m0.RemoveKey(key)
+	assert.NoError(t, err)
+	res, err := m1.ListKeys()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{rotated: 2}, res.Keys)
+
+	//the keyring file takes precedence over the configured key on restart
+	b, err := ioutil.ReadFile(filepath.Join(dir, "1.keyring"))
+	assert.NoError(t, err)
+	var keys []string
+	assert.NoError(t, json.Unmarshal(b, &keys))
+	assert.Equal(t, []string{rotated}, keys)
+	assert.NoError(t, m1.Leave())
+	assert.NoError(t, m1.serf.Shutdown())
+	_, err = newEncryptedMember("1", key, dir, m0)
+	assert.NoError(t, err)
+	_, err = newEncryptedMember("2", key, dir, m0)
+	assert.Error(t, err)
+}
+
+//newEncryptedMember creates a member that keeps its keyring in dir
+func newEncryptedMember(name, key, dir string, join *Membership) (*Membership, error) {
+	config := memberConfig(name, dynaport.Get(1)[0], join, 0)
+	config.EncryptKey = key
+	config.KeyringFile = filepath.Join(dir, name+".keyring")
+	return NewMembership(newHandler(nMembers*10), config)
+}
+
+func newKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
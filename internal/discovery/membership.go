@@ -1,9 +1,20 @@
 package discovery
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
+	api "github.com/krehermann/proglog/api/v1"
 	"go.uber.org/zap"
 )
 
@@ -12,6 +23,15 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+	//FailedGracePeriod is how long a failed member is given to come back before it is treated
+	//as having left. Zero treats failed members as having left immediately
+	FailedGracePeriod time.Duration
+	//EncryptKey is the base64 encoded key used to encrypt gossip traffic. It must decode to
+	//16, 24 or 32 bytes. Empty leaves gossip unencrypted
+	EncryptKey string
+	//KeyringFile is where the gossip keyring is persisted when keys are installed, used or removed.
+	//When the file exists its keys take precedence over EncryptKey
+	KeyringFile string
 }
 type Membership struct {
 	Config
@@ -19,6 +39,11 @@ type Membership struct {
 	serf    *serf.Serf
 	events  chan serf.Event
 	logger  zap.Logger
+	mu      sync.Mutex
+	// addrs tracks the rpc_addr of the members that were reported to the handler
+	addrs map[string]string
+	// failed tracks the members in their grace period. The timers report them as left on expiry
+	failed map[string]*time.Timer
 }
 
 func NewMembership(handler Handler, config Config) (*Membership, error) {
@@ -26,6 +51,8 @@ func NewMembership(handler Handler, config Config) (*Membership, error) {
 		Config:  config,
 		handler: handler,
 		logger:  *zap.L().Named("membership"),
+		addrs:   make(map[string]string),
+		failed:  make(map[string]*time.Timer),
 	}
 
 	err := c.setupSerf()
@@ -48,6 +75,11 @@ func (m *Membership) setupSerf() (err error) {
 	config.EventCh = m.events
 	config.Tags = m.Tags
 	config.NodeName = m.Config.NodeName
+	config.KeyringFile = m.KeyringFile
+	config.MemberlistConfig.Keyring, err = m.keyring()
+	if err != nil {
+		return err
+	}
 	m.serf, err = serf.Create(config)
 	if err != nil {
 		return err
@@ -63,27 +95,155 @@ func (m *Membership) setupSerf() (err error) {
 
 }
 
+//keyring returns the gossip keyring from the keyring file or the encryption key.
+//It returns nil when encryption is not configured
+func (m *Membership) keyring() (*memberlist.Keyring, error) {
+	var keys []string
+	if m.KeyringFile != "" {
+		b, err := ioutil.ReadFile(m.KeyringFile)
+		switch {
+		case err == nil:
+			err = json.Unmarshal(b, &keys)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode keyring file %q: %w", m.KeyringFile, err)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, err
+		}
+	}
+	if len(keys) == 0 && m.EncryptKey != "" {
+		keys = []string{m.EncryptKey}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	decoded := make([][]byte, len(keys))
+	for i, key := range keys {
+		var err error
+		decoded[i], err = decodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return memberlist.NewKeyring(decoded, decoded[0])
+}
+
+//ErrInvalidKey is returned for gossip keys that are not base64 encoded AES keys
+var ErrInvalidKey = errors.New("invalid gossip key")
+
+//decodeKey decodes a base64 gossip key and checks that it is a valid AES key
+func decodeKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode: %v", ErrInvalidKey, err)
+	}
+	err = memberlist.ValidateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return b, nil
+}
+
 type Handler interface {
 	Join(name, addr string) error
 	Leave(name string) error
 }
 
+//EventType is the kind of membership transition reported to an EventHandler
+type EventType int
+
+const (
+	//MemberJoined is reported when a member joins the cluster
+	MemberJoined EventType = iota
+	//MemberFailed is reported when a member stops responding. It is followed by either
+	//MemberRecovered or, once the grace period expires, MemberLeft
+	MemberFailed
+	//MemberRecovered is reported when a failed member returns within the grace period
+	MemberRecovered
+	//MemberUpdated is reported when a member's rpc_addr changes
+	MemberUpdated
+	//MemberLeft is reported when a member leaves, is reaped, or its grace period expires
+	MemberLeft
+)
+
+func (t EventType) String() string {
+	switch t {
+	case MemberJoined:
+		return "joined"
+	case MemberFailed:
+		return "failed"
+	case MemberRecovered:
+		return "recovered"
+	case MemberUpdated:
+		return "updated"
+	case MemberLeft:
+		return "left"
+	}
+	return "unknown"
+}
+
+//Event is a membership transition of a single member
+type Event struct {
+	Type EventType
+	Name string
+	Addr string
+}
+
+//EventHandler is a Handler that is told about every transition rather than only joins and leaves.
+//Membership calls HandleEvent instead of Join and Leave for handlers that implement it
+type EventHandler interface {
+	Handler
+	HandleEvent(Event) error
+}
+
+//Handlers reports every event to each of its handlers in turn, so that several components can follow
+//the membership of the cluster. It returns the first error, after every handler has been told
+type Handlers []EventHandler
+
+var _ EventHandler = Handlers(nil)
+
+func (hs Handlers) Join(name, addr string) error {
+	return hs.each(func(h EventHandler) error { return h.Join(name, addr) })
+}
+
+func (hs Handlers) Leave(name string) error {
+	return hs.each(func(h EventHandler) error { return h.Leave(name) })
+}
+
+func (hs Handlers) HandleEvent(e Event) error {
+	return hs.each(func(h EventHandler) error { return h.HandleEvent(e) })
+}
+
+func (hs Handlers) each(fn func(EventHandler) error) error {
+	var first error
+	for _, h := range hs {
+		err := fn(h)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
 //eventHandler is loop that reads serf events and processes them
 func (m *Membership) eventHandler() {
 	for e := range m.events {
-		switch e.EventType() {
-		case serf.EventMemberJoin:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if m.isLocal(member) {
-					continue
-				}
-				m.handleJoin(member)
+		memberEvent, ok := e.(serf.MemberEvent)
+		if !ok {
+			continue
+		}
+		for _, member := range memberEvent.Members {
+			if m.isLocal(member) {
+				continue
 			}
-		case serf.EventMemberLeave, serf.EventMemberFailed:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if m.isLocal(member) {
-					continue
-				}
+			switch e.EventType() {
+			case serf.EventMemberJoin:
+				m.handleJoin(member)
+			case serf.EventMemberFailed:
+				m.handleFailed(member)
+			case serf.EventMemberUpdate:
+				m.handleUpdate(member)
+			case serf.EventMemberLeave, serf.EventMemberReap:
 				m.handleLeave(member)
 			}
 		}
@@ -91,21 +251,110 @@ func (m *Membership) eventHandler() {
 }
 
 func (m *Membership) handleJoin(member serf.Member) {
-	err := m.handler.Join(
-		member.Name,
-		member.Tags["rpc_addr"],
-	)
-	if err != nil {
-		m.logError(err, "failed to join", member)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addr := member.Tags["rpc_addr"]
+	timer, failed := m.failed[member.Name]
+	if failed {
+		timer.Stop()
+		delete(m.failed, member.Name)
+		prevAddr := m.addrs[member.Name]
+		m.addrs[member.Name] = addr
+		m.report(Event{Type: MemberRecovered, Name: member.Name, Addr: addr}, member)
+		if prevAddr != addr {
+			m.report(Event{Type: MemberUpdated, Name: member.Name, Addr: addr}, member)
+		}
+		return
+	}
+	m.addrs[member.Name] = addr
+	m.report(Event{Type: MemberJoined, Name: member.Name, Addr: addr}, member)
+}
+
+//handleFailed pauses a failed member and reports it as left if it doesn't recover within the grace period
+func (m *Membership) handleFailed(member serf.Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.addrs[member.Name]; !ok {
+		return
+	}
+	if m.FailedGracePeriod == 0 {
+		m.leave(member)
+		return
+	}
+	if _, ok := m.failed[member.Name]; ok {
+		return
 	}
+	m.report(Event{Type: MemberFailed, Name: member.Name, Addr: m.addrs[member.Name]}, member)
+	m.failed[member.Name] = time.AfterFunc(m.FailedGracePeriod, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.failed[member.Name]; !ok {
+			//recovered or left while the timer fired
+			return
+		}
+		m.leave(member)
+	})
+}
+
+//handleUpdate reports members whose rpc_addr has changed. Other tag changes are ignored
+func (m *Membership) handleUpdate(member serf.Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prevAddr, ok := m.addrs[member.Name]
+	addr := member.Tags["rpc_addr"]
+	if !ok || prevAddr == addr {
+		return
+	}
+	m.addrs[member.Name] = addr
+	if _, failed := m.failed[member.Name]; failed {
+		//the new address is reported when the member recovers
+		return
+	}
+	m.report(Event{Type: MemberUpdated, Name: member.Name, Addr: addr}, member)
 }
 
 func (m *Membership) handleLeave(member serf.Member) {
-	err := m.handler.Leave(
-		member.Name,
-	)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.addrs[member.Name]; !ok {
+		//already left, e.g. a member that is reaped after its grace period expired
+		return
+	}
+	m.leave(member)
+}
+
+//leave reports member as left and forgets it. The caller must hold m.mu
+func (m *Membership) leave(member serf.Member) {
+	if timer, ok := m.failed[member.Name]; ok {
+		timer.Stop()
+		delete(m.failed, member.Name)
+	}
+	addr := m.addrs[member.Name]
+	delete(m.addrs, member.Name)
+	m.report(Event{Type: MemberLeft, Name: member.Name, Addr: addr}, member)
+}
+
+//report passes the event to the handler. Handlers that only implement Handler are told
+//about joins and leaves, and see an updated member leave and join again at its new address
+func (m *Membership) report(e Event, member serf.Member) {
+	var err error
+	if h, ok := m.handler.(EventHandler); ok {
+		err = h.HandleEvent(e)
+	} else {
+		switch e.Type {
+		case MemberJoined:
+			err = m.handler.Join(e.Name, e.Addr)
+		case MemberUpdated:
+			err = m.handler.Leave(e.Name)
+			if err == nil {
+				err = m.handler.Join(e.Name, e.Addr)
+			}
+		case MemberLeft:
+			err = m.handler.Leave(e.Name)
+		}
+	}
 	if err != nil {
-		m.logError(err, "failed to join", member)
+		m.logError(err, "failed to handle "+e.Type.String(), member)
 	}
 }
 
@@ -119,11 +368,78 @@ func (m *Membership) Members() []serf.Member {
 	return m.serf.Members()
 }
 
+//GetServers returns the alive members of the cluster, including the local member, sorted by name.
+//The member with the lowest name is reported as the leader, so every node that sees the same
+//membership agrees on the leader without further coordination
+func (m *Membership) GetServers() ([]*api.Server, error) {
+	var servers []*api.Server
+	for _, member := range m.serf.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+		servers = append(servers, &api.Server{
+			Id:      member.Name,
+			RpcAddr: member.Tags["rpc_addr"],
+		})
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Id < servers[j].Id
+	})
+	if len(servers) > 0 {
+		servers[0].IsLeader = true
+	}
+	return servers, nil
+}
+
+//InstallKey adds the base64 encoded key to the keyring of every member. Installing a key on the whole
+//cluster before using it lets keys be rotated without members losing contact with each other
+func (m *Membership) InstallKey(key string) (*serf.KeyResponse, error) {
+	_, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return m.serf.KeyManager().InstallKey(key)
+}
+
+//UseKey makes the installed key the primary key used to encrypt gossip on every member
+func (m *Membership) UseKey(key string) (*serf.KeyResponse, error) {
+	_, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return m.serf.KeyManager().UseKey(key)
+}
+
+//RemoveKey removes the key from the keyring of every member. The primary key cannot be removed
+func (m *Membership) RemoveKey(key string) (*serf.KeyResponse, error) {
+	_, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return m.serf.KeyManager().RemoveKey(key)
+}
+
+//ListKeys returns the keys installed in the cluster and how many members have each of them
+func (m *Membership) ListKeys() (*serf.KeyResponse, error) {
+	return m.serf.KeyManager().ListKeys()
+}
+
+//Joined returns true while the local member is alive in the cluster, that is after it has joined
+//the start join addresses and until it leaves or shuts down
+func (m *Membership) Joined() bool {
+	return m.serf.State() == serf.SerfAlive
+}
+
 //Leave instructs this instance to depart from the serf cluster
 func (m *Membership) Leave() error {
 	return m.serf.Leave()
 }
 
+//Shutdown stops this instance without leaving the serf cluster, so the other members see it fail
+func (m *Membership) Shutdown() error {
+	return m.serf.Shutdown()
+}
+
 //logError logs the given error and message
 func (m *Membership) logError(err error, msg string, member serf.Member) {
 	m.logger.Error(
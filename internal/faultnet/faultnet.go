@@ -0,0 +1,305 @@
+//Package faultnet injects network faults between named nodes. Connections are made through a
+//Network's dialer, which plugs into Replicator.DialOpts with grpc.WithContextDialer, and accepted
+//through its listener wrapper, which wraps a server's listener. Each wrapped connection applies the
+//faults of the direction it writes in, so wrapping both ends faults traffic in both directions.
+package faultnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+//Any matches every node when setting faults
+const Any = "*"
+
+var (
+	//ErrDropped is returned when a connection attempt is dropped
+	ErrDropped = errors.New("faultnet: connection dropped")
+	//ErrPartitioned is returned when dialing across a partition
+	ErrPartitioned = errors.New("faultnet: partitioned")
+	//ErrReset is returned by a connection that was reset
+	ErrReset = errors.New("faultnet: connection reset")
+)
+
+//Faults are the faults injected into the traffic from one node to another
+type Faults struct {
+	//Latency delays every write by Latency plus a random duration up to Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	//DropRate is the probability that a connection attempt is dropped
+	DropRate float64
+	//ResetRate is the probability that a write resets its connection
+	ResetRate float64
+	//Partitioned stalls writes until the partition heals and refuses new connections
+	Partitioned bool
+}
+
+//link is the direction of traffic between two nodes
+type link struct {
+	from, to string
+}
+
+//Network tracks the faults between nodes and the connections they affect.
+//Random decisions are made from a seeded source so scenarios can be replayed
+type Network struct {
+	mu     sync.Mutex
+	rand   *rand.Rand
+	faults map[link]Faults
+	// nodes maps the rpc addresses of the nodes to their names
+	nodes map[string]string
+	// dialed maps the local addresses of dialed connections to the names of the dialing nodes
+	dialed map[string]string
+	conns  map[*Conn]struct{}
+	// changed is closed and replaced whenever the faults change, waking stalled writes
+	changed chan struct{}
+}
+
+//New creates a network without faults whose random decisions are made from seed
+func New(seed int64) *Network {
+	return &Network{
+		rand:    rand.New(rand.NewSource(seed)),
+		faults:  make(map[link]Faults),
+		nodes:   make(map[string]string),
+		dialed:  make(map[string]string),
+		conns:   make(map[*Conn]struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+//Register names the node listening at addr
+func (n *Network) Register(name, addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nodes[addr] = name
+}
+
+//Set sets the faults of the traffic from one node to another. Either may be Any
+func (n *Network) Set(from, to string, f Faults) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.faults[link{from, to}] = f
+	n.notify()
+}
+
+//Partition stalls the traffic from one node to another, leaving the other direction intact
+func (n *Network) Partition(from, to string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f := n.faults[link{from, to}]
+	f.Partitioned = true
+	n.faults[link{from, to}] = f
+	n.notify()
+}
+
+//Heal removes all faults. Stalled writes are delivered
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.faults = make(map[link]Faults)
+	n.notify()
+}
+
+//Reset resets the connections between two nodes in either direction
+func (n *Network) Reset(a, b string) {
+	n.mu.Lock()
+	var reset []*Conn
+	for c := range n.conns {
+		if (c.local == a && c.remote == b) || (c.local == b && c.remote == a) {
+			reset = append(reset, c)
+		}
+	}
+	n.mu.Unlock()
+	for _, c := range reset {
+		c.reset()
+	}
+}
+
+//Dialer returns a dialer for the named node. Use it with grpc.WithContextDialer
+func (n *Network) Dialer(from string) func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		n.mu.Lock()
+		to := n.nodes[addr]
+		f := n.lookup(from, to)
+		back := n.lookup(to, from)
+		drop := n.chance(f.DropRate)
+		n.mu.Unlock()
+		if f.Partitioned || back.Partitioned {
+			return nil, fmt.Errorf("%w: %s and %s", ErrPartitioned, from, to)
+		}
+		if drop {
+			return nil, ErrDropped
+		}
+		var d net.Dialer
+		nc, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		c := n.wrap(nc, from, to)
+		n.mu.Lock()
+		n.dialed[nc.LocalAddr().String()] = from
+		n.mu.Unlock()
+		return c, nil
+	}
+}
+
+//Listener wraps the listener of the named node so the connections it accepts apply the
+//node's faults. Connections from dialers of other networks are not faulted
+func (n *Network) Listener(name string, ln net.Listener) net.Listener {
+	return &listener{Listener: ln, name: name, network: n}
+}
+
+type listener struct {
+	net.Listener
+	name    string
+	network *Network
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	nc, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.network.wrap(nc, l.name, ""), nil
+}
+
+func (n *Network) wrap(nc net.Conn, local, remote string) *Conn {
+	c := &Conn{
+		Conn:    nc,
+		network: n,
+		local:   local,
+		remote:  remote,
+		closed:  make(chan struct{}),
+	}
+	n.mu.Lock()
+	n.conns[c] = struct{}{}
+	n.mu.Unlock()
+	return c
+}
+
+//lookup returns the faults from one node to another, preferring the most specific match.
+//The caller must hold n.mu
+func (n *Network) lookup(from, to string) Faults {
+	if from == "" || to == "" {
+		//traffic from or to unknown peers is never faulted
+		return Faults{}
+	}
+	for _, l := range []link{{from, to}, {from, Any}, {Any, to}, {Any, Any}} {
+		if f, ok := n.faults[l]; ok {
+			return f
+		}
+	}
+	return Faults{}
+}
+
+//chance returns true with probability p. The caller must hold n.mu
+func (n *Network) chance(p float64) bool {
+	return p > 0 && n.rand.Float64() < p
+}
+
+//notify wakes stalled writes. The caller must hold n.mu
+func (n *Network) notify() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+//Conn is a connection that applies the faults from its local node to its remote node to its writes
+type Conn struct {
+	net.Conn
+	network *Network
+	local   string
+	// remote is resolved on the first write for accepted connections
+	remote  string
+	wmu     sync.Mutex
+	once    sync.Once
+	closed  chan struct{}
+	isReset bool
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := c.network
+	for {
+		n.mu.Lock()
+		if c.remote == "" {
+			c.remote = n.dialed[c.RemoteAddr().String()]
+		}
+		f := n.lookup(c.local, c.remote)
+		changed := n.changed
+		reset := n.chance(f.ResetRate)
+		delay := f.Latency
+		if f.Jitter > 0 {
+			delay += time.Duration(n.rand.Int63n(int64(f.Jitter)))
+		}
+		n.mu.Unlock()
+		if reset {
+			c.reset()
+			return 0, ErrReset
+		}
+		if f.Partitioned {
+			select {
+			case <-changed:
+				continue
+			case <-c.closed:
+				return 0, c.closedErr()
+			}
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-c.closed:
+				return 0, c.closedErr()
+			}
+		}
+		return c.Conn.Write(p)
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		select {
+		case <-c.closed:
+			return n, c.closedErr()
+		default:
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.network.mu.Lock()
+		delete(c.network.conns, c)
+		delete(c.network.dialed, c.LocalAddr().String())
+		c.network.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+//reset closes the connection so that both ends see it fail
+func (c *Conn) reset() {
+	c.network.mu.Lock()
+	c.isReset = true
+	c.network.mu.Unlock()
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		//discard unsent data and send a RST rather than a FIN
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
+
+func (c *Conn) closedErr() error {
+	c.network.mu.Lock()
+	defer c.network.mu.Unlock()
+	if c.isReset {
+		return ErrReset
+	}
+	return net.ErrClosed
+}
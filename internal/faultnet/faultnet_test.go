@@ -0,0 +1,152 @@
+package faultnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetwork(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, n *Network, addr string){
+		"no faults":                    testNoFaults,
+		"latency delays writes":        testLatency,
+		"drops refuse connections":     testDrop,
+		"resets close connections":     testReset,
+		"partitions stall until heal":  testPartitionHeal,
+		"partitions are asymmetric":    testAsymmetricPartition,
+		"partitions refuse to connect": testPartitionDial,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			n := New(1)
+			addr := setupEcho(t, n)
+			fn(t, n, addr)
+		})
+	}
+}
+
+func testNoFaults(t *testing.T, n *Network, addr string) {
+	c := dial(t, n, addr)
+	requireEcho(t, c, "hello")
+}
+
+func testLatency(t *testing.T, n *Network, addr string) {
+	n.Set("client", "server", Faults{Latency: 100 * time.Millisecond})
+	c := dial(t, n, addr)
+	start := time.Now()
+	requireEcho(t, c, "hello")
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+}
+
+func testDrop(t *testing.T, n *Network, addr string) {
+	n.Set("client", Any, Faults{DropRate: 1})
+	_, err := n.Dialer("client")(context.Background(), addr)
+	require.True(t, errors.Is(err, ErrDropped))
+}
+
+func testReset(t *testing.T, n *Network, addr string) {
+	c := dial(t, n, addr)
+	requireEcho(t, c, "hello")
+	n.Set(Any, Any, Faults{ResetRate: 1})
+	_, err := c.Write([]byte("hello"))
+	require.True(t, errors.Is(err, ErrReset))
+	n.Heal()
+
+	c = dial(t, n, addr)
+	requireEcho(t, c, "hello")
+	n.Reset("client", "server")
+	_, err = c.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, ErrReset))
+}
+
+func testPartitionHeal(t *testing.T, n *Network, addr string) {
+	c := dial(t, n, addr)
+	n.Partition("client", "server")
+	written := make(chan error)
+	go func() {
+		_, err := c.Write([]byte("hello"))
+		written <- err
+	}()
+	select {
+	case <-written:
+		t.Fatal("write crossed the partition")
+	case <-time.After(100 * time.Millisecond):
+	}
+	n.Heal()
+	require.NoError(t, <-written)
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func testAsymmetricPartition(t *testing.T, n *Network, addr string) {
+	c := dial(t, n, addr)
+	//the server's replies stall but the client's writes are delivered
+	n.Partition("server", "client")
+	_, err := c.Write([]byte("hello"))
+	require.NoError(t, err)
+	read := make(chan error)
+	go func() {
+		_, err := io.ReadFull(c, make([]byte, 5))
+		read <- err
+	}()
+	select {
+	case <-read:
+		t.Fatal("reply crossed the partition")
+	case <-time.After(100 * time.Millisecond):
+	}
+	n.Heal()
+	require.NoError(t, <-read)
+}
+
+func testPartitionDial(t *testing.T, n *Network, addr string) {
+	n.Partition("server", "client")
+	_, err := n.Dialer("client")(context.Background(), addr)
+	require.True(t, errors.Is(err, ErrPartitioned))
+}
+
+//setupEcho starts an echo server for the node named server, listening through the network
+func setupEcho(t *testing.T, n *Network) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	n.Register("server", l.Addr().String())
+	ln := n.Listener("server", l)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, n *Network, addr string) net.Conn {
+	t.Helper()
+	c, err := n.Dialer("client")(context.Background(), addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func requireEcho(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	_, err := c.Write([]byte(msg))
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, msg, string(buf))
+}
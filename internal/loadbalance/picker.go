@@ -0,0 +1,90 @@
+package loadbalance
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+//Picker routes produce calls to the leader and balances consume calls round-robin across the followers.
+//It is rebuilt by the base balancer whenever the set of ready sub connections changes, so servers that
+//disappear from the cluster are dropped from the rotation
+type Picker struct {
+	mu        sync.RWMutex
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	current   uint64
+}
+
+var _ base.PickerBuilder = (*Picker)(nil)
+var _ balancer.Picker = (*Picker)(nil)
+
+func init() {
+	balancer.Register(
+		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
+	)
+}
+
+//Build creates a picker from the ready sub connections
+func (p *Picker) Build(info base.PickerBuildInfo) balancer.Picker {
+	var followers []balancer.SubConn
+	var leader balancer.SubConn
+	for sc, scInfo := range info.ReadySCs {
+		isLeader, _ := scInfo.Address.Attributes.Value(isLeaderKey{}).(bool)
+		if isLeader {
+			leader = sc
+			continue
+		}
+		followers = append(followers, sc)
+	}
+	return &Picker{
+		leader:    leader,
+		followers: followers,
+	}
+}
+
+//aclMethods is the prefix of the methods of the acl service
+var aclMethods = "/" + api.ACL_ServiceDesc.ServiceName + "/"
+
+//Pick sends Produce, ProduceStream and the calls that change the acl to the leader. Consume,
+//ConsumeStream and any other call go to the next follower, falling back to the leader when there
+//are no followers
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var result balancer.PickResult
+	if strings.Contains(info.FullMethodName, "Produce") || changesACL(info.FullMethodName) {
+		result.SubConn = p.leader
+	} else {
+		result.SubConn = p.nextFollower()
+		if result.SubConn == nil {
+			result.SubConn = p.leader
+		}
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+//changesACL reports whether method adds or removes acl rules, which is done on the leader
+func changesACL(method string) bool {
+	name := strings.TrimPrefix(method, aclMethods)
+	if name == method {
+		return false
+	}
+	return strings.HasPrefix(name, "Add") || strings.HasPrefix(name, "Remove")
+}
+
+//nextFollower returns the next follower in round-robin order or nil if there are none
+func (p *Picker) nextFollower() balancer.SubConn {
+	if len(p.followers) == 0 {
+		return nil
+	}
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	return p.followers[int(cur%uint64(len(p.followers)))]
+}
@@ -0,0 +1,114 @@
+package loadbalance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := &Picker{}
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		info := balancer.PickInfo{
+			FullMethodName: method,
+		}
+		result, err := picker.Pick(info)
+		assert.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		assert.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerProducesToLeader(t *testing.T) {
+	picker, subConns := setupPickerTest()
+	info := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Produce",
+	}
+	for i := 0; i < 5; i++ {
+		gotPick, err := picker.Pick(info)
+		assert.NoError(t, err)
+		assert.Equal(t, subConns[0], gotPick.SubConn)
+	}
+}
+
+func TestPickerChangesACLOnLeader(t *testing.T) {
+	picker, subConns := setupPickerTest()
+	for method, leader := range map[string]bool{
+		"/log.v1.ACL/AddPolicy":         true,
+		"/log.v1.ACL/RemoveRoleBinding": true,
+		"/log.v1.ACL/ListPolicies":      false,
+	} {
+		pick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		assert.NoError(t, err)
+		assert.Equal(t, leader, pick.SubConn == subConns[0], method)
+	}
+}
+
+func TestPickerConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupPickerTest()
+	info := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Consume",
+	}
+	for i := 0; i < 5; i++ {
+		pick, err := picker.Pick(info)
+		assert.NoError(t, err)
+		assert.Equal(t, subConns[i%2+1], pick.SubConn)
+	}
+}
+
+func TestPickerConsumesFromLeaderWithoutFollowers(t *testing.T) {
+	leader := &subConn{}
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+			leader: {Address: resolver.Address{
+				Attributes: attributes.New(isLeaderKey{}, true),
+			}},
+		},
+	}
+	picker := (&Picker{}).Build(buildInfo)
+	pick, err := picker.Pick(balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/ConsumeStream",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, leader, pick.SubConn)
+}
+
+//setupPickerTest builds a picker with a leader, subConns[0], and two followers
+func setupPickerTest() (balancer.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < 3; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New(isLeaderKey{}, i == 0),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := &Picker{}
+	p := picker.Build(buildInfo).(*Picker)
+	//pin the follower order so the round-robin assertions are deterministic
+	p.followers = []balancer.SubConn{subConns[1], subConns[2]}
+	p.current = 1
+	return p, subConns
+}
+
+//subConn implements balancer.SubConn
+type subConn struct {
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
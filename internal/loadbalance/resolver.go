@@ -0,0 +1,184 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+//Name is the scheme of the resolver and the name of the load balancer.
+//Clients dial targets of the form proglog:///<addr of any server in the cluster>
+const Name = "proglog"
+
+//isLeaderKey is the address attribute that marks the leader of the cluster
+type isLeaderKey struct{}
+
+var defaultRefreshInterval = 10 * time.Second
+
+//Resolver implements resolver.Builder and resolver.Resolver. It discovers the servers in the
+//cluster by calling GetServers on the dialed server and refreshes them every RefreshInterval
+type Resolver struct {
+	//RefreshInterval is how often the servers are refreshed. Defaults to 10s
+	RefreshInterval time.Duration
+	//CallCredentials, when set, are sent with the GetServers calls of the resolver, for servers
+	//that authenticate clients by tokens or api keys. Use it with grpc.WithResolvers
+	CallCredentials credentials.PerRPCCredentials
+
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	dialOpts      []grpc.DialOption
+	serviceConfig *serviceconfig.ParseResult
+	known         []string
+	logger        *zap.Logger
+	//resolveNow asks the refresh goroutine to resolve the servers before the next refresh
+	resolveNow chan struct{}
+	close      chan struct{}
+	wg         sync.WaitGroup
+}
+
+var _ resolver.Builder = (*Resolver)(nil)
+var _ resolver.Resolver = (*Resolver)(nil)
+
+func init() {
+	resolver.Register(&Resolver{})
+}
+
+//Build creates a resolver for the target. Each ClientConn gets its own resolver, so the
+//registered Resolver only serves as a template for its configuration
+func (r *Resolver) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	nr := &Resolver{
+		RefreshInterval: r.RefreshInterval,
+		CallCredentials: r.CallCredentials,
+		clientConn:      cc,
+		logger:          zap.L().Named("resolver"),
+		resolveNow:      make(chan struct{}, 1),
+		close:           make(chan struct{}),
+	}
+	if nr.RefreshInterval == 0 {
+		nr.RefreshInterval = defaultRefreshInterval
+	}
+	if opts.DialCreds != nil {
+		nr.dialOpts = append(nr.dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	} else {
+		nr.dialOpts = append(nr.dialOpts, grpc.WithInsecure())
+	}
+	if nr.CallCredentials != nil {
+		nr.dialOpts = append(nr.dialOpts, grpc.WithPerRPCCredentials(nr.CallCredentials))
+	}
+	nr.serviceConfig = cc.ParseServiceConfig(
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+	)
+	var err error
+	nr.resolverConn, err = grpc.Dial(target.Endpoint, nr.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	nr.resolve()
+	nr.wg.Add(1)
+	go nr.refresh()
+	return nr, nil
+}
+
+//Scheme returns the scheme handled by the resolver
+func (r *Resolver) Scheme() string {
+	return Name
+}
+
+//ResolveNow asks for the servers to be resolved again. It doesn't wait for them, as grpc calls it
+//while connecting and picking
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+		//a resolution is already pending
+	}
+}
+
+//resolve fetches the servers in the cluster and updates the state of the client connection
+func (r *Resolver) resolve() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), r.RefreshInterval)
+	defer cancel()
+	servers, err := r.getServers(ctx)
+	if err != nil {
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+	var addrs []resolver.Address
+	r.known = r.known[:0]
+	for _, server := range servers {
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(isLeaderKey{}, server.IsLeader),
+		})
+		r.known = append(r.known, server.RpcAddr)
+	}
+	r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	})
+}
+
+//getServers asks the dialed server for the cluster's servers. If that server is unavailable,
+//the servers from the last successful resolution are tried in turn
+func (r *Resolver) getServers(ctx context.Context) ([]*api.Server, error) {
+	res, err := api.NewLogClient(r.resolverConn).GetServers(ctx, &api.GetServersRequest{})
+	if err == nil {
+		return res.Servers, nil
+	}
+	for _, addr := range r.known {
+		cc, dialErr := grpc.Dial(addr, r.dialOpts...)
+		if dialErr != nil {
+			continue
+		}
+		res, getErr := api.NewLogClient(cc).GetServers(ctx, &api.GetServersRequest{})
+		cc.Close()
+		if getErr == nil {
+			return res.Servers, nil
+		}
+	}
+	return nil, err
+}
+
+//refresh re-resolves the servers every RefreshInterval, and when ResolveNow asks for it, until the
+//resolver is closed
+func (r *Resolver) refresh() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+		case <-r.resolveNow:
+		}
+		r.resolve()
+	}
+}
+
+//Close stops refreshing and closes the connection used to resolve the servers
+func (r *Resolver) Close() {
+	close(r.close)
+	r.wg.Wait()
+	err := r.resolverConn.Close()
+	if err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+}
@@ -0,0 +1,286 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/config"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/krehermann/proglog/internal/server"
+	"github.com/krehermann/proglog/internal/testconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func TestResolver(t *testing.T) {
+	cluster := setupCluster(t, 2)
+	defer cluster.teardown()
+
+	conn := &clientConn{}
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      cluster.files.RootClientCertFile,
+		KeyFile:       cluster.files.RootClientKeyFile,
+		CAFile:        cluster.files.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+	opts := resolver.BuildOptions{
+		DialCreds: credentials.NewTLS(tlsConfig),
+	}
+	r := &Resolver{}
+	res, err := r.Build(
+		resolver.Target{
+			Scheme:   Name,
+			Endpoint: cluster.addrs[0],
+		},
+		conn,
+		opts,
+	)
+	require.NoError(t, err)
+	defer res.Close()
+
+	wantState := resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:       cluster.addrs[0],
+			Attributes: attributes.New(isLeaderKey{}, true),
+		}, {
+			Addr:       cluster.addrs[1],
+			Attributes: attributes.New(isLeaderKey{}, false),
+		}},
+	}
+	assert.Equal(t, wantState, conn.State())
+
+	//the resolver refreshes the servers when the topology changes
+	cluster.topology.set(cluster.addrs[1:])
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	wantState.Addresses = []resolver.Address{{
+		Addr:       cluster.addrs[1],
+		Attributes: attributes.New(isLeaderKey{}, true),
+	}}
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(wantState, conn.State())
+	}, 5*time.Second, 10*time.Millisecond)
+
+	//asking for a resolution doesn't wait for one in progress
+	res.(*Resolver).mu.Lock()
+	defer res.(*Resolver).mu.Unlock()
+	res.ResolveNow(resolver.ResolveNowOptions{})
+	res.ResolveNow(resolver.ResolveNowOptions{})
+}
+
+func TestClusterBalancing(t *testing.T) {
+	cluster := setupCluster(t, 3)
+	defer cluster.teardown()
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      cluster.files.RootClientCertFile,
+		KeyFile:       cluster.files.RootClientKeyFile,
+		CAFile:        cluster.files.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        false,
+	})
+	require.NoError(t, err)
+	cc, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", Name, cluster.addrs[1]),
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+	ctx := context.Background()
+
+	//produces all go to the leader
+	for i := 0; i < 4; i++ {
+		var res *api.ProduceResponse
+		require.Eventually(t, func() bool {
+			res, err = client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+			})
+			return err == nil
+		}, 3*time.Second, 50*time.Millisecond)
+		assert.Equal(t, uint64(i), res.Offset)
+	}
+	for i, l := range cluster.logs {
+		want := 0
+		if i == 0 {
+			want = 4
+		}
+		assert.Equal(t, want, l.appends(), "server %d", i)
+	}
+
+	//consumes are spread across the followers once they are ready
+	require.Eventually(t, func() bool {
+		client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+		return cluster.logs[1].reads() > 0 && cluster.logs[2].reads() > 0
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, cluster.logs[0].reads())
+
+	//consumes fail over to the remaining servers when a follower disappears
+	cluster.servers[2].Stop()
+	cluster.topology.set(cluster.addrs[:2])
+	before := cluster.logs[1].reads()
+	for i := 0; i < 4; i++ {
+		_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 100}, grpc.WaitForReady(true))
+		assert.Error(t, err)
+	}
+	assert.Greater(t, cluster.logs[1].reads(), before)
+}
+
+type cluster struct {
+	addrs    []string
+	servers  []*grpc.Server
+	logs     []*countingLog
+	topology *topology
+	dirs     []string
+	//files are the certificates the servers and their clients use
+	files *testconfig.Files
+}
+
+//setupCluster starts n grpc servers with their own logs that share a topology. The first server is the leader
+func setupCluster(t *testing.T, n int) *cluster {
+	t.Helper()
+	files := testconfig.New(t)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      files.ServerCertFile,
+		KeyFile:       files.ServerKeyFile,
+		CAFile:        files.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	c := &cluster{topology: &topology{}, files: files}
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		dir, err := ioutil.TempDir("", "loadbalance-test")
+		require.NoError(t, err)
+		clog, err := log.NewLog(dir, log.Config{})
+		require.NoError(t, err)
+		cl := &countingLog{CommitLog: clog}
+		srv, err := server.NewGRPCServer(&server.Config{
+			CommitLog:   cl,
+			Authorizer:  auth.New(files.ACLModelFile, files.ACLPolicyFile),
+			GetServerer: c.topology,
+		}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+		require.NoError(t, err)
+		go srv.Serve(l)
+		c.addrs = append(c.addrs, l.Addr().String())
+		c.servers = append(c.servers, srv)
+		c.logs = append(c.logs, cl)
+		c.dirs = append(c.dirs, dir)
+	}
+	c.topology.set(c.addrs)
+	return c
+}
+
+func (c *cluster) teardown() {
+	for _, srv := range c.servers {
+		srv.Stop()
+	}
+	for _, dir := range c.dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+//topology implements server.GetServerer. The first address is the leader
+type topology struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (t *topology) set(addrs []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.addrs = addrs
+}
+
+func (t *topology) GetServers() ([]*api.Server, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var servers []*api.Server
+	for i, addr := range t.addrs {
+		servers = append(servers, &api.Server{
+			Id:       fmt.Sprintf("%d", i),
+			RpcAddr:  addr,
+			IsLeader: i == 0,
+		})
+	}
+	return servers, nil
+}
+
+//countingLog counts the appends and reads served by a server
+type countingLog struct {
+	server.CommitLog
+	mu               sync.Mutex
+	nAppend, nRead int
+}
+
+func (l *countingLog) Append(r *api.Record) (uint64, error) {
+	l.mu.Lock()
+	l.nAppend++
+	l.mu.Unlock()
+	return l.CommitLog.Append(r)
+}
+
+func (l *countingLog) Read(off uint64) (*api.Record, error) {
+	l.mu.Lock()
+	l.nRead++
+	l.mu.Unlock()
+	return l.CommitLog.Read(off)
+}
+
+func (l *countingLog) appends() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nAppend
+}
+
+func (l *countingLog) reads() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nRead
+}
+
+//clientConn implements resolver.ClientConn to capture the resolved state
+type clientConn struct {
+	resolver.ClientConn
+	mu    sync.Mutex
+	state resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	return nil
+}
+
+func (c *clientConn) State() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *clientConn) NewServiceConfig(config string) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return nil
+}
@@ -0,0 +1,192 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+//An archive holds a range of records independently of how the log that exported them was configured.
+//
+//	magic    8 bytes "proglog\x00"
+//	version  uint16
+//	first    uint64, the offset of the first record
+//	count    uint64, the number of records
+//	records  count times a uint64 length followed by the protobuf encoded api.Record
+//	checksum 32 bytes, the SHA-256 of everything before it
+//
+//Integers are big endian. Records keep their offsets and all of their fields
+const (
+	archiveMagic   = "proglog\x00"
+	ArchiveVersion = uint16(1)
+)
+
+var (
+	//ErrNotArchive is returned when importing data that does not start like an archive
+	ErrNotArchive = errors.New("not a proglog archive")
+	//ErrArchiveChecksum is returned when an archive's checksum does not match its contents
+	ErrArchiveChecksum = errors.New("archive checksum mismatch")
+)
+
+//RecordReader reads the record at an offset. Log is a RecordReader
+type RecordReader interface {
+	Read(uint64) (*api.Record, error)
+}
+
+//ArchiveHeader describes the records in an archive
+type ArchiveHeader struct {
+	Version     uint16
+	FirstOffset uint64
+	Count       uint64
+}
+
+//Export writes the records from offset from up to, not including, offset to as an archive
+func Export(w io.Writer, r RecordReader, from, to uint64) error {
+	if to < from {
+		return fmt.Errorf("cannot export offsets %d to %d", from, to)
+	}
+	h := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	header := ArchiveHeader{Version: ArchiveVersion, FirstOffset: from, Count: to - from}
+	_, err := bw.WriteString(archiveMagic)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(bw, enc, header)
+	if err != nil {
+		return err
+	}
+	for off := from; off < to; off++ {
+		record, err := r.Read(off)
+		if err != nil {
+			return err
+		}
+		b, err := proto.Marshal(record)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(bw, enc, uint64(len(b)))
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(h.Sum(nil))
+	return err
+}
+
+//Import reads an archive into the log in dir, creating it with cfg if dir holds no log. The
+//initial offset of cfg is replaced by the archive's first offset, and an existing log must
+//continue at that offset. If the archive is invalid, the records read from it are removed
+//again and the error is returned
+func Import(r io.Reader, dir string, cfg Config) (*ArchiveHeader, error) {
+	//the checksum covers the bytes consumed before the trailer
+	br := bufio.NewReader(r)
+	h := sha256.New()
+	tr := io.TeeReader(br, h)
+	header, err := ReadArchiveHeader(tr)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Segment.InitialOffset = header.FirstOffset
+	l, err := NewLog(dir, cfg)
+	if err != nil {
+		return nil, err
+	}
+	next, err := l.NextOffset()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if next != header.FirstOffset {
+		l.Close()
+		return nil, fmt.Errorf("archive starts at offset %d but the log in %s continues at %d",
+			header.FirstOffset, dir, next)
+	}
+	err = importRecords(tr, l, header)
+	if err == nil {
+		sum := h.Sum(nil)
+		trailer := make([]byte, sha256.Size)
+		_, err = io.ReadFull(br, trailer)
+		if err == nil && !bytes.Equal(sum, trailer) {
+			err = ErrArchiveChecksum
+		}
+	}
+	closeErr := l.Close()
+	if err != nil {
+		truncErr := TruncateFrom(dir, header.FirstOffset)
+		if truncErr != nil {
+			return nil, fmt.Errorf("%v, and failed to remove the imported records: %w", err, truncErr)
+		}
+		return nil, err
+	}
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	return header, nil
+}
+
+//ReadArchiveHeader reads the header at the start of an archive
+func ReadArchiveHeader(r io.Reader) (*ArchiveHeader, error) {
+	magic := make([]byte, len(archiveMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil || string(magic) != archiveMagic {
+		return nil, ErrNotArchive
+	}
+	header := &ArchiveHeader{}
+	err = binary.Read(r, enc, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive header: %w", err)
+	}
+	if header.Version != ArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d, expected %d", header.Version, ArchiveVersion)
+	}
+	return header, nil
+}
+
+func importRecords(r io.Reader, l *Log, header *ArchiveHeader) error {
+	for i := uint64(0); i < header.Count; i++ {
+		want := header.FirstOffset + i
+		var n uint64
+		err := binary.Read(r, enc, &n)
+		if err != nil {
+			return fmt.Errorf("failed to read record %d: %w", want, err)
+		}
+		//the length is not trusted to allocate the record
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(n)))
+		if err != nil {
+			return fmt.Errorf("failed to read record %d: %w", want, err)
+		}
+		if uint64(len(b)) != n {
+			return fmt.Errorf("failed to read record %d: %w", want, io.ErrUnexpectedEOF)
+		}
+		record := &api.Record{}
+		err = proto.Unmarshal(b, record)
+		if err != nil {
+			return fmt.Errorf("failed to decode record %d: %w", want, err)
+		}
+		if record.Offset != want {
+			return fmt.Errorf("archive has record %d where record %d was expected", record.Offset, want)
+		}
+		_, err = l.Append(record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
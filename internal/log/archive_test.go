@@ -0,0 +1,128 @@
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchive(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, src *Log, dst string){
+		"round trip under a different config": testArchiveRoundTrip,
+		"import continues an existing log":    testArchiveContinue,
+		"import rejects a gap":                testArchiveGap,
+		"import rejects a corrupted archive":  testArchiveCorrupted,
+		"import rejects a truncated archive":  testArchiveTruncated,
+		"import rejects other data":           testArchiveNotArchive,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			srcDir, err := ioutil.TempDir("", "archive-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(srcDir)
+			dst, err := ioutil.TempDir("", "archive-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dst)
+			src, err := NewLog(srcDir, inspectConfig())
+			require.NoError(t, err)
+			defer src.Close()
+			for i := 0; i < 10; i++ {
+				_, err := src.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+			fn(t, src, dst)
+		})
+	}
+}
+
+func export(t *testing.T, src *Log, from, to uint64) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	require.NoError(t, Export(buf, src, from, to))
+	return buf.Bytes()
+}
+
+func requireRecords(t *testing.T, dir string, cfg Config, from, to uint64) {
+	t.Helper()
+	l, err := NewLog(dir, cfg)
+	require.NoError(t, err)
+	defer l.Close()
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, from, lowest)
+	for off := from; off < to; off++ {
+		r, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(r.Value))
+		require.Equal(t, off, r.Offset)
+	}
+	next, err := l.NextOffset()
+	require.NoError(t, err)
+	require.Equal(t, to, next)
+}
+
+func testArchiveRoundTrip(t *testing.T, src *Log, dst string) {
+	archive := export(t, src, 2, 8)
+	header, err := ReadArchiveHeader(bytes.NewReader(archive))
+	require.NoError(t, err)
+	require.Equal(t, &ArchiveHeader{Version: ArchiveVersion, FirstOffset: 2, Count: 6}, header)
+
+	//the imported log has larger segments than the exported one
+	cfg := Config{}
+	cfg.Segment.MaxIndexBytes = 4 * entWidth
+	header, err = Import(bytes.NewReader(archive), dst, cfg)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), header.Count)
+	requireRecords(t, dst, cfg, 2, 8)
+	infos, err := Inspect(dst)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+}
+
+func testArchiveContinue(t *testing.T, src *Log, dst string) {
+	_, err := Import(bytes.NewReader(export(t, src, 0, 4)), dst, Config{})
+	require.NoError(t, err)
+	_, err = Import(bytes.NewReader(export(t, src, 4, 10)), dst, Config{})
+	require.NoError(t, err)
+	requireRecords(t, dst, Config{}, 0, 10)
+}
+
+func testArchiveGap(t *testing.T, src *Log, dst string) {
+	_, err := Import(bytes.NewReader(export(t, src, 0, 4)), dst, Config{})
+	require.NoError(t, err)
+	_, err = Import(bytes.NewReader(export(t, src, 5, 10)), dst, Config{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "continues at 4")
+	requireRecords(t, dst, Config{}, 0, 4)
+}
+
+func testArchiveCorrupted(t *testing.T, src *Log, dst string) {
+	_, err := Import(bytes.NewReader(export(t, src, 0, 2)), dst, Config{})
+	require.NoError(t, err)
+	archive := export(t, src, 2, 10)
+	//flip a bit in the value of the last record, which is followed by its offset
+	archive[len(archive)-sha256.Size-3] ^= 1
+	_, err = Import(bytes.NewReader(archive), dst, Config{})
+	require.Equal(t, ErrArchiveChecksum, err)
+	//the records imported from the corrupted archive are removed
+	requireRecords(t, dst, Config{}, 0, 2)
+}
+
+func testArchiveTruncated(t *testing.T, src *Log, dst string) {
+	archive := export(t, src, 0, 10)
+	for _, n := range []int{len(archive) - 1, len(archive) - 40} {
+		_, err := Import(bytes.NewReader(archive[:n]), dst, Config{})
+		require.Error(t, err)
+		requireRecords(t, dst, Config{}, 0, 0)
+	}
+}
+
+func testArchiveNotArchive(t *testing.T, src *Log, dst string) {
+	_, err := Import(bytes.NewReader([]byte("definitely not an archive")), dst, Config{})
+	require.Equal(t, ErrNotArchive, err)
+}
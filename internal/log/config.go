@@ -1,9 +1,51 @@
 package log
 
+import (
+	"fmt"
+	"strings"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	Retention struct {
+		//MaxBytes bounds the size of the stores of the log. When a new segment is created, the oldest
+		//segments are removed until the log fits. Zero keeps every segment
+		MaxBytes uint64
+	}
+	//DisableMetrics stops the log recording metrics. Internal logs such as the acl and audit logs
+	//set it so that the metrics describe the log of the server
+	DisableMetrics bool
+}
+
+//Validate checks that the configuration describes a usable log. Zero sizes are valid and replaced
+//with defaults by NewLog
+func (c Config) Validate() error {
+	var errs []string
+	if c.Segment.MaxIndexBytes != 0 && c.Segment.MaxIndexBytes < entWidth {
+		errs = append(errs, fmt.Sprintf(
+			"segment max index bytes %d is smaller than one index entry (%d bytes)",
+			c.Segment.MaxIndexBytes, entWidth))
+	}
+	if c.Segment.MaxStoreBytes != 0 && c.Segment.MaxStoreBytes <= lenWidth {
+		errs = append(errs, fmt.Sprintf(
+			"segment max store bytes %d cannot hold a record (records need more than %d bytes)",
+			c.Segment.MaxStoreBytes, lenWidth))
+	}
+	maxStoreBytes := c.Segment.MaxStoreBytes
+	if maxStoreBytes == 0 {
+		maxStoreBytes = defaultSize
+	}
+	if c.Retention.MaxBytes != 0 && c.Retention.MaxBytes < maxStoreBytes {
+		errs = append(errs, fmt.Sprintf(
+			"retention max bytes %d is smaller than one segment (%d bytes)",
+			c.Retention.MaxBytes, maxStoreBytes))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid log config: %s", strings.Join(errs, "; "))
+	}
+	return nil
 }
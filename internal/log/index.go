@@ -41,12 +41,17 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	return idx, nil
 }
 
-func (i *index) Close() error {
+//Sync commits the memory mapped entries to the file and the file to stable storage
+func (i *index) Sync() error {
 	err := i.mmap.Sync(gommap.MS_SYNC)
 	if err != nil {
 		return err
 	}
-	err = i.file.Sync()
+	return i.file.Sync()
+}
+
+func (i *index) Close() error {
+	err := i.Sync()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,433 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+//The functions in this file work on the files of a log directory without opening a Log, which
+//resizes index files and expects them to be consistent. They are meant for offline use and must
+//not be used on the directory of a running log
+
+//SegmentInfo describes the files of a segment and the records they hold
+type SegmentInfo struct {
+	BaseOffset uint64
+	//NextOffset is the offset after the last record that is both in the store and the index
+	NextOffset uint64
+	//StoreFile and IndexFile are empty if the file is missing
+	StoreFile  string
+	IndexFile  string
+	StoreBytes int64
+	IndexBytes int64
+	//Problems describe inconsistencies within the segment and with its neighbours.
+	//A healthy segment has none
+	Problems []string
+}
+
+//segmentFiles are the files of a segment, named by its base offset
+type segmentFiles struct {
+	base  uint64
+	store string
+	index string
+}
+
+//frame is a complete record in a store
+type frame struct {
+	pos  uint64
+	size uint64
+}
+
+//segmentScan is the result of reading the files of a segment
+type segmentScan struct {
+	info *SegmentInfo
+	//frames are the records of the store up to the first incomplete or invalid frame
+	frames []frame
+	//indexed is the number of index entries that point to frames
+	indexed int
+}
+
+//Inspect reads the segments of the log in dir and reports their sizes, offsets and problems
+func Inspect(dir string) ([]*SegmentInfo, error) {
+	scans, err := scanDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*SegmentInfo, len(scans))
+	for i, s := range scans {
+		infos[i] = s.info
+	}
+	return infos, nil
+}
+
+//ReadRecord reads the record at off from the log in dir
+func ReadRecord(dir string, off uint64) (*api.Record, error) {
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	//the segment holding off is the last one whose base offset is not after it
+	i := sort.Search(len(files), func(i int) bool { return files[i].base > off }) - 1
+	if i < 0 || files[i].store == "" || files[i].index == "" {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	idx, err := os.Open(files[i].index)
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+	entry := make([]byte, entWidth)
+	_, err = idx.ReadAt(entry, int64((off-files[i].base)*entWidth))
+	if errors.Is(err, io.EOF) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	if err != nil {
+		return nil, err
+	}
+	str, err := os.Open(files[i].store)
+	if err != nil {
+		return nil, err
+	}
+	defer str.Close()
+	fi, err := str.Stat()
+	if err != nil {
+		return nil, err
+	}
+	//an index that was not closed cleanly ends with the zeroed entries preallocated for records that
+	//were never written. Only the first record of a segment has a zeroed entry, at the start of the store
+	if isZero(entry) && (off > files[i].base || fi.Size() == 0) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	pos := enc.Uint64(entry[offWidth:])
+	size := make([]byte, lenWidth)
+	_, err = str.ReadAt(size, int64(pos))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record %d at position %d of %s: %w", off, pos, files[i].store, err)
+	}
+	//a damaged length would otherwise allocate a buffer of any size
+	n := enc.Uint64(size)
+	if n > uint64(fi.Size())-pos-lenWidth {
+		return nil, fmt.Errorf("record %d at position %d of %s is corrupt: its length of %d bytes is past the end of the store",
+			off, pos, files[i].store, n)
+	}
+	buf := make([]byte, n)
+	_, err = str.ReadAt(buf, int64(pos+lenWidth))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record %d at position %d of %s: %w", off, pos, files[i].store, err)
+	}
+	r := &api.Record{}
+	err = proto.Unmarshal(buf, r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Offset != off {
+		return nil, fmt.Errorf("index entry for %d points to record %d", off, r.Offset)
+	}
+	return r, nil
+}
+
+//Repair makes each segment of the log in dir consistent. Partial and invalid records at the end
+//of a store are cut off, indexes are rebuilt from their stores and index files without a store
+//are removed. It returns the segments after the repair. Problems that remain, such as offsets
+//missing between segments, need TruncateFrom
+func Repair(dir string) ([]*SegmentInfo, error) {
+	scans, err := scanDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range scans {
+		if len(s.info.Problems) == 0 {
+			continue
+		}
+		err = s.repair(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return Inspect(dir)
+}
+
+//TruncateFrom removes the records of the log in dir from off on, so that off is the next offset
+//appended. The segments before off must be consistent, see Repair
+func TruncateFrom(dir string, off uint64) error {
+	scans, err := scanDir(dir)
+	if err != nil {
+		return err
+	}
+	kept := 0
+	for i, s := range scans {
+		base := s.info.BaseOffset
+		if base >= off {
+			err = s.remove()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		kept++
+		if i+1 < len(scans) && scans[i+1].info.BaseOffset < off {
+			//the whole segment is before off
+			continue
+		}
+		if uint64(len(s.frames)) < off-base {
+			return fmt.Errorf("segment %d holds %d records, cannot truncate it at %d", base, len(s.frames), off)
+		}
+		s.frames = s.frames[:off-base]
+		err = s.repair(dir)
+		if err != nil {
+			return err
+		}
+	}
+	if kept == 0 {
+		//keep an empty segment so the log continues at off
+		return (&segmentScan{info: &SegmentInfo{BaseOffset: off}}).repair(dir)
+	}
+	return nil
+}
+
+//listSegmentFiles finds the store and index files in dir, sorted by base offset
+func listSegmentFiles(dir string) ([]*segmentFiles, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byBase := make(map[uint64]*segmentFiles)
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != storeExt && ext != indexExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ext), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected segment file %s: %w", e.Name(), err)
+		}
+		f, ok := byBase[base]
+		if !ok {
+			f = &segmentFiles{base: base}
+			byBase[base] = f
+		}
+		if ext == storeExt {
+			f.store = filepath.Join(dir, e.Name())
+		} else {
+			f.index = filepath.Join(dir, e.Name())
+		}
+	}
+	files := make([]*segmentFiles, 0, len(byBase))
+	for _, f := range byBase {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].base < files[j].base })
+	return files, nil
+}
+
+//scanDir scans every segment in dir and checks that their offsets follow each other
+func scanDir(dir string) ([]*segmentScan, error) {
+	files, err := listSegmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	scans := make([]*segmentScan, len(files))
+	for i, f := range files {
+		scans[i], err = scanSegment(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := 1; i < len(scans); i++ {
+		prev, cur := scans[i-1].info, scans[i].info
+		if prev.NextOffset != cur.BaseOffset {
+			cur.Problems = append(cur.Problems, fmt.Sprintf(
+				"previous segment ends at offset %d but this segment starts at %d",
+				prev.NextOffset, cur.BaseOffset))
+		}
+	}
+	return scans, nil
+}
+
+//scanSegment reads the store and index of a segment and checks that they agree
+func scanSegment(f *segmentFiles) (*segmentScan, error) {
+	s := &segmentScan{
+		info: &SegmentInfo{
+			BaseOffset: f.base,
+			NextOffset: f.base,
+			StoreFile:  f.store,
+			IndexFile:  f.index,
+		},
+	}
+	if f.store == "" {
+		s.problem("store file is missing")
+	} else {
+		err := s.scanStore()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.index == "" {
+		s.problem("index file is missing")
+		return s, nil
+	}
+	err := s.scanIndex()
+	if err != nil {
+		return nil, err
+	}
+	s.info.NextOffset = f.base + uint64(s.indexed)
+	return s, nil
+}
+
+//scanStore reads the frames of the store until the end of the file or the first frame that
+//is incomplete or does not hold the record with the expected offset
+func (s *segmentScan) scanStore() error {
+	f, err := os.Open(s.info.StoreFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	s.info.StoreBytes = fi.Size()
+	r := bufio.NewReader(f)
+	size := uint64(fi.Size())
+	pos := uint64(0)
+	for pos < size {
+		if size-pos < lenWidth {
+			s.problem("store ends with %d bytes of a partial record length at position %d", size-pos, pos)
+			return nil
+		}
+		prefix := make([]byte, lenWidth)
+		_, err = io.ReadFull(r, prefix)
+		if err != nil {
+			return err
+		}
+		n := enc.Uint64(prefix)
+		if n > size-pos-lenWidth {
+			s.problem("store ends with a partial record of %d bytes at position %d, %d bytes are missing",
+				size-pos, pos, n-(size-pos-lenWidth))
+			return nil
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return err
+		}
+		record := &api.Record{}
+		err = proto.Unmarshal(buf, record)
+		if err != nil {
+			s.problem("store has an invalid record at position %d: %v", pos, err)
+			return nil
+		}
+		want := s.info.BaseOffset + uint64(len(s.frames))
+		if record.Offset != want {
+			s.problem("store has record %d at position %d, expected record %d", record.Offset, pos, want)
+			return nil
+		}
+		s.frames = append(s.frames, frame{pos: pos, size: lenWidth + n})
+		pos += lenWidth + n
+	}
+	return nil
+}
+
+//scanIndex counts the index entries that point to the frames of the store
+func (s *segmentScan) scanIndex() error {
+	b, err := ioutil.ReadFile(s.info.IndexFile)
+	if err != nil {
+		return err
+	}
+	s.info.IndexBytes = int64(len(b))
+	entries := uint64(len(b)) / entWidth
+	i := uint64(0)
+	for ; i < entries && i < uint64(len(s.frames)); i++ {
+		entry := b[i*entWidth : (i+1)*entWidth]
+		off, pos := enc.Uint32(entry[:offWidth]), enc.Uint64(entry[offWidth:])
+		if uint64(off) != i || pos != s.frames[i].pos {
+			s.problem("index entry %d points to record %d at position %d, the store has it at position %d",
+				i, off, pos, s.frames[i].pos)
+			break
+		}
+	}
+	s.indexed = int(i)
+	switch {
+	case i < entries && i < uint64(len(s.frames)):
+		//the mismatched entry was reported above
+	case i < entries && isZero(b[i*entWidth:]):
+		s.problem("index has %d bytes of empty entries, the log was not closed cleanly", uint64(len(b))-i*entWidth)
+	case i < entries:
+		s.problem("index has %d entries for records that are not in the store", entries-i)
+	case i < uint64(len(s.frames)):
+		s.problem("%d records of the store are missing from the index", uint64(len(s.frames))-i)
+	}
+	if extra := uint64(len(b)) % entWidth; extra != 0 && !isZero(b[len(b)-int(extra):]) {
+		s.problem("index ends with %d bytes of a partial entry", extra)
+	}
+	return nil
+}
+
+func (s *segmentScan) problem(format string, args ...interface{}) {
+	s.info.Problems = append(s.info.Problems, fmt.Sprintf(format, args...))
+}
+
+//repair cuts the store after the scanned frames and rewrites the index to point to them
+func (s *segmentScan) repair(dir string) error {
+	if s.info.StoreFile == "" && s.info.IndexFile != "" {
+		return s.remove()
+	}
+	storeFile := filepath.Join(dir, fmt.Sprintf("%d%s", s.info.BaseOffset, storeExt))
+	indexFile := filepath.Join(dir, fmt.Sprintf("%d%s", s.info.BaseOffset, indexExt))
+	end := uint64(0)
+	index := make([]byte, 0, len(s.frames)*int(entWidth))
+	for i, f := range s.frames {
+		entry := make([]byte, entWidth)
+		enc.PutUint32(entry[:offWidth], uint32(i))
+		enc.PutUint64(entry[offWidth:], f.pos)
+		index = append(index, entry...)
+		end = f.pos + f.size
+	}
+	f, err := os.OpenFile(storeFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(int64(end))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(indexFile, index, 0644)
+}
+
+//remove deletes the files of the segment
+func (s *segmentScan) remove() error {
+	for _, name := range []string{s.info.StoreFile, s.info.IndexFile} {
+		if name == "" {
+			continue
+		}
+		err := os.Remove(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
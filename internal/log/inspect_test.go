@@ -0,0 +1,228 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"healthy log":                testInspectHealthy,
+		"unclean shutdown":           testInspectUncleanShutdown,
+		"partial record in store":    testInspectPartialRecord,
+		"records missing from index": testInspectMissingIndexEntries,
+		"missing files":              testInspectMissingFiles,
+		"corrupt record length":      testReadCorruptRecordLength,
+		"truncate from":              testTruncateFrom,
+		"truncate everything":        testTruncateEverything,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "inspect-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			fn(t, dir)
+		})
+	}
+}
+
+//inspectConfig puts three records in each segment
+func inspectConfig() Config {
+	cfg := Config{}
+	cfg.Segment.MaxIndexBytes = 3 * entWidth
+	return cfg
+}
+
+//writeLog appends n records to a new log in dir and closes it
+func writeLog(t *testing.T, dir string, n int) {
+	t.Helper()
+	l, err := NewLog(dir, inspectConfig())
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+}
+
+//requireLog opens the log in dir and checks that it holds n records and appends after them
+func requireLog(t *testing.T, dir string, n int) {
+	t.Helper()
+	l, err := NewLog(dir, inspectConfig())
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < n; i++ {
+		r, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(r.Value))
+	}
+	off, err := l.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(n), off)
+}
+
+func requireHealthy(t *testing.T, infos []*SegmentInfo) {
+	t.Helper()
+	for _, info := range infos {
+		require.Empty(t, info.Problems, "segment %d", info.BaseOffset)
+	}
+}
+
+func segmentFile(dir string, base uint64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", base, ext))
+}
+
+func testInspectHealthy(t *testing.T, dir string) {
+	writeLog(t, dir, 7)
+	index, err := os.Stat(segmentFile(dir, 6, indexExt))
+	require.NoError(t, err)
+
+	infos, err := Inspect(dir)
+	require.NoError(t, err)
+	requireHealthy(t, infos)
+	require.Len(t, infos, 3)
+	for i, info := range infos {
+		require.Equal(t, uint64(3*i), info.BaseOffset)
+		require.NotZero(t, info.StoreBytes)
+	}
+	require.Equal(t, uint64(3), infos[0].NextOffset)
+	require.Equal(t, uint64(7), infos[2].NextOffset)
+	require.Equal(t, int64(entWidth), infos[2].IndexBytes)
+
+	r, err := ReadRecord(dir, 4)
+	require.NoError(t, err)
+	require.Equal(t, "record 4", string(r.Value))
+	_, err = ReadRecord(dir, 7)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 7}, err)
+
+	//inspecting leaves the files as they were
+	after, err := os.Stat(segmentFile(dir, 6, indexExt))
+	require.NoError(t, err)
+	require.Equal(t, index.Size(), after.Size())
+	requireLog(t, dir, 7)
+}
+
+func testInspectUncleanShutdown(t *testing.T, dir string) {
+	writeLog(t, dir, 4)
+	//a log that is not closed leaves its index at its maximum size
+	require.NoError(t, os.Truncate(segmentFile(dir, 3, indexExt), int64(3*entWidth)))
+
+	infos, err := Inspect(dir)
+	require.NoError(t, err)
+	require.Len(t, infos[1].Problems, 1)
+	require.Contains(t, infos[1].Problems[0], "not closed cleanly")
+	require.Equal(t, uint64(4), infos[1].NextOffset)
+	//the empty entries are past the end of the index
+	r, err := ReadRecord(dir, 3)
+	require.NoError(t, err)
+	require.Equal(t, "record 3", string(r.Value))
+	_, err = ReadRecord(dir, 4)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 4}, err)
+
+	infos, err = Repair(dir)
+	require.NoError(t, err)
+	requireHealthy(t, infos)
+	requireLog(t, dir, 4)
+}
+
+func testInspectPartialRecord(t *testing.T, dir string) {
+	writeLog(t, dir, 5)
+	f, err := os.OpenFile(segmentFile(dir, 3, storeExt), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	frame := make([]byte, lenWidth+4)
+	enc.PutUint64(frame, 100)
+	_, err = f.Write(frame)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	infos, err := Inspect(dir)
+	require.NoError(t, err)
+	require.Len(t, infos[1].Problems, 1)
+	require.Contains(t, infos[1].Problems[0], "partial record")
+
+	infos, err = Repair(dir)
+	require.NoError(t, err)
+	requireHealthy(t, infos)
+	requireLog(t, dir, 5)
+}
+
+func testInspectMissingIndexEntries(t *testing.T, dir string) {
+	writeLog(t, dir, 5)
+	require.NoError(t, os.Truncate(segmentFile(dir, 3, indexExt), int64(entWidth)))
+
+	infos, err := Inspect(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1 records of the store are missing from the index"}, infos[1].Problems)
+	require.Equal(t, uint64(4), infos[1].NextOffset)
+
+	infos, err = Repair(dir)
+	require.NoError(t, err)
+	requireHealthy(t, infos)
+	require.Equal(t, uint64(5), infos[1].NextOffset)
+	requireLog(t, dir, 5)
+}
+
+func testReadCorruptRecordLength(t *testing.T, dir string) {
+	writeLog(t, dir, 5)
+	//record 3 is the first of its segment
+	f, err := os.OpenFile(segmentFile(dir, 3, storeExt), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	length := make([]byte, lenWidth)
+	enc.PutUint64(length, 1<<62)
+	_, err = f.WriteAt(length, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = ReadRecord(dir, 3)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "record 3 at position 0")
+	require.Contains(t, err.Error(), "is corrupt")
+	r, err := ReadRecord(dir, 2)
+	require.NoError(t, err)
+	require.Equal(t, "record 2", string(r.Value))
+}
+
+func testInspectMissingFiles(t *testing.T, dir string) {
+	writeLog(t, dir, 7)
+	require.NoError(t, os.Remove(segmentFile(dir, 3, indexExt)))
+	require.NoError(t, os.Remove(segmentFile(dir, 6, storeExt)))
+
+	infos, err := Inspect(dir)
+	require.NoError(t, err)
+	require.Contains(t, infos[1].Problems, "index file is missing")
+	require.Contains(t, infos[2].Problems, "store file is missing")
+
+	//the index is rebuilt and the index without a store is removed
+	infos, err = Repair(dir)
+	require.NoError(t, err)
+	requireHealthy(t, infos)
+	require.Len(t, infos, 2)
+	requireLog(t, dir, 6)
+}
+
+func testTruncateFrom(t *testing.T, dir string) {
+	writeLog(t, dir, 7)
+	require.NoError(t, TruncateFrom(dir, 4))
+	infos, err := Inspect(dir)
+	require.NoError(t, err)
+	requireHealthy(t, infos)
+	require.Len(t, infos, 2)
+	requireLog(t, dir, 4)
+
+	require.Error(t, TruncateFrom(dir, 10), "offsets after the log cannot be truncated")
+}
+
+func testTruncateEverything(t *testing.T, dir string) {
+	writeLog(t, dir, 4)
+	require.NoError(t, TruncateFrom(dir, 0))
+	infos, err := Inspect(dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, uint64(0), infos[0].NextOffset)
+	requireLog(t, dir, 0)
+}
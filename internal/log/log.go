@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/krehermann/proglog/api/v1"
 )
@@ -26,12 +27,11 @@ type Log struct {
 var defaultSize = uint64(1024)
 
 func NewLog(dir string, cfg Config) (*Log, error) {
-	if cfg.Segment.MaxIndexBytes == 0 {
-		cfg.Segment.MaxIndexBytes = defaultSize
-	}
-	if cfg.Segment.MaxStoreBytes == 0 {
-		cfg.Segment.MaxStoreBytes = defaultSize
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
 	}
+	setDefaults(&cfg)
 
 	l := &Log{
 		Dir:      dir,
@@ -39,13 +39,22 @@ func NewLog(dir string, cfg Config) (*Log, error) {
 		segments: make([]*segment, 0),
 	}
 
-	err := l.initialize()
+	err = l.initialize()
 	if err != nil {
 		return nil, err
 	}
 	return l, nil
 }
 
+func setDefaults(cfg *Config) {
+	if cfg.Segment.MaxIndexBytes == 0 {
+		cfg.Segment.MaxIndexBytes = defaultSize
+	}
+	if cfg.Segment.MaxStoreBytes == 0 {
+		cfg.Segment.MaxStoreBytes = defaultSize
+	}
+}
+
 //initialize finds all the segments in the configured directory and sets activeSegment
 //to that specified in the configuration. If no segments exist, one is created in Dir
 //using the configured InitialOffset
@@ -101,6 +110,14 @@ func (l *Log) initialize() error {
 			return err
 		}
 	}
+	//the last segment is full if the log was repaired or its configuration changed
+	if l.activeSegment.IsFull() {
+		err = l.newSegment(l.activeSegment.nextOffset)
+		if err != nil {
+			return err
+		}
+	}
+	l.recordState()
 	return nil
 
 }
@@ -119,19 +136,73 @@ func (l *Log) newSegment(off uint64) error {
 //Append appends a record to the log and returns the offset in the current segment
 //After appending, if the active segment is full a new segment is created for future appends
 func (l *Log) Append(r *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	size := l.activeSegment.str.Size()
 	off, err := l.activeSegment.Append(r)
 	if err != nil {
 		return 0, err
 	}
+	l.recordAppend(l.activeSegment.str.Size() - size)
 	if l.activeSegment.IsFull() {
 		err = l.newSegment(off + 1)
 		if err != nil {
 			return 0, err
 		}
+		err = l.enforceRetention()
+		if err != nil {
+			return 0, err
+		}
 	}
+	l.recordState()
 	return off, err
 }
 
+//Reconfigure changes the settings that are safe to change while the log is open: segment sizes,
+//which apply to segments created from now on, and retention. The initial offset and whether metrics
+//are disabled are ignored
+func (l *Log) Reconfigure(cfg Config) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	setDefaults(&cfg)
+	cfg.Segment.InitialOffset = l.Cfg.Segment.InitialOffset
+	cfg.DisableMetrics = l.Cfg.DisableMetrics
+	l.Cfg = cfg
+	err = l.enforceRetention()
+	if err != nil {
+		return err
+	}
+	l.recordState()
+	return nil
+}
+
+//enforceRetention removes the oldest segments until the stores fit in the configured retention.
+//The active segment is never removed. The caller must hold l.mu
+func (l *Log) enforceRetention() error {
+	max := l.Cfg.Retention.MaxBytes
+	if max == 0 {
+		return nil
+	}
+	size := uint64(0)
+	for _, s := range l.segments {
+		size += uint64(s.str.Size())
+	}
+	for len(l.segments) > 1 && size > max {
+		oldest := l.segments[0]
+		size -= uint64(oldest.str.Size())
+		err := oldest.Remove()
+		if err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
 //Reads reads the record stored at the given offset.
 //Finds the appropriate segment from which to read and return an error if out of bounds
 func (l *Log) Read(off uint64) (*api.Record, error) {
@@ -212,24 +283,88 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return next - 1, nil
 }
 
-//Truncate removes all segments whose highest offset is lower than lowest
+//NextOffset returns the offset of the next record appended to the log.
+//Unlike HighestOffset, it distinguishes an empty log from a log with one record
+func (l *Log) NextOffset() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segments[len(l.segments)-1].nextOffset, nil
+}
+
+//Check reads the active segment, so that it fails when the log can't be read
+func (l *Log) Check() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.segments[len(l.segments)-1].Check()
+}
+
+//Truncate removes all segments whose highest offset is lower than lowest.
+//The active segment is never removed
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	//segments are sorted, so count how many are removed and break
-	deleteIdx := 0
-	for i, s := range l.segments {
-		if s.nextOffset-1 <= lowest {
-			err := s.Remove()
-			if err != nil {
-				return err
-			}
-			deleteIdx = i
-		} else {
+	removed := 0
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if s.nextOffset > lowest {
 			break
 		}
+		err := s.Remove()
+		if err != nil {
+			return err
+		}
+		removed++
+	}
+	l.segments = l.segments[removed:]
+	l.recordState()
+	return nil
+}
+
+//Segments describes the segments of the log, oldest first
+func (l *Log) Segments() []SegmentInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	infos := make([]SegmentInfo, len(l.segments))
+	for i, s := range l.segments {
+		infos[i] = SegmentInfo{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreFile:  s.str.Name(),
+			IndexFile:  s.idx.Name(),
+			StoreBytes: s.str.Size(),
+			IndexBytes: int64(s.idx.size),
+		}
+	}
+	return infos
+}
+
+//Roll closes the active segment to appends and starts a new one, returning its base offset.
+//An empty active segment is kept
+func (l *Log) Roll() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.activeSegment.nextOffset == l.activeSegment.baseOffset {
+		return l.activeSegment.baseOffset, nil
+	}
+	err := l.newSegment(l.activeSegment.nextOffset)
+	if err != nil {
+		return 0, err
+	}
+	l.recordState()
+	return l.activeSegment.baseOffset, nil
+}
+
+//Sync flushes buffered writes and commits the segments to stable storage
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.recordSync(time.Now())
+	for _, s := range l.segments {
+		err := s.Sync()
+		if err != nil {
+			return err
+		}
 	}
-	l.segments = l.segments[deleteIdx+1:]
 	return nil
 }
 
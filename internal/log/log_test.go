@@ -20,6 +20,12 @@ func TestLog(t *testing.T) {
 		"init with existing segments": testInitExisting,
 		"reader":                      testReader,
 		"truncate":                    testTruncate,
+		"next offset":                 testNextOffset,
+		"retention":                   testRetention,
+		"reconfigure":                 testReconfigure,
+		"roll, sync and segments":     testRollSyncSegments,
+		"truncate keeps active":       testTruncateKeepsActive,
+		"check":                       testCheck,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "log-test")
@@ -143,3 +149,181 @@ func testTruncate(t *testing.T, log *Log) {
 	assert.NoError(t, err)
 	assert.Equal(t, got.Value, want.Value)
 }
+
+func testNextOffset(t *testing.T, log *Log) {
+	off, err := log.NextOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), off)
+
+	_, err = log.Append(&api.Record{
+		Value: []byte("These are the times that try men's souls"),
+	})
+	assert.NoError(t, err)
+	off, err = log.NextOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), off)
+}
+
+func testCheck(t *testing.T, log *Log) {
+	assert.NoError(t, log.Check())
+	_, err := log.Append(&api.Record{
+		Value: []byte("Tyranny, like hell, is not easily conquered"),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, log.Check())
+	//the log can't be read once its files are closed
+	assert.NoError(t, log.Close())
+	assert.Error(t, log.Check())
+}
+
+func testRetention(t *testing.T, log *Log) {
+	want := &api.Record{
+		Value: []byte("We have it in our power to begin the world over again"),
+	}
+	//each segment holds one record and the log keeps two segments' worth of records.
+	//stored records carry their offset, which takes up to 2 more bytes
+	cfg := Config{}
+	cfg.Segment.MaxIndexBytes = entWidth
+	cfg.Retention.MaxBytes = 2 * (lenWidth + uint64(proto.Size(want)) + 2)
+	cfg.Segment.MaxStoreBytes = cfg.Retention.MaxBytes / 2
+	assert.NoError(t, log.Close())
+	log, err := NewLog(log.Dir, cfg)
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(want)
+		assert.NoError(t, err)
+	}
+	assert.LessOrEqual(t, uint64(log.Size()), cfg.Retention.MaxBytes)
+	_, err = log.Read(2)
+	assert.Error(t, err)
+	got, err := log.Read(4)
+	assert.NoError(t, err)
+	assert.Equal(t, want.Value, got.Value)
+	off, err := log.LowestOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), off)
+}
+
+func TestConfigValidate(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		cfg     func(*Config)
+		wantErr string
+	}{
+		"zero values use defaults": {
+			cfg: func(c *Config) {},
+		},
+		"index smaller than an entry": {
+			cfg:     func(c *Config) { c.Segment.MaxIndexBytes = entWidth - 1 },
+			wantErr: "smaller than one index entry",
+		},
+		"store smaller than a record": {
+			cfg:     func(c *Config) { c.Segment.MaxStoreBytes = lenWidth },
+			wantErr: "cannot hold a record",
+		},
+		"retention smaller than a segment": {
+			cfg: func(c *Config) {
+				c.Segment.MaxStoreBytes = 1024
+				c.Retention.MaxBytes = 512
+			},
+			wantErr: "smaller than one segment",
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			cfg := Config{}
+			tc.cfg(&cfg)
+			err := cfg.Validate()
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tc.wantErr)
+			dir, err := ioutil.TempDir("", "log-test")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+			_, err = NewLog(dir, cfg)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func testReconfigure(t *testing.T, log *Log) {
+	want := &api.Record{
+		Value: []byte("Time makes more converts than reason"),
+	}
+	_, err := log.Append(want)
+	assert.NoError(t, err)
+
+	cfg := Config{}
+	cfg.Segment.MaxIndexBytes = entWidth - 1
+	assert.Error(t, log.Reconfigure(cfg))
+
+	//the active segment keeps its size, new segments hold one record each
+	cfg.Segment.MaxIndexBytes = entWidth
+	assert.NoError(t, log.Reconfigure(cfg))
+	assert.Equal(t, entWidth, log.Cfg.Segment.MaxIndexBytes)
+	assert.Equal(t, defaultSize, log.Cfg.Segment.MaxStoreBytes)
+	n := len(log.segments)
+	for i := 0; len(log.segments) == n; i++ {
+		if !assert.Less(t, i, 1024, "the active segment never filled") {
+			return
+		}
+		_, err = log.Append(want)
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		n = len(log.segments)
+		_, err = log.Append(want)
+		assert.NoError(t, err)
+		assert.Equal(t, n+1, len(log.segments))
+	}
+}
+
+func testRollSyncSegments(t *testing.T, log *Log) {
+	want := &api.Record{
+		Value: []byte("The cause of America is in a great measure the cause of all mankind"),
+	}
+	base, err := log.Roll()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), base, "an empty segment is not rolled")
+
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(want)
+		assert.NoError(t, err)
+	}
+	base, err = log.Roll()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), base)
+	off, err := log.Append(want)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), off)
+
+	segments := log.Segments()
+	assert.Equal(t, 2, len(segments))
+	assert.Equal(t, uint64(0), segments[0].BaseOffset)
+	assert.Equal(t, uint64(2), segments[0].NextOffset)
+	assert.Equal(t, int64(2*entWidth), segments[0].IndexBytes)
+	assert.Equal(t, uint64(3), segments[1].NextOffset)
+
+	//synced records are in the files without closing the log
+	assert.NoError(t, log.Sync())
+	fi, err := os.Stat(segments[1].StoreFile)
+	assert.NoError(t, err)
+	assert.Equal(t, segments[1].StoreBytes, fi.Size())
+	assert.NotZero(t, fi.Size())
+}
+
+func testTruncateKeepsActive(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("Common Sense")})
+	assert.NoError(t, err)
+	_, err = log.Roll()
+	assert.NoError(t, err)
+	assert.NoError(t, log.Truncate(10))
+	assert.Equal(t, 1, len(log.segments))
+	off, err := log.Append(&api.Record{Value: []byte("Common Sense")})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), off)
+	_, err = log.Read(0)
+	assert.Error(t, err)
+}
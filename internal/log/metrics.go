@@ -0,0 +1,74 @@
+package log
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+//Measures recorded by the log and the replicator. They are only aggregated once Views are registered
+var (
+	mAppends        = stats.Int64("proglog/log/appends", "Records appended to the log", stats.UnitDimensionless)
+	mAppendBytes    = stats.Int64("proglog/log/append_bytes", "Bytes appended to the log's stores", stats.UnitBytes)
+	mSegments       = stats.Int64("proglog/log/segments", "Segments in the log", stats.UnitDimensionless)
+	mLowestOffset   = stats.Int64("proglog/log/lowest_offset", "Offset of the oldest record in the log", stats.UnitDimensionless)
+	mNextOffset     = stats.Int64("proglog/log/next_offset", "Offset the log gives its next record", stats.UnitDimensionless)
+	mSyncLatency    = stats.Float64("proglog/log/sync_latency", "Time to flush and fsync the log", stats.UnitMilliseconds)
+	mReplicationLag = stats.Int64("proglog/replication/lag", "Records the local log is behind the replicated peer", stats.UnitDimensionless)
+	mReconnects     = stats.Int64("proglog/replication/reconnects", "Times replication reconnected to a peer after a failure", stats.UnitDimensionless)
+
+	//peerKey tags replication measures with the name of the replicated peer
+	peerKey = tag.MustNewKey("peer")
+)
+
+//Views aggregate the measures of the log and of replication
+var Views = []*view.View{
+	{Measure: mAppends, Aggregation: view.Count()},
+	{Measure: mAppendBytes, Aggregation: view.Sum()},
+	{Measure: mSegments, Aggregation: view.LastValue()},
+	{Measure: mLowestOffset, Aggregation: view.LastValue()},
+	{Measure: mNextOffset, Aggregation: view.LastValue()},
+	{Measure: mSyncLatency, Aggregation: view.Distribution(0.1, 0.5, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000)},
+	{Measure: mReplicationLag, Aggregation: view.LastValue(), TagKeys: []tag.Key{peerKey}},
+	{Measure: mReconnects, Aggregation: view.Count(), TagKeys: []tag.Key{peerKey}},
+}
+
+//recordState records the segments and offsets of the log. The caller must hold l.mu
+func (l *Log) recordState() {
+	if l.Cfg.DisableMetrics {
+		return
+	}
+	stats.Record(context.Background(),
+		mSegments.M(int64(len(l.segments))),
+		mLowestOffset.M(int64(l.segments[0].baseOffset)),
+		mNextOffset.M(int64(l.activeSegment.nextOffset)),
+	)
+}
+
+//recordSync records how long a sync that started at start took
+func (l *Log) recordSync(start time.Time) {
+	if l.Cfg.DisableMetrics {
+		return
+	}
+	stats.Record(context.Background(), mSyncLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+}
+
+//recordAppend records an append of size bytes. The caller must hold l.mu
+func (l *Log) recordAppend(size int64) {
+	if l.Cfg.DisableMetrics {
+		return
+	}
+	stats.Record(context.Background(), mAppends.M(1), mAppendBytes.M(size))
+}
+
+//recordPeer records measurements tagged with the name of a replicated peer
+func recordPeer(peer string, ms ...stats.Measurement) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(peerKey, peer))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, ms...)
+}
@@ -3,27 +3,89 @@ package log
 import (
 	"context"
 	"sync"
+	"time"
 
 	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/discovery"
+	"github.com/krehermann/proglog/internal/tracing"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 //Replicator implements Handler interface and acts a membership handler when a
-//server joins and leaves the cluster. Upon joining the cluster, it runs a loop that consumes
-//from discovered peers and produces to the local server.
+//server joins and leaves the cluster. It consumes from the leader of the cluster and produces to the
+//local server. The leader is the server with the lowest name that has not failed and whose log does
+//not end before the local log, see elect. Servers lists the servers with that leader, so that clients
+//produce to the server the cluster replicates from.
 type Replicator struct {
 	DialOpts    []grpc.DialOption
 	LocalServer api.LogClient
-	logger      *zap.Logger
-	mu          sync.Mutex
-	// servers is a map to track peers that we are replicating
-	servers map[string]chan struct{}
-	closed  bool
-	close   chan struct{}
+	//LocalName is the name of the local server in the cluster and must be set. The local server
+	//does not replicate when it is the leader
+	LocalName string
+	//Log is the name of the internal log to replicate. The main log is replicated when it is empty.
+	//Replication metrics are recorded for the main log only
+	Log string
+	//LocalLog is the log LocalServer writes to and must be set. Replication continues from its next
+	//offset whenever the leader changes, and it is compared with the logs of the peers to elect
+	//the leader
+	LocalLog *Log
+	logger   *zap.Logger
+	mu       sync.Mutex
+	// servers is a map to track the peers in the cluster
+	servers map[string]*peer
+	// leader is the name of the peer being replicated, LocalName when the local server is the
+	// leader, or empty while no server can lead
+	leader string
+	// offset is the next offset to replicate from the leader
+	offset uint64
+	// leaderOffset is the last next offset the leader reported, valid when leaderOffsetKnown is set
+	leaderOffset      uint64
+	leaderOffsetKnown bool
+	// stop is closed to stop the running replication loop, and done is closed once it has stopped
+	stop chan struct{}
+	done chan struct{}
+	// probe is signalled to probe the peers without waiting for probeInterval
+	probe  chan struct{}
+	closed bool
+	close  chan struct{}
 }
 
-//Join Adds name,addr to list of servers to replicate, if not present, and starts go routine to replicate the data
+var _ discovery.EventHandler = (*Replicator)(nil)
+
+//peer is a server in the cluster
+type peer struct {
+	addr   string
+	failed bool
+	//probed is set once the peer's log has been compared with the local log since it joined or
+	//recovered, or the leader failed. ahead is set when the peer has records past the end of the
+	//local log, and behind when its log ends before the local log's
+	probed bool
+	ahead  bool
+	behind bool
+}
+
+var replicateRetryInterval = 250 * time.Millisecond
+
+//probeInterval is how often the peers are probed while the leader is not settled, and probeTimeout
+//bounds each probe
+var (
+	probeInterval = 250 * time.Millisecond
+	probeTimeout  = time.Second
+)
+
+//LogMetadataKey is the request metadata key that names the internal log a request is for
+const LogMetadataKey = "proglog-log"
+
+//ReplicaMetadataKey is the request metadata key that marks the consumes of a replicator, and holds the
+//name of the replicating server. The leader authorizes them with the replicate action
+const ReplicaMetadataKey = "proglog-replica"
+
+//Join Adds name,addr to list of servers, if not present, and replicates from it if it is the leader
 func (r *Replicator) Join(name, addr string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -33,20 +95,117 @@ func (r *Replicator) Join(name, addr string) error {
 	}
 	_, ok := r.servers[name]
 	if ok {
-		//already replicating
+		//already known
 		return nil
 	}
-	r.servers[name] = make(chan struct{})
-
-	go r.replicate(addr, r.servers[name])
+	r.servers[name] = &peer{addr: addr}
+	r.elect(false)
+	r.probeNow()
+	return nil
+}
 
+//HandleEvent pauses replication from a failed leader, replicating from the next leader instead, and
+//resumes it when the server recovers. A leader whose address changes is replicated from the new address
+func (r *Replicator) HandleEvent(e discovery.Event) error {
+	switch e.Type {
+	case discovery.MemberJoined:
+		return r.Join(e.Name, e.Addr)
+	case discovery.MemberLeft:
+		return r.Leave(e.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	p, ok := r.servers[e.Name]
+	if !ok || r.closed {
+		return nil
+	}
+	switch e.Type {
+	case discovery.MemberFailed:
+		p.failed = true
+		if e.Name == r.leader {
+			r.unprobe()
+		}
+	case discovery.MemberRecovered:
+		p.failed = false
+		p.probed = false
+	case discovery.MemberUpdated:
+		p.addr = e.Addr
+		p.probed = false
+	}
+	r.elect(e.Type == discovery.MemberUpdated && e.Name == r.leader)
+	r.probeNow()
 	return nil
 }
 
-//replicate connects to addr and consumes a stream of records.
+//elect replicates from the leader, switching from the previous leader if it has changed or
+//restart is set. The leader is the server with the lowest name that has not failed and whose log
+//does not end before the local log. The local server is a candidate once it has probed every peer
+//and none is ahead of it. So a server that comes back with a shorter log, such as a restarted
+//leader, catches up before it leads again and the records the cluster has are not written over.
+//The caller must hold r.mu
+func (r *Replicator) elect(restart bool) {
+	leader := ""
+	candidate := true
+	for name, p := range r.servers {
+		if p.failed {
+			continue
+		}
+		if !p.probed || p.ahead {
+			candidate = false
+		}
+		if !p.probed || p.behind {
+			continue
+		}
+		if leader == "" || name < leader {
+			leader = name
+		}
+	}
+	if candidate && (leader == "" || r.LocalName < leader) {
+		leader = r.LocalName
+	}
+	if leader == r.leader && !restart {
+		return
+	}
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	r.leader = leader
+	r.leaderOffsetKnown = false
+	if leader == "" || leader == r.LocalName {
+		return
+	}
+	prevDone := r.done
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.replicate(leader, r.servers[leader].addr, r.stop, r.done, prevDone)
+}
+
+//replicate replicates from the peer name at addr until stop is closed, retrying after failures.
+//It waits for the previous replication loop to finish so that records are replicated once
+func (r *Replicator) replicate(name, addr string, stop, done, prevDone chan struct{}) {
+	defer close(done)
+	if prevDone != nil {
+		<-prevDone
+	}
+	for {
+		r.replicateFrom(addr, stop)
+		select {
+		case <-r.close:
+			return
+		case <-stop:
+			return
+		case <-time.After(replicateRetryInterval):
+			r.recordPeer(name, mReconnects.M(1))
+		}
+	}
+}
+
+//replicateFrom connects to addr and consumes a stream of records, starting at the end of the local log.
 //It writes each of the records to the local server of the Replicator
-func (r *Replicator) replicate(addr string, leaveCh chan struct{}) {
-	cc, err := grpc.Dial(addr, r.DialOpts)
+func (r *Replicator) replicateFrom(addr string, stop chan struct{}) {
+	cc, err := grpc.Dial(addr, r.DialOpts...)
 	if err != nil {
 		r.logError(err, "failed to dial", addr)
 		return
@@ -54,25 +213,53 @@ func (r *Replicator) replicate(addr string, leaveCh chan struct{}) {
 	defer cc.Close()
 
 	client := api.NewLogClient(cc)
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(r.outgoing(context.Background()))
+	defer cancel()
+	//the local log may have been written to while another server led
+	offset, err := r.LocalLog.NextOffset()
+	if err != nil {
+		r.logError(err, "failed to read the local log", addr)
+		return
+	}
+	r.mu.Lock()
+	r.offset = offset
+	r.mu.Unlock()
+	//the stream is quiet while there is nothing to replicate, so ask the leader how far its log goes
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: offset})
+	switch {
+	case err == nil:
+		r.setLeaderOffset(stop, res.NextOffset)
+	case status.Code(err) == api.ErrOffsetOutOfRange{}.GRPCStatus().Code():
+		r.setLeaderOffset(stop, offset)
+	default:
+		r.logError(err, "failed to consume", addr)
+		return
+	}
 	stream, err := client.ConsumeStream(
 		ctx,
 		&api.ConsumeRequest{
-			Offset: 0,
+			Offset: offset,
 		})
 	if err != nil {
 		r.logError(err, "failed to consume stream", addr)
 		return
 	}
-	records := make(chan *api.Record)
+	records := make(chan *api.ConsumeResponse)
 	go func() {
 		for {
 			recv, err := stream.Recv()
 			if err != nil {
-				r.logError(err, "failed to recv", addr)
+				if ctx.Err() == nil {
+					r.logError(err, "failed to recv", addr)
+				}
+				close(records)
+				return
+			}
+			select {
+			case records <- recv:
+			case <-ctx.Done():
 				return
 			}
-			records <- recv.Record
 		}
 	}()
 
@@ -80,23 +267,290 @@ func (r *Replicator) replicate(addr string, leaveCh chan struct{}) {
 		select {
 		case <-r.close:
 			return
-		case <-leaveCh:
+		case <-stop:
 			return
-		case record := <-records:
-			_, err := r.LocalServer.Produce(ctx,
-				&api.ProduceRequest{
-					Record: record,
-				})
+		case recv, ok := <-records:
+			if !ok {
+				return
+			}
+			err := r.produce(ctx, addr, recv.Record)
 			if err != nil {
 				r.logError(err, "failed to produce", addr)
 				return
 			}
+			r.mu.Lock()
+			r.offset = recv.Record.Offset + 1
+			r.mu.Unlock()
+			//also records the lag now that the offset has moved
+			r.setLeaderOffset(stop, recv.NextOffset)
+		}
+	}
+}
+
+//outgoing adds the metadata of a replicator's requests to ctx
+func (r *Replicator) outgoing(ctx context.Context) context.Context {
+	ctx = metadata.AppendToOutgoingContext(ctx, ReplicaMetadataKey, r.LocalName)
+	if r.Log != "" {
+		//both consuming from the leader and producing locally are for the internal log
+		ctx = metadata.AppendToOutgoingContext(ctx, LogMetadataKey, r.Log)
+	}
+	return ctx
+}
+
+//probeNow probes the peers without waiting for probeInterval. The caller must hold r.mu
+func (r *Replicator) probeNow() {
+	select {
+	case r.probe <- struct{}{}:
+	default:
+	}
+}
+
+//unprobe has the peers probed again before they can lead. The caller must hold r.mu
+func (r *Replicator) unprobe() {
+	for _, p := range r.servers {
+		p.probed = false
+	}
+}
+
+//settled reports whether probing the peers can't change the leader. The caller must hold r.mu
+func (r *Replicator) settled() bool {
+	if r.leader == "" || (r.leader != r.LocalName && r.LocalName < r.leader) {
+		//no server can lead yet, or the local server leads once it catches up
+		return false
+	}
+	for name, p := range r.servers {
+		if p.failed {
+			continue
+		}
+		if !p.probed || (p.behind && name < r.leader) {
+			return false
 		}
 	}
+	return true
+}
+
+//probePeers compares the logs of the peers with the local log and elects the leader again, until
+//the Replicator is closed. It only probes while the leader is not settled
+func (r *Replicator) probePeers() {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-r.probe:
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		if r.settled() {
+			r.mu.Unlock()
+			continue
+		}
+		addrs := make(map[string]string)
+		for name, p := range r.servers {
+			if !p.failed {
+				addrs[name] = p.addr
+			}
+		}
+		r.mu.Unlock()
+		next, err := r.LocalLog.NextOffset()
+		if err != nil {
+			r.logger.Error("failed to read the local log", zap.Error(err))
+			continue
+		}
+		type result struct {
+			ahead, behind bool
+			err           error
+		}
+		results := make(map[string]result)
+		for name, addr := range addrs {
+			ahead, behind, err := r.probePeer(addr, next)
+			if err != nil {
+				r.logError(err, "failed to probe", addr)
+			}
+			results[name] = result{ahead, behind, err}
+		}
+		r.mu.Lock()
+		for name, res := range results {
+			p, ok := r.servers[name]
+			if !ok || p.failed || p.addr != addrs[name] {
+				continue
+			}
+			p.probed = true
+			//a peer that can't be reached isn't waited for, it is replicated from if it leads
+			p.ahead = res.ahead
+			if res.err == nil {
+				p.behind = res.behind
+			}
+		}
+		if !r.closed {
+			r.elect(false)
+		}
+		r.mu.Unlock()
+	}
+}
+
+//probePeer reports whether the log of the peer at addr has records past next, the next offset of
+//the local log, or ends before it
+func (r *Replicator) probePeer(addr string, next uint64) (ahead, behind bool, err error) {
+	cc, err := grpc.Dial(addr, r.DialOpts...)
+	if err != nil {
+		return false, false, err
+	}
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+	ctx, cancel := context.WithTimeout(r.outgoing(context.Background()), probeTimeout)
+	defer cancel()
+	outOfRange := api.ErrOffsetOutOfRange{}.GRPCStatus().Code()
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: next})
+	if err == nil {
+		return true, false, nil
+	}
+	if status.Code(err) != outOfRange {
+		return false, false, err
+	}
+	if next == 0 {
+		return false, false, nil
+	}
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: next - 1})
+	if err == nil {
+		return false, false, nil
+	}
+	if status.Code(err) != outOfRange {
+		return false, false, err
+	}
+	return false, true, nil
+}
+
+//produce writes a record replicated from addr to the local server. A record produced in a trace
+//is replicated in a span of that trace, so the trace continues into the local server's Produce
+func (r *Replicator) produce(ctx context.Context, addr string, record *api.Record) error {
+	sc, ok := tracing.Extract(record)
+	if !ok {
+		_, err := r.LocalServer.Produce(ctx, &api.ProduceRequest{Record: record})
+		return err
+	}
+	ctx, span := trace.StartSpanWithRemoteParent(ctx, "log.Replicator.replicate", sc)
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("peer", addr),
+		trace.Int64Attribute("offset", int64(record.Offset)),
+	)
+	_, err := r.LocalServer.Produce(ctx, &api.ProduceRequest{Record: record})
+	if err != nil {
+		span.SetStatus(trace.Status{Code: int32(status.Code(err)), Message: err.Error()})
+	}
+	return err
+}
+
+//setLeaderOffset records the next offset reported by the leader replicated until stop is closed
+func (r *Replicator) setLeaderOffset(stop chan struct{}, offset uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-stop:
+		//the leader has changed
+		return
+	default:
+	}
+	if !r.leaderOffsetKnown || offset > r.leaderOffset {
+		r.leaderOffset = offset
+	}
+	r.leaderOffsetKnown = true
+	lag, _ := r.lag()
+	r.recordPeer(r.leader, mReplicationLag.M(int64(lag)))
+}
+
+//Leading reports whether the local server is the leader, which is the case until it learns of a
+//server it replicates from
+func (r *Replicator) Leading() bool {
+	return r.Leader() == r.LocalName
+}
+
+//Leads reports whether the local server leads a cluster of the named peers: it has learned of
+//each of them, compared its log with the log of those that have not failed, and leads
+func (r *Replicator) Leads(peers []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	for _, name := range peers {
+		p, ok := r.servers[name]
+		if !ok || (!p.failed && !p.probed) {
+			return false
+		}
+	}
+	return r.leader == r.LocalName
+}
+
+//Leader returns the name of the server the local server replicates from, LocalName when the local
+//server leads, or the empty string while no server can lead
+func (r *Replicator) Leader() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	return r.leader
+}
+
+//ServerLister lists the servers of the cluster, like discovery.Membership
+type ServerLister interface {
+	GetServers() ([]*api.Server, error)
+}
+
+//Servers returns the servers of servers with the leader of the Replicator reported as the leader
+func (r *Replicator) Servers(servers ServerLister) ServerLister {
+	return &leaderServers{ServerLister: servers, replicator: r}
+}
+
+type leaderServers struct {
+	ServerLister
+	replicator *Replicator
+}
+
+func (s *leaderServers) GetServers() ([]*api.Server, error) {
+	servers, err := s.ServerLister.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	leader := s.replicator.Leader()
+	for _, server := range servers {
+		server.IsLeader = server.Id == leader
+	}
+	return servers, nil
+}
+
+//recordPeer records replication metrics of the main log
+func (r *Replicator) recordPeer(peer string, ms ...stats.Measurement) {
+	if r.Log != "" {
+		return
+	}
+	recordPeer(peer, ms...)
+}
+
+//Lag returns how many records the local server is behind the leader, or false if that is not known
+//yet because the leader has not been reached. The lag is zero when the local server is the leader
+func (r *Replicator) Lag() (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init()
+	return r.lag()
+}
+
+//lag implements Lag. The caller must hold r.mu
+func (r *Replicator) lag() (uint64, bool) {
+	if r.leader == r.LocalName {
+		return 0, true
+	}
+	if r.leader == "" || !r.leaderOffsetKnown {
+		return 0, false
+	}
+	if r.leaderOffset <= r.offset {
+		return 0, true
+	}
+	return r.leaderOffset - r.offset, true
 }
 
 //Leave handles the server with the given name leaving the cluster.
-//It closes the replication channel and deletes the name from the map of servers.
+//It deletes the name from the map of servers and replicates from the next leader if it was the leader.
 func (r *Replicator) Leave(name string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -105,8 +559,14 @@ func (r *Replicator) Leave(name string) error {
 	if !ok {
 		return nil
 	}
-	close(r.servers[name])
 	delete(r.servers, name)
+	if name == r.leader {
+		r.unprobe()
+	}
+	if !r.closed {
+		r.elect(false)
+		r.probeNow()
+	}
 	return nil
 }
 
@@ -114,12 +574,16 @@ func (r *Replicator) init() {
 	if r.logger == nil {
 		r.logger = zap.L().Named("replicator")
 	}
-	if r.servers == nil {
-		r.servers = make(map[string]chan struct{})
-	}
 	if r.close == nil {
 		r.close = make(chan struct{})
 	}
+	if r.servers == nil {
+		//alone, the local server leads
+		r.servers = make(map[string]*peer)
+		r.leader = r.LocalName
+		r.probe = make(chan struct{}, 1)
+		go r.probePeers()
+	}
 }
 
 func (r *Replicator) logError(err error, msg, addr string) {
@@ -131,15 +595,20 @@ func (r *Replicator) logError(err error, msg, addr string) {
 }
 
 //Close closes the replicator so it doesn't replicate new servers that join
-// and stops replicating existing servers
+// and stops replicating existing servers. It waits for the record being replicated to be produced
 func (r *Replicator) Close() error {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 	r.init()
 	if r.closed {
+		r.mu.Unlock()
 		return nil
 	}
 	r.closed = true
 	close(r.close)
+	done := r.done
+	r.mu.Unlock()
+	if done != nil {
+		<-done
+	}
 	return nil
 }
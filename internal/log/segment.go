@@ -105,6 +105,24 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return r, err
 }
 
+//Check fails when the files of the segment can't be read: it stats both files and reads the last
+//record, if any
+func (s *segment) Check() error {
+	_, err := s.idx.file.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = s.str.File.Stat()
+	if err != nil {
+		return err
+	}
+	if s.nextOffset == s.baseOffset {
+		return nil
+	}
+	_, err = s.Read(s.nextOffset - 1)
+	return err
+}
+
 //IsFull returns true if either the index or store are equal/greater than their respective configured values
 func (s *segment) IsFull() bool {
 	return s.str.size >= s.cfg.Segment.MaxStoreBytes || s.idx.size >= s.cfg.Segment.MaxIndexBytes
@@ -123,6 +141,14 @@ func (s *segment) Remove() error {
 
 }
 
+func (s *segment) Sync() error {
+	err := s.idx.Sync()
+	if err != nil {
+		return err
+	}
+	return s.str.Sync()
+}
+
 func (s *segment) Close() error {
 	err := s.idx.Close()
 	if err != nil {
@@ -0,0 +1,137 @@
+//Package metrics serves the registered OpenCensus views in the Prometheus text exposition format.
+//
+//View names are converted to metric names by replacing the characters Prometheus does not allow
+//with underscores, so the view proglog/log/appends becomes proglog_log_appends. Count and sum
+//views are counters and get a _total suffix, last value views are gauges and distribution views
+//are histograms
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+)
+
+//ContentType is the content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//Handler serves the metrics of every view registered with the view package, and of any other
+//OpenCensus metric producer, each time it is scraped
+type Handler struct{}
+
+//NewHandler returns a handler for the metrics endpoint
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var metrics []*metricdata.Metric
+	for _, producer := range metricproducer.GlobalManager().GetAll() {
+		metrics = append(metrics, producer.Read()...)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Descriptor.Name < metrics[j].Descriptor.Name
+	})
+	w.Header().Set("Content-Type", ContentType)
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		writeMetric(bw, m)
+	}
+	bw.Flush()
+}
+
+//writeMetric writes the latest point of each of the time series of m
+func writeMetric(w *bufio.Writer, m *metricdata.Metric) {
+	name := sanitize(m.Descriptor.Name)
+	var typ string
+	switch m.Descriptor.Type {
+	case metricdata.TypeCumulativeInt64, metricdata.TypeCumulativeFloat64:
+		name += "_total"
+		typ = "counter"
+	case metricdata.TypeGaugeInt64, metricdata.TypeGaugeFloat64:
+		typ = "gauge"
+	case metricdata.TypeCumulativeDistribution, metricdata.TypeGaugeDistribution:
+		typ = "histogram"
+	default:
+		//summaries are not produced by views
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", name, helpEscaper.Replace(m.Descriptor.Description))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	for _, ts := range m.TimeSeries {
+		if len(ts.Points) == 0 {
+			continue
+		}
+		labels := make([]string, 0, len(ts.LabelValues))
+		for i, v := range ts.LabelValues {
+			if !v.Present || i >= len(m.Descriptor.LabelKeys) {
+				continue
+			}
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, sanitize(m.Descriptor.LabelKeys[i].Key), labelEscaper.Replace(v.Value)))
+		}
+		switch v := ts.Points[len(ts.Points)-1].Value.(type) {
+		case int64:
+			writeSample(w, name, labels, float64(v))
+		case float64:
+			writeSample(w, name, labels, v)
+		case *metricdata.Distribution:
+			count := int64(0)
+			for i, bound := range v.BucketOptions.Bounds {
+				if i < len(v.Buckets) {
+					count += v.Buckets[i].Count
+				}
+				writeSample(w, name+"_bucket", append(labels, fmt.Sprintf("le=%q", formatFloat(bound))), float64(count))
+			}
+			writeSample(w, name+"_bucket", append(labels, `le="+Inf"`), float64(v.Count))
+			writeSample(w, name+"_sum", labels, v.Sum)
+			writeSample(w, name+"_count", labels, float64(v.Count))
+		}
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+//sanitize replaces the characters that are not allowed in metric and label names, and prefixes
+//names that start with a digit
+func sanitize(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		ok := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+//helpEscaper escapes help texts and labelEscaper escapes label values
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestHandler(t *testing.T) {
+	requests := stats.Int64("test/requests", "Requests\nhandled", stats.UnitDimensionless)
+	depth := stats.Int64("test/queue-depth", "Queue depth", stats.UnitDimensionless)
+	latency := stats.Float64("test/latency", "Latency", stats.UnitMilliseconds)
+	pathKey := tag.MustNewKey("path")
+	views := []*view.View{
+		{Measure: requests, Aggregation: view.Count(), TagKeys: []tag.Key{pathKey}},
+		{Measure: depth, Aggregation: view.LastValue()},
+		{Measure: latency, Aggregation: view.Distribution(1, 10)},
+	}
+	require.NoError(t, view.Register(views...))
+	defer view.Unregister(views...)
+
+	ctx, err := tag.New(context.Background(), tag.Upsert(pathKey, `/a"b`))
+	require.NoError(t, err)
+	stats.Record(ctx, requests.M(1))
+	stats.Record(ctx, requests.M(1))
+	stats.Record(context.Background(), depth.M(3), latency.M(0.5), latency.M(5), latency.M(50))
+
+	want := []string{
+		`# HELP test_requests_total Requests\nhandled`,
+		`# TYPE test_requests_total counter`,
+		`test_requests_total{path="/a\"b"} 2`,
+		`# TYPE test_queue_depth gauge`,
+		`test_queue_depth 3`,
+		`# TYPE test_latency histogram`,
+		`test_latency_bucket{le="1"} 1`,
+		`test_latency_bucket{le="10"} 2`,
+		`test_latency_bucket{le="+Inf"} 3`,
+		`test_latency_sum 55.5`,
+		`test_latency_count 3`,
+	}
+	require.Eventually(t, func() bool {
+		rec := httptest.NewRecorder()
+		NewHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if rec.Header().Get("Content-Type") != ContentType {
+			return false
+		}
+		lines := strings.Split(rec.Body.String(), "\n")
+		for _, w := range want {
+			if !contains(lines, w) {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSanitize(t *testing.T) {
+	require.Equal(t, "grpc_io_server_server_latency", sanitize("grpc.io/server/server_latency"))
+	require.Equal(t, "_9lives", sanitize("9lives"))
+}
+
+func contains(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
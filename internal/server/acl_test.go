@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestACL(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		rootACL api.ACLClient,
+		nobodyACL api.ACLClient,
+		nobodyClient api.LogClient,
+	){
+		"role bindings grant access":     testACLRoleBindings,
+		"policies grant access":          testACLPolicies,
+		"unauthorized fails":             testACLUnauthorized,
+		"invalid changes are not logged": testACLInvalid,
+		"the acl log is not produced to": testACLLogNotProduced,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+				cfg.ACL = cfg.Authorizer.(*auth.Authorizer)
+				cfg.Logs = map[string]CommitLog{"acl": aclLog(t, cfg.ACL.(*auth.Authorizer))}
+			})
+			defer teardown()
+			fn(t, api.NewACLClient(rootConn), api.NewACLClient(nobodyConn), api.NewLogClient(nobodyConn))
+		})
+	}
+}
+
+//aclLog creates the change log of a
+func aclLog(t *testing.T, a *auth.Authorizer) *log.Log {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "acl-test")
+	require.NoError(t, err)
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Remove() })
+	require.NoError(t, a.UseChangeLog(l))
+	return l
+}
+
+func testACLRoleBindings(t *testing.T, acl, _ api.ACLClient, nobody api.LogClient) {
+	ctx := context.Background()
+	produce := &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}}
+	_, err := nobody.Produce(ctx, produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	binding := &api.RoleBinding{Subject: "nobody", Role: "writer"}
+	_, err = acl.AddRoleBinding(ctx, &api.AddRoleBindingRequest{RoleBinding: binding})
+	require.NoError(t, err)
+	_, err = nobody.Produce(ctx, produce)
+	require.NoError(t, err)
+	bindings, err := acl.ListRoleBindings(ctx, &api.ListRoleBindingsRequest{})
+	require.NoError(t, err)
+	var found bool
+	for _, b := range bindings.RoleBindings {
+		found = found || proto.Equal(b, binding)
+	}
+	require.True(t, found)
+
+	_, err = acl.RemoveRoleBinding(ctx, &api.RemoveRoleBindingRequest{RoleBinding: binding})
+	require.NoError(t, err)
+	_, err = nobody.Produce(ctx, produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testACLPolicies(t *testing.T, acl, _ api.ACLClient, nobody api.LogClient) {
+	ctx := context.Background()
+	policy := &api.Policy{Subject: "nobody", Object: "log/*", Action: "*"}
+	_, err := acl.AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	policies, err := acl.ListPolicies(ctx, &api.ListPoliciesRequest{})
+	require.NoError(t, err)
+	var found bool
+	for _, p := range policies.Policies {
+		found = found || proto.Equal(p, policy)
+	}
+	require.True(t, found)
+	res, err := nobody.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}})
+	require.NoError(t, err)
+	_, err = nobody.Consume(ctx, &api.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+
+	//the changes are records of the acl log, which nobody may not read
+	aclCtx := metadata.AppendToOutgoingContext(ctx, log.LogMetadataKey, "acl")
+	_, err = nobody.Consume(aclCtx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	unknownCtx := metadata.AppendToOutgoingContext(ctx, log.LogMetadataKey, "unknown")
+	_, err = nobody.Consume(unknownCtx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = acl.RemovePolicy(ctx, &api.RemovePolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	_, err = nobody.Consume(ctx, &api.ConsumeRequest{Offset: res.Offset})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testACLLogNotProduced(t *testing.T, acl, _ api.ACLClient, nobody api.LogClient) {
+	ctx := context.Background()
+	//not even by subjects the policy allows, as only the leader may change the acl
+	policy := &api.Policy{Subject: "nobody", Object: "acl/records", Action: "produce"}
+	_, err := acl.AddPolicy(ctx, &api.AddPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	aclCtx := metadata.AppendToOutgoingContext(ctx, log.LogMetadataKey, "acl")
+	change := &api.ACLChange{Rule: &api.ACLChange_RoleBinding{RoleBinding: &api.RoleBinding{Subject: "nobody", Role: "operator"}}}
+	value, err := proto.Marshal(change)
+	require.NoError(t, err)
+	_, err = nobody.Produce(aclCtx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Contains(t, err.Error(), "written by the server only")
+}
+
+func testACLUnauthorized(t *testing.T, _, acl api.ACLClient, _ api.LogClient) {
+	ctx := context.Background()
+	_, err := acl.AddRoleBinding(ctx, &api.AddRoleBindingRequest{
+		RoleBinding: &api.RoleBinding{Subject: "nobody", Role: "operator"},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = acl.ListPolicies(ctx, &api.ListPoliciesRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testACLInvalid(t *testing.T, acl, _ api.ACLClient, _ api.LogClient) {
+	ctx := context.Background()
+	_, err := acl.AddPolicy(ctx, &api.AddPolicyRequest{Policy: &api.Policy{Subject: "nobody"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = acl.AddRoleBinding(ctx, &api.AddRoleBindingRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestACLWithoutACL(t *testing.T) {
+	rootConn, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	_, err := api.NewACLClient(rootConn).ListPolicies(context.Background(), &api.ListPoliciesRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdmin(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		rootClient api.LogClient,
+		rootAdmin api.AdminClient,
+		nobodyAdmin api.AdminClient,
+	){
+		"offsets and size":        testAdminOffsets,
+		"roll, list and truncate": testAdminRollTruncate,
+		"sync":                    testAdminSync,
+		"unauthorized fails":      testAdminUnauthorized,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+				cfg.AdminLog = cfg.CommitLog.(*log.Log)
+			})
+			defer teardown()
+			fn(t, api.NewLogClient(rootConn), api.NewAdminClient(rootConn), api.NewAdminClient(nobodyConn))
+		})
+	}
+}
+
+func TestAdminWithoutLog(t *testing.T) {
+	rootConn, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	_, err := api.NewAdminClient(rootConn).GetSize(context.Background(), &api.GetSizeRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func produce(t *testing.T, client api.LogClient, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("record")},
+		})
+		require.NoError(t, err)
+	}
+}
+
+func testAdminOffsets(t *testing.T, client api.LogClient, admin, _ api.AdminClient) {
+	ctx := context.Background()
+	offsets, err := admin.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.LowestOffset)
+	require.Equal(t, uint64(0), offsets.NextOffset)
+
+	produce(t, client, 3)
+	offsets, err = admin.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offsets.LowestOffset)
+	require.Equal(t, uint64(3), offsets.NextOffset)
+
+	size, err := admin.GetSize(ctx, &api.GetSizeRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, size.SizeBytes)
+}
+
+func testAdminRollTruncate(t *testing.T, client api.LogClient, admin, _ api.AdminClient) {
+	ctx := context.Background()
+	produce(t, client, 2)
+	roll, err := admin.RollSegment(ctx, &api.RollSegmentRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), roll.BaseOffset)
+	//rolling an empty segment keeps it
+	roll, err = admin.RollSegment(ctx, &api.RollSegmentRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), roll.BaseOffset)
+	produce(t, client, 1)
+
+	segments, err := admin.ListSegments(ctx, &api.ListSegmentsRequest{})
+	require.NoError(t, err)
+	require.Len(t, segments.Segments, 2)
+	require.Equal(t, uint64(0), segments.Segments[0].BaseOffset)
+	require.Equal(t, uint64(2), segments.Segments[0].NextOffset)
+	require.Equal(t, uint64(2), segments.Segments[1].BaseOffset)
+	require.Equal(t, uint64(3), segments.Segments[1].NextOffset)
+	require.NotZero(t, segments.Segments[1].StoreBytes)
+
+	//the first segment still holds offset 1
+	truncated, err := admin.Truncate(ctx, &api.TruncateRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), truncated.LowestOffset)
+
+	truncated, err = admin.Truncate(ctx, &api.TruncateRequest{Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), truncated.LowestOffset)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	//the active segment is never removed
+	truncated, err = admin.Truncate(ctx, &api.TruncateRequest{Offset: 10})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), truncated.LowestOffset)
+}
+
+func testAdminSync(t *testing.T, client api.LogClient, admin, _ api.AdminClient) {
+	produce(t, client, 2)
+	_, err := admin.Sync(context.Background(), &api.SyncRequest{})
+	require.NoError(t, err)
+}
+
+func testAdminUnauthorized(t *testing.T, _ api.LogClient, _, admin api.AdminClient) {
+	ctx := context.Background()
+	for name, call := range map[string]func() error{
+		"GetOffsets": func() error {
+			_, err := admin.GetOffsets(ctx, &api.GetOffsetsRequest{})
+			return err
+		},
+		"GetSize": func() error {
+			_, err := admin.GetSize(ctx, &api.GetSizeRequest{})
+			return err
+		},
+		"ListSegments": func() error {
+			_, err := admin.ListSegments(ctx, &api.ListSegmentsRequest{})
+			return err
+		},
+		"Truncate": func() error {
+			_, err := admin.Truncate(ctx, &api.TruncateRequest{Offset: 1})
+			return err
+		},
+		"RollSegment": func() error {
+			_, err := admin.RollSegment(ctx, &api.RollSegmentRequest{})
+			return err
+		},
+		"Sync": func() error {
+			_, err := admin.Sync(ctx, &api.SyncRequest{})
+			return err
+		},
+	} {
+		require.Equal(t, codes.PermissionDenied, status.Code(call()), name)
+	}
+}
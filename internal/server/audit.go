@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+//AuditLogName is the name the audit log is served under as an internal log. Its records are
+//api.AuditEvent messages and the resource audit/records
+const AuditLogName = "audit"
+
+//maxAuditRanges bounds the offset ranges of an event. A long stream of scattered offsets has its
+//last range widened instead
+const maxAuditRanges = 1024
+
+//audit collects the event of an rpc as it is authorized and touches offsets. allowed is called
+//once, with the lock held, the first time a stream is allowed
+type audit struct {
+	mu         sync.Mutex
+	event      *api.AuditEvent
+	authorized bool
+	allowed    func()
+}
+
+type auditContextKey struct{}
+
+//authorize checks that the caller may perform action on object and records the decision in the
+//audit event of the rpc. A denial is kept over earlier decisions
+func (s *grpcServer) authorize(ctx context.Context, object, action string) error {
+	err := s.Authorizer.Authorize(subject(ctx), object, action)
+	a, ok := ctx.Value(auditContextKey{}).(*audit)
+	if !ok {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.authorized || a.event.Allowed {
+		a.authorized = true
+		a.event.Object = object
+		a.event.Action = action
+		a.event.Allowed = err == nil
+	}
+	if a.allowed != nil && a.event.Allowed {
+		a.allowed()
+		a.allowed = nil
+	}
+	return err
+}
+
+//touched records offsets from first to last in the audit event of the rpc
+func touched(ctx context.Context, first, last uint64) {
+	a, ok := ctx.Value(auditContextKey{}).(*audit)
+	if !ok {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ranges := a.event.Offsets
+	if n := len(ranges); n > 0 {
+		r := ranges[n-1]
+		switch {
+		case first >= r.First && first <= r.Last+1 && last >= r.Last:
+			r.Last = last
+			return
+		case n >= maxAuditRanges:
+			if first < r.First {
+				r.First = first
+			}
+			if last > r.Last {
+				r.Last = last
+			}
+			return
+		}
+	}
+	a.event.Offsets = append(ranges, &api.OffsetRange{First: first, Last: last})
+}
+
+//auditor appends the audit events of authorized rpcs to the audit log
+type auditor struct {
+	log    CommitLog
+	logger *zap.Logger
+}
+
+func (a *auditor) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, record := a.start(ctx, info.FullMethod, false)
+	res, err := handler(ctx, req)
+	record(err)
+	return res, err
+}
+
+func (a *auditor) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, record := a.start(ss.Context(), info.FullMethod, true)
+	err := handler(srv, &auditStream{ServerStream: ss, ctx: ctx})
+	record(err)
+	return err
+}
+
+//start adds the audit of an rpc to ctx. The returned func appends its event once the rpc completes.
+//A stream also has its event appended once it is allowed, which a stream that never completes,
+//because it is long lived or the server crashes, would otherwise not have
+func (a *auditor) start(ctx context.Context, method string, stream bool) (context.Context, func(error)) {
+	start := time.Now()
+	event := &api.AuditEvent{
+		TimeUnixNano: start.UnixNano(),
+		Subject:      subject(ctx),
+		Method:       method,
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		event.Peer = p.Addr.String()
+	}
+	state := &audit{event: event}
+	if stream {
+		state.allowed = func() {
+			started := proto.Clone(event).(*api.AuditEvent)
+			started.Stage = api.AuditEvent_STARTED
+			a.append(started)
+		}
+	}
+	return context.WithValue(ctx, auditContextKey{}, state), func(err error) {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		if !state.authorized {
+			return
+		}
+		event.DurationNanos = time.Since(start).Nanoseconds()
+		event.Code = status.Code(err).String()
+		a.append(event)
+	}
+}
+
+//append appends event to the audit log
+func (a *auditor) append(event *api.AuditEvent) {
+	//reading the audit log would otherwise add to it as fast as it is read
+	if event.Allowed && event.Object == AuditLogName+"/records" && event.Action != produceAction {
+		return
+	}
+	value, err := proto.Marshal(event)
+	if err == nil {
+		_, err = a.log.Append(&api.Record{Value: value})
+	}
+	if err != nil {
+		a.logger.Error("failed to append audit event", zap.String("method", event.Method), zap.Error(err))
+	}
+}
+
+//auditStream is a server stream with the audit of the rpc in its context
+type auditStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *auditStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	require.NoError(t, err)
+	auditLog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer auditLog.Remove()
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.AdminLog = cfg.CommitLog.(*log.Log)
+		cfg.AuditLog = auditLog
+	})
+	defer teardown()
+	root := api.NewLogClient(rootConn)
+	nobody := api.NewLogClient(nobodyConn)
+	admin := api.NewAdminClient(rootConn)
+	ctx := context.Background()
+
+	//events reads the audit log from offset
+	events := func(offset uint64) []*api.AuditEvent {
+		var events []*api.AuditEvent
+		for {
+			record, err := auditLog.Read(offset)
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				return events
+			}
+			require.NoError(t, err)
+			event := &api.AuditEvent{}
+			require.NoError(t, proto.Unmarshal(record.Value, event))
+			events = append(events, event)
+			offset++
+		}
+	}
+	requireEvent := func(t *testing.T, event *api.AuditEvent, subject, method, action, object string, allowed bool, code codes.Code, offsets ...uint64) {
+		t.Helper()
+		require.Equal(t, subject, event.Subject)
+		require.Equal(t, method, event.Method)
+		require.Equal(t, action, event.Action)
+		require.Equal(t, object, event.Object)
+		require.Equal(t, allowed, event.Allowed)
+		require.Equal(t, code.String(), event.Code)
+		require.NotEmpty(t, event.Peer)
+		require.Equal(t, api.AuditEvent_COMPLETED, event.Stage)
+		require.InDelta(t, time.Now().UnixNano(), event.TimeUnixNano, float64(time.Minute))
+		var got []uint64
+		for _, r := range event.Offsets {
+			got = append(got, r.First, r.Last)
+		}
+		require.Equal(t, offsets, got)
+	}
+
+	for _, value := range []string{"a", "b", "c"} {
+		_, err := root.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+	}
+	_, err = root.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	_, err = nobody.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = root.Consume(ctx, &api.ConsumeRequest{Offset: 10})
+	require.Error(t, err)
+	_, err = admin.RollSegment(ctx, &api.RollSegmentRequest{})
+	require.NoError(t, err)
+	_, err = admin.Truncate(ctx, &api.TruncateRequest{Offset: 3})
+	require.NoError(t, err)
+
+	got := events(0)
+	require.Len(t, got, 8)
+	for i := 0; i < 3; i++ {
+		requireEvent(t, got[i], "root", "/log.v1.Log/Produce", "produce", "log/records", true, codes.OK, uint64(i), uint64(i))
+	}
+	requireEvent(t, got[3], "root", "/log.v1.Log/Consume", "consume", "log/records", true, codes.OK, 1, 1)
+	requireEvent(t, got[4], "nobody", "/log.v1.Log/Consume", "consume", "log/records", false, codes.PermissionDenied)
+	//api.ErrOffsetOutOfRange has the status code 404
+	requireEvent(t, got[5], "root", "/log.v1.Log/Consume", "consume", "log/records", true, codes.Code(404))
+	requireEvent(t, got[6], "root", "/log.v1.Admin/RollSegment", "admin", "log/segments", true, codes.OK, 3, 3)
+	requireEvent(t, got[7], "root", "/log.v1.Admin/Truncate", "admin", "log/records", true, codes.OK, 0, 2)
+
+	//a stream has an event once it is allowed, before it touches any records
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := root.ConsumeStream(streamCtx, &api.ConsumeRequest{Offset: 3})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(events(8)) == 1 }, time.Second, 10*time.Millisecond)
+	started := events(8)[0]
+	require.Equal(t, api.AuditEvent_STARTED, started.Stage)
+	require.Equal(t, "root", started.Subject)
+	require.Equal(t, "/log.v1.Log/ConsumeStream", started.Method)
+	require.Equal(t, "log/records", started.Object)
+	require.True(t, started.Allowed)
+	require.Empty(t, started.Code)
+	require.Empty(t, started.Offsets)
+	//and a single event for all the records it touches once it completes
+	//the truncated log continues at offset 3
+	for _, value := range []string{"d", "e"} {
+		_, err = root.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.NoError(t, err)
+	}
+	cancel()
+	require.Eventually(t, func() bool { return len(events(9)) == 3 }, time.Second, 10*time.Millisecond)
+	got = events(9)
+	requireEvent(t, got[0], "root", "/log.v1.Log/Produce", "produce", "log/records", true, codes.OK, 3, 3)
+	requireEvent(t, got[1], "root", "/log.v1.Log/Produce", "produce", "log/records", true, codes.OK, 4, 4)
+	requireEvent(t, got[2], "root", "/log.v1.Log/ConsumeStream", "consume", "log/records", true, codes.OK, 3, 4)
+
+	//the audit log is served as an internal log, and reading it is not audited
+	auditCtx := metadata.AppendToOutgoingContext(ctx, log.LogMetadataKey, AuditLogName)
+	res, err := root.Consume(auditCtx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	event := &api.AuditEvent{}
+	require.NoError(t, proto.Unmarshal(res.Record.Value, event))
+	require.Equal(t, "/log.v1.Log/Produce", event.Method)
+	_, err = nobody.Consume(auditCtx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	got = events(12)
+	require.Len(t, got, 1)
+	requireEvent(t, got[0], "nobody", "/log.v1.Log/Consume", "consume", "audit/records", false, codes.PermissionDenied)
+}
+
+func TestAuditOffsets(t *testing.T) {
+	state := &audit{event: &api.AuditEvent{}}
+	ctx := context.WithValue(context.Background(), auditContextKey{}, state)
+	for _, o := range []uint64{3, 4, 4, 5, 9, 1} {
+		touched(ctx, o, o)
+	}
+	touched(ctx, 1, 6)
+	var got [][2]uint64
+	for _, r := range state.event.Offsets {
+		got = append(got, [2]uint64{r.First, r.Last})
+	}
+	require.Equal(t, [][2]uint64{{3, 5}, {9, 9}, {1, 6}}, got)
+
+	//ranges past the limit widen the last range
+	state.event.Offsets = nil
+	for i := uint64(0); i < maxAuditRanges+10; i++ {
+		touched(ctx, 2*i, 2*i)
+	}
+	require.Len(t, state.event.Offsets, maxAuditRanges)
+	last := state.event.Offsets[maxAuditRanges-1]
+	require.Equal(t, uint64(2*(maxAuditRanges-1)), last.First)
+	require.Equal(t, uint64(2*(maxAuditRanges+9)), last.Last)
+}
@@ -1,93 +1,392 @@
 package server
 
 import (
+	"context"
+	_ "embed"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
-//NewHTTPServer creates a http server at addr
-// POSTs to "/" are handled by Produce endpoint
-// GETs to "/" are handled by Consume endpoint
-func NewHTTPServer(addr string) *http.Server {
-	httpsrvr := newHTTPServer()
-	r := mux.NewRouter()
-	r.HandleFunc("/", httpsrvr.handleProduce).Methods("POST")
-	r.HandleFunc("/", httpsrvr.handleConsume).Methods("GET")
-	return &http.Server{
-		Addr:    addr,
-		Handler: r,
-	}
+//maxHTTPBodyBytes bounds the body of a produce, like the default message size of grpc servers
+const maxHTTPBodyBytes = 4 << 20
 
-}
+//openAPI describes the http api
+//go:embed openapi.json
+var openAPI []byte
 
-type httpServer struct {
-	Logger *Log
+//NewHTTPServer creates an http server for the JSON API of the log of cfg. Requests are
+//authenticated, authorized, audited and limited the same way as rpcs: TLS clients by their
+//certificate, others by an Authorization bearer token or an X-API-Key header. Records and
+//responses are the JSON encoding of the api messages, described at /openapi.json
+//
+//	POST /records           produces the record in the body, see api.Record
+//	GET  /records/{offset}  consumes the record at offset, 404 if there is none
+//	GET  /records/events    tails the log as server-sent events, see handleEvents
+//	GET  /records/websocket tails the log over a WebSocket, see handleWebSocket
+//
+//The caller serves it on a listener, wrapped with tls.NewListener to serve TLS
+func NewHTTPServer(cfg *Config) (*http.Server, error) {
+	srv, err := newgrpcServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	stream, unary := interceptors(cfg, zap.L().Named("http"))
+	h := &httpServer{
+		grpcServer: srv,
+		unary:      grpc_middleware.ChainUnaryServer(unary...),
+		stream:     grpc_middleware.ChainStreamServer(stream...),
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/records", h.handleProduce).Methods(http.MethodPost)
+	//before /records/{offset}, which would match them too
+	r.HandleFunc("/records/events", h.handleEvents).Methods(http.MethodGet)
+	r.HandleFunc("/records/websocket", h.handleWebSocket).Methods(http.MethodGet)
+	r.HandleFunc("/records/{offset}", h.handleConsume).Methods(http.MethodGet)
+	r.HandleFunc("/openapi.json", h.handleOpenAPI).Methods(http.MethodGet)
+	return &http.Server{Handler: r}, nil
 }
 
-func newHTTPServer() *httpServer {
-	return &httpServer{Logger: NewLog()}
+type httpServer struct {
+	*grpcServer
+	//unary runs the interceptors of the rpc server around the handlers
+	unary grpc.UnaryServerInterceptor
+	//stream runs them around the tails
+	stream grpc.StreamServerInterceptor
 }
 
-type ProduceRequest struct {
-	Rec Record `json:"record"`
+func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPBodyBytes))
+	if err != nil {
+		writeHTTPError(w, status.Errorf(codes.InvalidArgument, "reading record: %v", err))
+		return
+	}
+	record := &api.Record{}
+	err = protojson.Unmarshal(b, record)
+	if err != nil {
+		writeHTTPError(w, status.Errorf(codes.InvalidArgument, "decoding record: %v", err))
+		return
+	}
+	res, err := s.call(r, "/log.v1.Log/Produce", &api.ProduceRequest{Record: record},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return s.Produce(ctx, req.(*api.ProduceRequest))
+		},
+	)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeHTTP(w, http.StatusCreated, res)
 }
 
-type ProduceResponse struct {
-	Offset uint64 `json:"offset"`
+func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		writeHTTPError(w, status.Errorf(codes.InvalidArgument, "offset %q is not a number", mux.Vars(r)["offset"]))
+		return
+	}
+	res, err := s.call(r, "/log.v1.Log/Consume", &api.ConsumeRequest{Offset: offset},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return s.Consume(ctx, req.(*api.ConsumeRequest))
+		},
+	)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	writeHTTP(w, http.StatusOK, res)
 }
 
-type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
+//handleEvents tails the log from the offset query parameter as server-sent events, with the offset
+//of each record as the id of its event and the ConsumeResponse as its data. Clients that reconnect
+//with the Last-Event-ID header resume after that record. An error after the stream started ends
+//it with an error event
+func (s *httpServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, status.Error(codes.Unimplemented, "streaming is not supported"))
+		return
+	}
+	offset, err := tailOffset(r)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+	opened := false
+	err = s.follow(r, offset,
+		func() error {
+			opened = true
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			flusher.Flush()
+			return nil
+		},
+		func(res *api.ConsumeResponse) error {
+			b, err := httpJSON.Marshal(res)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", res.Record.Offset, b)
+			flusher.Flush()
+			return err
+		},
+	)
+	if err == nil || r.Context().Err() != nil {
+		return
+	}
+	if !opened {
+		writeHTTPError(w, err)
+		return
+	}
+	b, _ := json.Marshal(httpError{Error: status.Convert(err).Message()})
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+	flusher.Flush()
 }
 
-type ConsumeResponse struct {
-	Rec Record `json:"record"`
-}
+//upgrader keeps the default check of the Origin header, as browsers present client certificates
+//to WebSockets opened by any site
+var upgrader = websocket.Upgrader{}
 
-//handleProduce is handler for the produce request
-func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
-	var req ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+//handleWebSocket tails the log like handleEvents, with a text message for each ConsumeResponse.
+//Browsers can't set headers on WebSockets, so the last_event_id query parameter stands in for the
+//Last-Event-ID header. The server closes the WebSocket with the error of the stream, if any
+func (s *httpServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	offset, err := tailOffset(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeHTTPError(w, err)
 		return
 	}
-	off, err := s.Logger.Append(req.Rec)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var conn *websocket.Conn
+	upgraded := false
+	err = s.follow(r.WithContext(ctx), offset,
+		func() error {
+			//Upgrade replies with an error itself
+			upgraded = true
+			var err error
+			conn, err = upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return err
+			}
+			//the stream ends when the client closes the WebSocket, which only reads notice
+			go func() {
+				for {
+					_, _, err := conn.NextReader()
+					if err != nil {
+						cancel()
+						return
+					}
+				}
+			}()
+			return nil
+		},
+		func(res *api.ConsumeResponse) error {
+			b, err := httpJSON.Marshal(res)
+			if err != nil {
+				return err
+			}
+			return conn.WriteMessage(websocket.TextMessage, b)
+		},
+	)
+	if !upgraded {
+		writeHTTPError(w, err)
 		return
 	}
-	res := ProduceResponse{Offset: off}
-	err = json.NewEncoder(w).Encode(res)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	if ctx.Err() != nil {
 		return
 	}
+	code, reason := websocket.CloseNormalClosure, ""
+	if err != nil {
+		code, reason = websocket.CloseInternalServerErr, status.Convert(err).Message()
+		//close reasons are limited to 123 bytes
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
 
+func (s *httpServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
 }
 
-func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
-	var req ConsumeRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+//call runs handler as the rpc method, with the peer and the credentials of the http request
+func (s *httpServer) call(r *http.Request, method string, req interface{}, handler grpc.UnaryHandler) (proto.Message, error) {
+	res, err := s.unary(rpcContext(r), req, &grpc.UnaryServerInfo{Server: s.grpcServer, FullMethod: method}, handler)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, err
 	}
-	rec, err := s.Logger.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
+	return res.(proto.Message), nil
+}
+
+//follow streams the log from offset as the ConsumeStream rpc would, with the peer and the credentials
+//of the http request. open is called once the client is authorized to consume, before any record
+//is sent, so that errors until then can be http errors
+func (s *httpServer) follow(r *http.Request, offset uint64, open func() error, send func(*api.ConsumeResponse) error) error {
+	info := &grpc.StreamServerInfo{FullMethod: "/log.v1.Log/ConsumeStream", IsServerStream: true}
+	ss := &httpStream{ctx: rpcContext(r), send: send}
+	return s.stream(s.grpcServer, ss, info, func(srv interface{}, ss grpc.ServerStream) error {
+		commitLog, err := s.authorizeConsume(ss.Context())
+		if err != nil {
+			return err
+		}
+		err = open()
+		if err != nil {
+			return err
+		}
+		return tailLog(ss.Context(), commitLog, offset, func(res *api.ConsumeResponse) error {
+			return ss.SendMsg(res)
+		})
+	})
+}
+
+//tailOffset is the offset a tail starts from: after the Last-Event-ID of a client that resumes,
+//otherwise the offset query parameter, 0 by default
+func tailOffset(r *http.Request) (uint64, error) {
+	q := r.URL.Query()
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = q.Get("last_event_id")
+	}
+	if lastEventID != "" {
+		last, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return 0, status.Errorf(codes.InvalidArgument, "last event id %q is not an offset", lastEventID)
+		}
+		return last + 1, nil
+	}
+	if q.Get("offset") == "" {
+		return 0, nil
 	}
+	offset, err := strconv.ParseUint(q.Get("offset"), 10, 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return 0, status.Errorf(codes.InvalidArgument, "offset %q is not a number", q.Get("offset"))
+	}
+	return offset, nil
+}
+
+//httpStream is the grpc.ServerStream of a tail, which sends the records it is given to the client
+type httpStream struct {
+	ctx  context.Context
+	send func(*api.ConsumeResponse) error
+}
+
+func (s *httpStream) SetHeader(metadata.MD) error  { return nil }
+func (s *httpStream) SendHeader(metadata.MD) error { return nil }
+func (s *httpStream) SetTrailer(metadata.MD)       {}
+func (s *httpStream) Context() context.Context     { return s.ctx }
+func (s *httpStream) RecvMsg(m interface{}) error  { return io.EOF }
+
+func (s *httpStream) SendMsg(m interface{}) error {
+	return s.send(m.(*api.ConsumeResponse))
+}
+
+//rpcContext returns the context of r the way an rpc would have it, so that authenticators find
+//the client certificate in the peer and the credentials in the metadata
+func rpcContext(r *http.Request) context.Context {
+	p := &peer.Peer{Addr: httpAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
 	}
-	resp := ConsumeResponse{Rec: rec}
-	err = json.NewEncoder(w).Encode(resp)
+	ctx := peer.NewContext(r.Context(), p)
+	md := metadata.MD{}
+	for _, key := range []string{"authorization", auth.APIKeyMetadataKey} {
+		if v := r.Header.Values(key); len(v) > 0 {
+			md.Set(key, v...)
+		}
+	}
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+//httpAddr is the remote address of an http request
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+var httpJSON = protojson.MarshalOptions{EmitUnpopulated: true}
+
+func writeHTTP(w http.ResponseWriter, code int, m proto.Message) {
+	b, err := httpJSON.Marshal(m)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeHTTPError(w, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+//httpError is the body of error responses
+type httpError struct {
+	Error string `json:"error"`
+}
+
+//writeHTTPError writes the http status of the grpc status of err. Clients over quota are told when
+//to retry in the Retry-After header
+func writeHTTPError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	for _, d := range st.Details() {
+		if retry, ok := d.(*errdetails.RetryInfo); ok {
+			seconds := math.Ceil(retry.RetryDelay.AsDuration().Seconds())
+			w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st.Code()))
+	json.NewEncoder(w).Encode(httpError{Error: st.Message()})
+}
+
+//httpStatus maps grpc codes to http statuses. api.ErrOffsetOutOfRange has the code 404
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.NotFound, http.StatusNotFound:
+		return http.StatusNotFound
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
 }
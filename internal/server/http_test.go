@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/config"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/krehermann/proglog/internal/testconfig"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+//setupHTTPTest serves the http api over TLS that verifies client certificates if given, and
+//returns clients for the root and nobody certificates and one without a certificate
+func setupHTTPTest(t *testing.T, cfgFn func(*Config)) (url string, root, nobody, anonymous *http.Client) {
+	t.Helper()
+	files := testconfig.New(t)
+	dir, err := ioutil.TempDir("", "http-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	cmtlog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	cfg := &Config{CommitLog: cmtlog, Authorizer: auth.New(files.ACLModelFile, files.ACLPolicyFile)}
+	if cfgFn != nil {
+		cfgFn(cfg)
+	}
+	srv, err := NewHTTPServer(cfg)
+	require.NoError(t, err)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:           files.ServerCertFile,
+		KeyFile:            files.ServerKeyFile,
+		CAFile:             files.CAFile,
+		Server:             true,
+		ClientCertOptional: true,
+	})
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.TLS = serverTLSConfig
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	client := func(certFile, keyFile string) *http.Client {
+		clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      certFile,
+			KeyFile:       keyFile,
+			CAFile:        files.CAFile,
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLSConfig}}
+	}
+	return ts.URL,
+		client(files.RootClientCertFile, files.RootClientKeyFile),
+		client(files.NobodyClientCertFile, files.NobodyClientKeyFile),
+		client("", "")
+}
+
+func TestHTTPServer(t *testing.T) {
+	keysDir, err := ioutil.TempDir("", "http-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(keysDir)
+	sum := sha256.Sum256([]byte("root-key"))
+	keysFile := filepath.Join(keysDir, "keys")
+	require.NoError(t, ioutil.WriteFile(keysFile, []byte("root "+hex.EncodeToString(sum[:])+"\n"), 0600))
+	apiKeys, err := auth.NewAPIKeyAuthenticator(keysFile)
+	require.NoError(t, err)
+	auditDir, err := ioutil.TempDir("", "http-audit")
+	require.NoError(t, err)
+	auditLog, err := log.NewLog(auditDir, log.Config{})
+	require.NoError(t, err)
+	defer auditLog.Remove()
+
+	url, root, nobody, anonymous := setupHTTPTest(t, func(cfg *Config) {
+		cfg.Authenticators = []Authenticator{TLSAuthenticator{}, apiKeys}
+		cfg.AuditLog = auditLog
+	})
+	do := func(client *http.Client, method, path, body string, header ...string) (int, string) {
+		req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+		require.NoError(t, err)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(b)
+	}
+	requireError := func(t *testing.T, body, contains string) {
+		t.Helper()
+		var e httpError
+		require.NoError(t, json.Unmarshal([]byte(body), &e))
+		require.Contains(t, e.Error, contains)
+	}
+
+	code, body := do(root, "POST", "/records", `{"value":"Zm9v"}`)
+	require.Equal(t, http.StatusCreated, code, body)
+	require.JSONEq(t, `{"offset":"0"}`, body)
+	code, body = do(root, "GET", "/records/0", "")
+	require.Equal(t, http.StatusOK, code, body)
+	res := &api.ConsumeResponse{}
+	require.NoError(t, protojson.Unmarshal([]byte(body), res))
+	require.Equal(t, []byte("foo"), res.Record.Value)
+	require.Equal(t, uint64(0), res.Record.Offset)
+	require.Equal(t, uint64(1), res.NextOffset)
+
+	for scenario, fn := range map[string]func(t *testing.T){
+		"offsets past the end are not found": func(t *testing.T) {
+			code, body := do(root, "GET", "/records/10", "")
+			require.Equal(t, http.StatusNotFound, code)
+			requireError(t, body, "offset out of range: 10")
+		},
+		"offsets are numbers": func(t *testing.T) {
+			code, _ := do(root, "GET", "/records/first", "")
+			require.Equal(t, http.StatusBadRequest, code)
+		},
+		"records are json": func(t *testing.T) {
+			code, body := do(root, "POST", "/records", `{"value":`)
+			require.Equal(t, http.StatusBadRequest, code)
+			requireError(t, body, "decoding record")
+			code, _ = do(root, "POST", "/records", `{"values":"Zm9v"}`)
+			require.Equal(t, http.StatusBadRequest, code)
+		},
+		"records are limited in size": func(t *testing.T) {
+			big := `{"value":"` + strings.Repeat("A", maxHTTPBodyBytes) + `"}`
+			code, _ := do(root, "POST", "/records", big)
+			require.Equal(t, http.StatusBadRequest, code)
+		},
+		"unauthorized subjects are forbidden": func(t *testing.T) {
+			code, body := do(nobody, "POST", "/records", `{"value":"Zm9v"}`)
+			require.Equal(t, http.StatusForbidden, code)
+			requireError(t, body, "nobody not permitted to produce to log/records")
+			code, _ = do(anonymous, "GET", "/records/0", "")
+			require.Equal(t, http.StatusForbidden, code)
+		},
+		"api keys": func(t *testing.T) {
+			code, _ := do(anonymous, "GET", "/records/0", "", "X-API-Key", "root-key")
+			require.Equal(t, http.StatusOK, code)
+			code, _ = do(anonymous, "GET", "/records/0", "", "X-API-Key", "wrong-key")
+			require.Equal(t, http.StatusUnauthorized, code)
+		},
+		"wrong methods": func(t *testing.T) {
+			code, _ := do(root, "DELETE", "/records/0", "")
+			require.Equal(t, http.StatusMethodNotAllowed, code)
+		},
+		"openapi": func(t *testing.T) {
+			code, body := do(anonymous, "GET", "/openapi.json", "")
+			require.Equal(t, http.StatusOK, code)
+			var doc struct {
+				OpenAPI string                     `json:"openapi"`
+				Paths   map[string]json.RawMessage `json:"paths"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(body), &doc))
+			require.Equal(t, "3.0.3", doc.OpenAPI)
+			require.Contains(t, doc.Paths, "/records")
+			require.Contains(t, doc.Paths, "/records/{offset}")
+			require.Contains(t, doc.Paths, "/records/events")
+		},
+	} {
+		t.Run(scenario, fn)
+	}
+
+	//requests are audited like the rpcs they map to
+	record, err := auditLog.Read(0)
+	require.NoError(t, err)
+	event := &api.AuditEvent{}
+	require.NoError(t, proto.Unmarshal(record.Value, event))
+	require.Equal(t, "root", event.Subject)
+	require.Equal(t, "/log.v1.Log/Produce", event.Method)
+	require.True(t, event.Allowed)
+}
+
+func TestHTTPQuotas(t *testing.T) {
+	url, root, _, _ := setupHTTPTest(t, func(cfg *Config) {
+		cfg.Quotas = Quotas{Default: Quota{ProduceRecordsPerSecond: 1}}
+	})
+	var res *http.Response
+	var err error
+	for i := 0; i < 3; i++ {
+		res, err = root.Post(url+"/records", "application/json", bytes.NewBufferString(`{"value":"Zm9v"}`))
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.Equal(t, "1", res.Header.Get("Retry-After"))
+}
+
+func TestHTTPTail(t *testing.T) {
+	url, root, nobody, _ := setupHTTPTest(t, nil)
+	produce := func(value string) {
+		res, err := root.Post(url+"/records", "application/json", strings.NewReader(`{"value":"`+value+`"}`))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusCreated, res.StatusCode)
+	}
+	produce("Zm9v")
+	produce("YmFy")
+
+	//events reads the id and the record of the next n events
+	events := func(t *testing.T, client *http.Client, path string, n int, header ...string) []string {
+		req, err := http.NewRequest("GET", url+path, nil)
+		require.NoError(t, err)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+		var got []string
+		var id string
+		lines := bufio.NewScanner(res.Body)
+		for len(got) < n && lines.Scan() {
+			line := lines.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				c := &api.ConsumeResponse{}
+				require.NoError(t, protojson.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), c))
+				got = append(got, id+"="+string(c.Record.Value))
+			}
+		}
+		return got
+	}
+
+	for scenario, fn := range map[string]func(t *testing.T){
+		"events": func(t *testing.T) {
+			require.Equal(t, []string{"0=foo", "1=bar"}, events(t, root, "/records/events", 2))
+			require.Equal(t, []string{"1=bar"}, events(t, root, "/records/events?offset=1", 1))
+		},
+		"events resume after the last event id": func(t *testing.T) {
+			got := events(t, root, "/records/events?offset=0", 1, "Last-Event-ID", "0")
+			require.Equal(t, []string{"1=bar"}, got)
+		},
+		"events wait for records": func(t *testing.T) {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				produce("YmF6")
+			}()
+			require.Equal(t, []string{"2=baz"}, events(t, root, "/records/events?offset=2", 1))
+		},
+		"offsets are numbers": func(t *testing.T) {
+			res, err := root.Get(url + "/records/events?offset=first")
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, http.StatusBadRequest, res.StatusCode)
+		},
+		"unauthorized subjects are forbidden": func(t *testing.T) {
+			res, err := nobody.Get(url + "/records/events")
+			require.NoError(t, err)
+			res.Body.Close()
+			require.Equal(t, http.StatusForbidden, res.StatusCode)
+		},
+		"websocket": func(t *testing.T) {
+			dialer := websocket.Dialer{TLSClientConfig: root.Transport.(*http.Transport).TLSClientConfig}
+			wsURL := "wss" + strings.TrimPrefix(url, "https") + "/records/websocket?last_event_id=0"
+			conn, _, err := dialer.Dial(wsURL, nil)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, b, err := conn.ReadMessage()
+			require.NoError(t, err)
+			c := &api.ConsumeResponse{}
+			require.NoError(t, protojson.Unmarshal(b, c))
+			require.Equal(t, uint64(1), c.Record.Offset)
+			require.Equal(t, []byte("bar"), c.Record.Value)
+		},
+		"websocket unauthorized subjects are forbidden": func(t *testing.T) {
+			dialer := websocket.Dialer{TLSClientConfig: nobody.Transport.(*http.Transport).TLSClientConfig}
+			_, res, err := dialer.Dial("wss"+strings.TrimPrefix(url, "https")+"/records/websocket", nil)
+			require.Error(t, err)
+			require.Equal(t, http.StatusForbidden, res.StatusCode)
+		},
+	} {
+		t.Run(scenario, fn)
+	}
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+//Quota limits the rate a subject produces and consumes at. Zero rates are unlimited. A subject may
+//use a second's worth of its rate at once
+type Quota struct {
+	//ProduceBytesPerSecond limits the bytes of the values of produced records
+	ProduceBytesPerSecond   float64
+	ProduceRecordsPerSecond float64
+	//ConsumeBytesPerSecond limits the bytes of the values of consumed records
+	ConsumeBytesPerSecond float64
+}
+
+//Quotas are the quotas of each subject. Replication, by subjects that may replicate the log, is not
+//limited
+type Quotas struct {
+	//Default is the quota of subjects without their own
+	Default Quota
+	//Subjects are the quotas of particular subjects
+	Subjects map[string]Quota
+	//ThrottleStreams slows streams that are over quota down to the quota, so that a consumer
+	//catching up is not cut off. By default they fail with ResourceExhausted like unary rpcs
+	ThrottleStreams bool
+}
+
+//Enabled returns true if any rate is limited
+func (q Quotas) Enabled() bool {
+	if q.Default != (Quota{}) {
+		return true
+	}
+	for _, quota := range q.Subjects {
+		if quota != (Quota{}) {
+			return true
+		}
+	}
+	return false
+}
+
+//quota indexes the rates of a Quota
+type quota int
+
+const (
+	produceBytes quota = iota
+	produceRecords
+	consumeBytes
+	numQuotas
+)
+
+func (q quota) String() string {
+	return [...]string{"produce_bytes", "produce_records", "consume_bytes"}[q]
+}
+
+func (q Quota) rate(of quota) float64 {
+	return [...]float64{q.ProduceBytesPerSecond, q.ProduceRecordsPerSecond, q.ConsumeBytesPerSecond}[of]
+}
+
+//Measures of quota usage, tagged with the subject and the quota
+var (
+	mQuotaUsed     = stats.Int64("proglog/quota/used", "Bytes or records counted against quotas", stats.UnitDimensionless)
+	mQuotaExceeded = stats.Int64("proglog/quota/exceeded", "Requests rejected or delayed for exceeding a quota", stats.UnitDimensionless)
+
+	subjectKey = tag.MustNewKey("subject")
+	quotaKey   = tag.MustNewKey("quota")
+)
+
+var quotaViews = []*view.View{
+	{Measure: mQuotaUsed, Aggregation: view.Sum(), TagKeys: []tag.Key{subjectKey, quotaKey}},
+	{Measure: mQuotaExceeded, Aggregation: view.Count(), TagKeys: []tag.Key{subjectKey, quotaKey}},
+}
+
+//bucket is a token bucket that may go into debt, so that a record larger than a second's worth of
+//the rate is let through once the bucket is full and later requests wait for the debt to be paid
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+//refill adds the tokens earned since the last refill, up to a second's worth
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+//wait returns how long until the bucket is out of debt
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+//evictInterval is how often the buckets of idle subjects are evicted
+var evictInterval = time.Minute
+
+//limiter holds the buckets of each subject. authorizer decides which subjects may replicate
+type limiter struct {
+	quotas     Quotas
+	authorizer Authorizer
+	now        func() time.Time
+	mu         sync.Mutex
+	//buckets are the buckets of each subject, nil for unlimited rates
+	buckets map[string]*[numQuotas]*bucket
+	//evicted is when idle buckets were last evicted
+	evicted time.Time
+}
+
+func newLimiter(quotas Quotas, authorizer Authorizer) *limiter {
+	return &limiter{
+		quotas:     quotas,
+		authorizer: authorizer,
+		now:        time.Now,
+		buckets:    make(map[string]*[numQuotas]*bucket),
+	}
+}
+
+//replica reports whether a request is replication, which is not limited. The metadata marking
+//requests as replication is set by clients, so its subject must also be allowed to replicate
+func (l *limiter) replica(ctx context.Context) bool {
+	if !replica(ctx) || l.authorizer == nil {
+		return false
+	}
+	return l.authorizer.Authorize(subject(ctx), logObject(ctx), replicateAction) == nil
+}
+
+//full reports whether the bucket has refilled to a second's worth of its rate by now
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.rate
+}
+
+//evict forgets the subjects whose buckets are all full, as they are the same as new buckets. The
+//caller must hold l.mu
+func (l *limiter) evict(now time.Time) {
+	l.evicted = now
+	for subject, bs := range l.buckets {
+		idle := true
+		for _, b := range bs {
+			if b != nil && !b.full(now) {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			delete(l.buckets, subject)
+		}
+	}
+}
+
+//subjectBuckets returns the buckets of subject, creating them full. The caller must hold l.mu
+func (l *limiter) subjectBuckets(subject string, now time.Time) *[numQuotas]*bucket {
+	if now.Sub(l.evicted) >= evictInterval {
+		l.evict(now)
+	}
+	bs, ok := l.buckets[subject]
+	if ok {
+		return bs
+	}
+	q, ok := l.quotas.Subjects[subject]
+	if !ok {
+		q = l.quotas.Default
+	}
+	bs = &[numQuotas]*bucket{}
+	for i := range bs {
+		if r := q.rate(quota(i)); r > 0 {
+			bs[i] = &bucket{rate: r, tokens: r, last: now}
+		}
+	}
+	l.buckets[subject] = bs
+	return bs
+}
+
+//wait returns how long subject has to wait until none of the quotas are in debt, and the quota
+//that has to be waited for longest
+func (l *limiter) wait(subject string, quotas ...quota) (time.Duration, quota) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	bs := l.subjectBuckets(subject, now)
+	var longest time.Duration
+	var exceeded quota
+	for _, q := range quotas {
+		b := bs[q]
+		if b == nil {
+			continue
+		}
+		b.refill(now)
+		if d := b.wait(); d > longest {
+			longest, exceeded = d, q
+		}
+	}
+	return longest, exceeded
+}
+
+//take counts n against the quota of subject
+func (l *limiter) take(subject string, q quota, n int) {
+	l.mu.Lock()
+	now := l.now()
+	b := l.subjectBuckets(subject, now)[q]
+	if b != nil {
+		b.refill(now)
+		b.tokens -= float64(n)
+	}
+	l.mu.Unlock()
+	recordQuota(subject, q, mQuotaUsed.M(int64(n)))
+}
+
+//produce waits for the produce quotas of subject, then counts the record against them. Unless
+//block, a subject over quota gets a ResourceExhausted error instead of waiting
+func (l *limiter) produce(ctx context.Context, subject string, record *api.Record, block bool) error {
+	err := l.await(ctx, subject, block, produceBytes, produceRecords)
+	if err != nil {
+		return err
+	}
+	l.take(subject, produceRecords, 1)
+	l.take(subject, produceBytes, len(record.GetValue()))
+	return nil
+}
+
+//await waits until none of the quotas of subject are in debt
+func (l *limiter) await(ctx context.Context, subject string, block bool, quotas ...quota) error {
+	d, q := l.wait(subject, quotas...)
+	if d == 0 {
+		return nil
+	}
+	recordQuota(subject, q, mQuotaExceeded.M(1))
+	if !block {
+		return exhausted(subject, q, d)
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+//exhausted returns the error of a subject over quota, with a hint of when to retry
+func exhausted(subject string, q quota, retryAfter time.Duration) error {
+	st := status.Newf(codes.ResourceExhausted, "%s is over its %s quota, retry after %s", subject, q, retryAfter)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func recordQuota(subject string, q quota, m stats.Measurement) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(subjectKey, subject), tag.Upsert(quotaKey, q.String()))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, m)
+}
+
+//unary limits produces and consumes. Subjects over quota get a ResourceExhausted error with the
+//time to retry after in its errdetails.RetryInfo details
+func (l *limiter) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if l.replica(ctx) {
+		return handler(ctx, req)
+	}
+	sub := subject(ctx)
+	switch r := req.(type) {
+	case *api.ProduceRequest:
+		err := l.produce(ctx, sub, r.Record, false)
+		if err != nil {
+			return nil, err
+		}
+	case *api.ConsumeRequest:
+		err := l.await(ctx, sub, false, consumeBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res, err := handler(ctx, req)
+	if c, ok := res.(*api.ConsumeResponse); ok && err == nil {
+		l.take(sub, consumeBytes, len(c.Record.GetValue()))
+	}
+	return res, err
+}
+
+//stream limits streams of produces and consumes. Streams over quota fail like unary rpcs, unless
+//Quotas.ThrottleStreams slows them to the quota instead
+func (l *limiter) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if l.replica(ss.Context()) {
+		return handler(srv, ss)
+	}
+	return handler(srv, &limitedStream{ServerStream: ss, limiter: l, subject: subject(ss.Context())})
+}
+
+//limitedStream checks the quota of its subject before it sends consumed records and after it
+//receives records to produce
+type limitedStream struct {
+	grpc.ServerStream
+	limiter *limiter
+	subject string
+}
+
+func (s *limitedStream) SendMsg(m interface{}) error {
+	if c, ok := m.(*api.ConsumeResponse); ok {
+		err := s.limiter.await(s.Context(), s.subject, s.limiter.quotas.ThrottleStreams, consumeBytes)
+		if err != nil {
+			return err
+		}
+		s.limiter.take(s.subject, consumeBytes, len(c.Record.GetValue()))
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+	if p, ok := m.(*api.ProduceRequest); ok {
+		return s.limiter.produce(s.Context(), s.subject, p.Record, s.limiter.quotas.ThrottleStreams)
+	}
+	return nil
+}
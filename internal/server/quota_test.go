@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newLimiter(Quotas{
+		Default: Quota{ProduceRecordsPerSecond: 2, ProduceBytesPerSecond: 100},
+		Subjects: map[string]Quota{
+			"bulk": {ProduceBytesPerSecond: 10},
+		},
+	}, nil)
+	l.now = func() time.Time { return now }
+	produce := func(subject string, size int) error {
+		return l.produce(context.Background(), subject, &api.Record{Value: make([]byte, size)}, false)
+	}
+	requireRetryAfter := func(t *testing.T, err error, want time.Duration) {
+		t.Helper()
+		st := status.Convert(err)
+		require.Equal(t, codes.ResourceExhausted, st.Code())
+		require.Len(t, st.Details(), 1)
+		require.Equal(t, want, st.Details()[0].(*errdetails.RetryInfo).RetryDelay.AsDuration())
+	}
+
+	//a second's worth of records, then a wait for the next record to be earned
+	require.NoError(t, produce("alice", 1))
+	require.NoError(t, produce("alice", 1))
+	require.NoError(t, produce("alice", 1))
+	requireRetryAfter(t, produce("alice", 1), 500*time.Millisecond)
+	//subjects have their own buckets
+	require.NoError(t, produce("bob", 1))
+	now = now.Add(500 * time.Millisecond)
+	require.NoError(t, produce("alice", 1))
+
+	//a record larger than a second's worth goes through, and the debt is paid before the next
+	require.NoError(t, produce("bulk", 25))
+	requireRetryAfter(t, produce("bulk", 1), 1500*time.Millisecond)
+	now = now.Add(1500 * time.Millisecond)
+	//bulk has no record quota
+	for i := 0; i < 10; i++ {
+		require.NoError(t, produce("bulk", 0))
+	}
+	require.NoError(t, produce("bulk", 1))
+
+	//waiting for the quota
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, l.await(ctx, "bulk", true, consumeBytes))
+	require.NoError(t, produce("carol", 200))
+	require.ErrorIs(t, l.await(ctx, "carol", true, produceBytes), context.Canceled)
+
+	//subjects are forgotten once their buckets are full again
+	require.Contains(t, l.buckets, "carol")
+	now = now.Add(evictInterval)
+	require.NoError(t, produce("dave", 1))
+	require.NotContains(t, l.buckets, "carol")
+	require.Contains(t, l.buckets, "dave")
+
+	require.False(t, Quotas{}.Enabled())
+	require.False(t, Quotas{Subjects: map[string]Quota{"alice": {}}}.Enabled())
+	require.True(t, Quotas{Subjects: map[string]Quota{"alice": {ConsumeBytesPerSecond: 1}}}.Enabled())
+}
+
+func TestQuotas(t *testing.T) {
+	rootConn, nobodyConn, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Quotas = Quotas{Default: Quota{ProduceRecordsPerSecond: 25, ConsumeBytesPerSecond: 200}}
+	})
+	defer teardown()
+	client := api.NewLogClient(rootConn)
+	ctx := context.Background()
+	value := []byte("0123456789")
+
+	//produces past the quota are refused
+	var err error
+	for i := 0; i < 30 && err == nil; i++ {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+	}
+	st := status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Positive(t, st.Details()[0].(*errdetails.RetryInfo).RetryDelay.AsDuration())
+	require.Eventually(t, func() bool {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	//streams over quota fail too. 200 bytes a second is 20 records, after the first 21
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for i := 0; i < 26 && err == nil; i++ {
+		_, err = stream.Recv()
+	}
+	st = status.Convert(err)
+	require.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Positive(t, st.Details()[0].(*errdetails.RetryInfo).RetryDelay.AsDuration())
+
+	//so are unary consumes, but not replication
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	replicaCtx := metadata.AppendToOutgoingContext(ctx, log.ReplicaMetadataKey, "1")
+	_, err = client.Consume(replicaCtx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	//marking requests as replication doesn't exempt subjects that may not replicate. nobody may
+	//not produce either, but its produces count against its quota before they are authorized
+	nobody := api.NewLogClient(nobodyConn)
+	for i := 0; i < 30 && status.Code(err) != codes.ResourceExhausted; i++ {
+		_, err = nobody.Produce(replicaCtx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+	}
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	rows, err := view.RetrieveData("proglog/quota/exceeded")
+	require.NoError(t, err)
+	exceeded := map[string]int64{}
+	for _, row := range rows {
+		tags := map[string]string{}
+		for _, tag := range row.Tags {
+			tags[tag.Key.Name()] = tag.Value
+		}
+		if tags["subject"] == "root" {
+			exceeded[tags["quota"]] = row.Data.(*view.CountData).Value
+		}
+	}
+	require.Positive(t, exceeded["produce_records"])
+	require.Positive(t, exceeded["consume_bytes"])
+	rows, err = view.RetrieveData("proglog/quota/used")
+	require.NoError(t, err)
+	require.NotEmpty(t, rows)
+}
+
+func TestQuotasThrottleStreams(t *testing.T) {
+	rootConn, _, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Quotas = Quotas{Default: Quota{ConsumeBytesPerSecond: 200}, ThrottleStreams: true}
+	})
+	defer teardown()
+	client := api.NewLogClient(rootConn)
+	ctx := context.Background()
+	for i := 0; i < 26; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("0123456789")}})
+		require.NoError(t, err)
+	}
+
+	//streams are slowed to the quota. 200 bytes a second is 20 records, after the first 21
+	start := time.Now()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for i := 0; i < 26; i++ {
+		_, err = stream.Recv()
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
@@ -2,13 +2,20 @@ package server
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"github.com/hashicorp/serf/serf"
 	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/discovery"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/krehermann/proglog/internal/tracing"
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
@@ -17,36 +24,140 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 // constants that match our ACL policy table
 const (
-	objectWildcard = "*"
-	produceAction  = "produce"
-	consumeAction  = "consume"
+	produceAction   = "produce"
+	consumeAction   = "consume"
+	adminAction     = "admin"
+	replicateAction = "replicate"
 )
 
+//Resources named in the ACL policy. They are paths so that a policy can match several of them
+//with a pattern such as log/*
+const (
+	recordsObject  = "log/records"
+	offsetsObject  = "log/offsets"
+	sizeObject     = "log/size"
+	segmentsObject = "log/segments"
+	serversObject  = "cluster/servers"
+	keyringObject  = "cluster/keyring"
+	policiesObject = "acl/policies"
+	rolesObject    = "acl/roles"
+)
+
+//Health service names reported by the grpc.health.v1 service. Produces and consumes have their own
+//status so that a server can serve consumes while it refuses produces. The empty service name is
+//the status of the whole server
+var (
+	LogHealthService     = api.Log_ServiceDesc.ServiceName
+	ProduceHealthService = LogHealthService + ".Produce"
+	ConsumeHealthService = LogHealthService + ".Consume"
+	AdminHealthService   = api.Admin_ServiceDesc.ServiceName
+)
+
+//Views are the rpc latency, size and completion views, which include the status of completed rpcs,
+//and the quota usage views. NewGRPCServer registers them
+var Views = append(append([]*view.View{}, ocgrpc.DefaultServerViews...), quotaViews...)
+
+//consumeStreamPollInterval is how long ConsumeStream waits before reading past the end of the log again
+var consumeStreamPollInterval = 10 * time.Millisecond
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
+//Authenticator resolves the subject of a request from its credentials. It returns false when the
+//request has none of the credentials it understands, and an error when they are not valid
+type Authenticator interface {
+	Authenticate(ctx context.Context) (subject string, ok bool, err error)
+}
+
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	NextOffset() (uint64, error)
+}
+
+//GetServerer exposes the servers in the cluster so that clients can discover them
+type GetServerer interface {
+	GetServers() ([]*api.Server, error)
+}
+
+//ACL manages the access control policy. Changes are written to the acl log and applied by every
+//server as it is replicated
+type ACL interface {
+	Change(*api.ACLChange) error
+	Policies() []*api.Policy
+	RoleBindings() []*api.RoleBinding
+}
+
+//AdminLog is the log managed by the admin service
+type AdminLog interface {
+	LowestOffset() (uint64, error)
+	NextOffset() (uint64, error)
+	Size() int64
+	Segments() []log.SegmentInfo
+	Truncate(lowest uint64) error
+	Roll() (uint64, error)
+	Sync() error
+}
+
+//Keyring rotates the keys that encrypt gossip between the members of the cluster. See
+//discovery.Membership
+type Keyring interface {
+	InstallKey(key string) (*serf.KeyResponse, error)
+	UseKey(key string) (*serf.KeyResponse, error)
+	RemoveKey(key string) (*serf.KeyResponse, error)
+	ListKeys() (*serf.KeyResponse, error)
 }
 
 //Config is configuration for the service
 type Config struct {
 	CommitLog  CommitLog
 	Authorizer Authorizer
+	//Authenticators are tried in order and the first that finds credentials it understands
+	//decides the subject of a request. Requests without credentials have the empty subject.
+	//By default clients are authenticated by their certificate, see TLSAuthenticator
+	Authenticators []Authenticator
+	GetServerer    GetServerer
+	//AdminLog enables the admin service
+	AdminLog AdminLog
+	//Keyring enables the keyring rpcs of the admin service
+	Keyring Keyring
+	//Logs are internal logs by name, such as the acl log. Consumes are for the internal log named
+	//by their log.LogMetadataKey metadata, and its records are the resource <name>/records. Internal
+	//logs are only written by the server itself, so produces to them are denied
+	Logs map[string]CommitLog
+	//ACL enables the acl service
+	ACL ACL
+	//AuditLog enables auditing. Every rpc that is authorized appends an api.AuditEvent to it once
+	//it completes. It is also served as the internal log named AuditLogName
+	AuditLog CommitLog
+	//Health is served as the grpc.health.v1 service. The caller sets the status of each of the
+	//health services. When it is nil, every service reports serving
+	Health *health.Server
+	//Quotas limit the rate each subject produces and consumes at
+	Quotas Quotas
+
+	//limiter enforces Quotas across the rpc and http servers of the config
+	limiter *limiter
 }
 
 var _ api.LogServer = (*grpcServer)(nil)
+var _ api.AdminServer = (*grpcServer)(nil)
+var _ api.ACLServer = (*grpcServer)(nil)
 
 type grpcServer struct {
 	api.UnimplementedLogServer
+	api.UnimplementedAdminServer
+	api.UnimplementedACLServer
 	*Config
 }
 
@@ -58,34 +169,68 @@ func newgrpcServer(cfg *Config) (srv *grpcServer, err error) {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction)
+	commitLog, object, err := s.commitLog(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	offset, err := s.CommitLog.Append(req.Record)
+	if object != recordsObject {
+		//a change written to the acl log of a follower would bypass the leader
+		return nil, status.Errorf(codes.PermissionDenied, "internal log %s is written by the server only", strings.TrimSuffix(object, "/records"))
+	}
+	err = s.authorize(ctx, object, produceAction)
+	if err != nil {
+		return nil, err
+	}
+	//consumers can link back to the span the record was produced in
+	tracing.Inject(req.Record, trace.FromContext(ctx).SpanContext())
+	offset, err := commitLog.Append(req.Record)
 	if err != nil {
 		return nil, err
 	}
+	touched(ctx, offset, offset)
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+//Consume reads a record
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	err := s.Authorizer.Authorize(
-		subject(ctx),
-		objectWildcard,
-		produceAction)
+	commitLog, err := s.authorizeConsume(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return consume(ctx, commitLog, req.Offset)
+}
+
+//authorizeConsume returns the log a request is for once the caller is allowed to consume from it.
+//Replicators, which mark their requests with log.ReplicaMetadataKey, need permission to replicate
+//rather than to consume
+func (s *grpcServer) authorizeConsume(ctx context.Context) (CommitLog, error) {
+	commitLog, object, err := s.commitLog(ctx)
 	if err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	action := consumeAction
+	if replica(ctx) {
+		action = replicateAction
+	}
+	err = s.authorize(ctx, object, action)
+	if err != nil {
+		return nil, err
+	}
+	return commitLog, nil
+}
+
+//consume reads the record at offset from a log the caller was allowed to consume from
+func consume(ctx context.Context, commitLog CommitLog, offset uint64) (*api.ConsumeResponse, error) {
+	record, err := commitLog.Read(offset)
+	if err != nil {
+		return nil, err
+	}
+	touched(ctx, offset, offset)
+	next, err := commitLog.NextOffset()
 	if err != nil {
 		return nil, err
 	}
-	return &api.ConsumeResponse{Record: record}, err
+	return &api.ConsumeResponse{Record: record, NextOffset: next}, nil
 }
 
 //ProduceStream is bidirectional stream. The server will stream records into the log and respond with the result
@@ -109,27 +254,303 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 //ConsumeStream streams records from the log to the client. It terminates when the client context terminates,
 // and will otherwise stream forever, including yet-to-be written records
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
-	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
-			}
-			err = stream.Send(res)
-			if err != nil {
-				return err
-			}
-			req.Offset++
+	return s.tail(stream.Context(), req.Offset, stream.Send)
+}
 
+//tail sends the records of the log from offset on until ctx is done, waiting for records that are
+//yet to be written. The caller is authorized once, when the tail starts
+func (s *grpcServer) tail(ctx context.Context, offset uint64, send func(*api.ConsumeResponse) error) error {
+	commitLog, err := s.authorizeConsume(ctx)
+	if err != nil {
+		return err
+	}
+	return tailLog(ctx, commitLog, offset, send)
+}
+
+//tailLog sends the records of a log the caller was allowed to consume from. ConsumeStream and the
+//http streams share it
+func tailLog(ctx context.Context, commitLog CommitLog, offset uint64, send func(*api.ConsumeResponse) error) error {
+	for ctx.Err() == nil {
+		res, err := consume(ctx, commitLog, offset)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			//wait for the record to be written rather than spinning on the log
+			timer := time.NewTimer(consumeStreamPollInterval)
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		default:
+			return err
+		}
+		err = send(res)
+		if err != nil {
+			return err
 		}
+		offset++
+	}
+	return nil
+}
+
+//GetServers returns the servers in the cluster. Clients use it to resolve and balance across the cluster
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	err := s.authorize(ctx, serversObject, consumeAction)
+	if err != nil {
+		return nil, err
+	}
+	if s.GetServerer == nil {
+		return nil, status.Error(codes.Unimplemented, "server is not configured with cluster membership")
+	}
+	servers, err := s.GetServerer.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+//authorizeAdmin checks that the caller may administer object and that the admin service is enabled
+func (s *grpcServer) authorizeAdmin(ctx context.Context, object string) error {
+	err := s.authorize(ctx, object, adminAction)
+	if err != nil {
+		return err
+	}
+	if s.AdminLog == nil {
+		return status.Error(codes.Unimplemented, "server is not configured with an admin log")
+	}
+	return nil
+}
+
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	err := s.authorizeAdmin(ctx, offsetsObject)
+	if err != nil {
+		return nil, err
+	}
+	lowest, err := s.AdminLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	next, err := s.AdminLog.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetsResponse{LowestOffset: lowest, NextOffset: next}, nil
+}
+
+func (s *grpcServer) GetSize(ctx context.Context, req *api.GetSizeRequest) (*api.GetSizeResponse, error) {
+	err := s.authorizeAdmin(ctx, sizeObject)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetSizeResponse{SizeBytes: s.AdminLog.Size()}, nil
+}
+
+func (s *grpcServer) ListSegments(ctx context.Context, req *api.ListSegmentsRequest) (*api.ListSegmentsResponse, error) {
+	err := s.authorizeAdmin(ctx, segmentsObject)
+	if err != nil {
+		return nil, err
+	}
+	res := &api.ListSegmentsResponse{}
+	for _, info := range s.AdminLog.Segments() {
+		res.Segments = append(res.Segments, &api.Segment{
+			BaseOffset: info.BaseOffset,
+			NextOffset: info.NextOffset,
+			StoreBytes: info.StoreBytes,
+			IndexBytes: info.IndexBytes,
+		})
+	}
+	return res, nil
+}
+
+//Truncate removes the segments whose records are all below the requested offset and returns
+//the new lowest offset
+func (s *grpcServer) Truncate(ctx context.Context, req *api.TruncateRequest) (*api.TruncateResponse, error) {
+	err := s.authorizeAdmin(ctx, recordsObject)
+	if err != nil {
+		return nil, err
+	}
+	before, err := s.AdminLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	err = s.AdminLog.Truncate(req.Offset)
+	if err != nil {
+		return nil, err
+	}
+	lowest, err := s.AdminLog.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	if lowest > before {
+		touched(ctx, before, lowest-1)
+	}
+	return &api.TruncateResponse{LowestOffset: lowest}, nil
+}
+
+func (s *grpcServer) RollSegment(ctx context.Context, req *api.RollSegmentRequest) (*api.RollSegmentResponse, error) {
+	err := s.authorizeAdmin(ctx, segmentsObject)
+	if err != nil {
+		return nil, err
+	}
+	base, err := s.AdminLog.Roll()
+	if err != nil {
+		return nil, err
 	}
+	touched(ctx, base, base)
+	return &api.RollSegmentResponse{BaseOffset: base}, nil
+}
+
+func (s *grpcServer) Sync(ctx context.Context, req *api.SyncRequest) (*api.SyncResponse, error) {
+	err := s.authorizeAdmin(ctx, segmentsObject)
+	if err != nil {
+		return nil, err
+	}
+	err = s.AdminLog.Sync()
+	if err != nil {
+		return nil, err
+	}
+	return &api.SyncResponse{}, nil
+}
+
+func (s *grpcServer) InstallKey(ctx context.Context, req *api.KeyRequest) (*api.KeyResponse, error) {
+	return s.keyring(ctx, func(k Keyring) (*serf.KeyResponse, error) { return k.InstallKey(req.Key) })
+}
+
+func (s *grpcServer) UseKey(ctx context.Context, req *api.KeyRequest) (*api.KeyResponse, error) {
+	return s.keyring(ctx, func(k Keyring) (*serf.KeyResponse, error) { return k.UseKey(req.Key) })
+}
+
+func (s *grpcServer) RemoveKey(ctx context.Context, req *api.KeyRequest) (*api.KeyResponse, error) {
+	return s.keyring(ctx, func(k Keyring) (*serf.KeyResponse, error) { return k.RemoveKey(req.Key) })
+}
+
+func (s *grpcServer) ListKeys(ctx context.Context, req *api.ListKeysRequest) (*api.KeyResponse, error) {
+	return s.keyring(ctx, Keyring.ListKeys)
+}
+
+//keyring runs op on the keyring once the caller is authorized to administer it. Members that fail
+//the operation are reported in the response rather than failing the rpc, so that the caller can
+//see which members to retry
+func (s *grpcServer) keyring(ctx context.Context, op func(Keyring) (*serf.KeyResponse, error)) (*api.KeyResponse, error) {
+	err := s.authorize(ctx, keyringObject, adminAction)
+	if err != nil {
+		return nil, err
+	}
+	if s.Keyring == nil {
+		return nil, status.Error(codes.Unimplemented, "server is not configured with a keyring")
+	}
+	res, err := op(s.Keyring)
+	if errors.Is(err, discovery.ErrInvalidKey) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if res == nil || (err != nil && res.NumResp == 0) {
+		return nil, status.Errorf(codes.Unavailable, "keyring: %v", err)
+	}
+	out := &api.KeyResponse{
+		NumNodes:    int32(res.NumNodes),
+		NumResp:     int32(res.NumResp),
+		NumErr:      int32(res.NumErr),
+		Messages:    res.Messages,
+		Keys:        map[string]int32{},
+		PrimaryKeys: map[string]int32{},
+	}
+	for key, n := range res.Keys {
+		out.Keys[key] = int32(n)
+	}
+	for key, n := range res.PrimaryKeys {
+		out.PrimaryKeys[key] = int32(n)
+	}
+	return out, nil
+}
+
+//authorizeACL checks that the caller may administer object and that the acl service is enabled
+func (s *grpcServer) authorizeACL(ctx context.Context, object string) error {
+	err := s.authorize(ctx, object, adminAction)
+	if err != nil {
+		return err
+	}
+	if s.ACL == nil {
+		return status.Error(codes.Unimplemented, "server is not configured with an acl")
+	}
+	return nil
+}
+
+func (s *grpcServer) AddPolicy(ctx context.Context, req *api.AddPolicyRequest) (*api.AddPolicyResponse, error) {
+	err := s.authorizeACL(ctx, policiesObject)
+	if err != nil {
+		return nil, err
+	}
+	err = s.ACL.Change(&api.ACLChange{
+		Op:   api.ACLChange_ADD,
+		Rule: &api.ACLChange_Policy{Policy: req.Policy},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddPolicyResponse{}, nil
+}
+
+func (s *grpcServer) RemovePolicy(ctx context.Context, req *api.RemovePolicyRequest) (*api.RemovePolicyResponse, error) {
+	err := s.authorizeACL(ctx, policiesObject)
+	if err != nil {
+		return nil, err
+	}
+	err = s.ACL.Change(&api.ACLChange{
+		Op:   api.ACLChange_REMOVE,
+		Rule: &api.ACLChange_Policy{Policy: req.Policy},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.RemovePolicyResponse{}, nil
+}
+
+func (s *grpcServer) ListPolicies(ctx context.Context, req *api.ListPoliciesRequest) (*api.ListPoliciesResponse, error) {
+	err := s.authorizeACL(ctx, policiesObject)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListPoliciesResponse{Policies: s.ACL.Policies()}, nil
+}
+
+func (s *grpcServer) AddRoleBinding(ctx context.Context, req *api.AddRoleBindingRequest) (*api.AddRoleBindingResponse, error) {
+	err := s.authorizeACL(ctx, rolesObject)
+	if err != nil {
+		return nil, err
+	}
+	err = s.ACL.Change(&api.ACLChange{
+		Op:   api.ACLChange_ADD,
+		Rule: &api.ACLChange_RoleBinding{RoleBinding: req.RoleBinding},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.AddRoleBindingResponse{}, nil
+}
+
+func (s *grpcServer) RemoveRoleBinding(ctx context.Context, req *api.RemoveRoleBindingRequest) (*api.RemoveRoleBindingResponse, error) {
+	err := s.authorizeACL(ctx, rolesObject)
+	if err != nil {
+		return nil, err
+	}
+	err = s.ACL.Change(&api.ACLChange{
+		Op:   api.ACLChange_REMOVE,
+		Rule: &api.ACLChange_RoleBinding{RoleBinding: req.RoleBinding},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.RemoveRoleBindingResponse{}, nil
+}
+
+func (s *grpcServer) ListRoleBindings(ctx context.Context, req *api.ListRoleBindingsRequest) (*api.ListRoleBindingsResponse, error) {
+	err := s.authorizeACL(ctx, rolesObject)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListRoleBindingsResponse{RoleBindings: s.ACL.RoleBindings()}, nil
 }
 
 func NewGRPCServer(cfg *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
@@ -144,52 +565,113 @@ func NewGRPCServer(cfg *Config, grpcOpts ...grpc.ServerOption) (*grpc.Server, er
 			},
 		),
 	}
-	trace.ApplyConfig(trace.Config{
-		DefaultSampler: trace.AlwaysSample(),
-	})
-	err := view.Register(ocgrpc.DefaultServerViews...)
+	err := view.Register(Views...)
 	if err != nil {
 		return nil, err
 	}
+	streamInterceptors, unaryInterceptors := interceptors(cfg, logger)
+	streamInterceptors = append([]grpc.StreamServerInterceptor{
+		grpc_ctxtags.StreamServerInterceptor(),
+		grpc_zap.StreamServerInterceptor(logger, zapOpts...),
+	}, streamInterceptors...)
+	unaryInterceptors = append([]grpc.UnaryServerInterceptor{
+		grpc_ctxtags.UnaryServerInterceptor(),
+		grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
+	}, unaryInterceptors...)
 	grpcOpts = append(grpcOpts,
-		grpc.StreamInterceptor(
-			grpc_middleware.ChainStreamServer(
-				grpc_ctxtags.StreamServerInterceptor(),
-				grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-				grpc_auth.StreamServerInterceptor(authenticate),
-			)),
-		grpc.UnaryInterceptor(
-			grpc_middleware.ChainUnaryServer(
-				grpc_ctxtags.UnaryServerInterceptor(),
-				grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-				grpc_auth.UnaryServerInterceptor(authenticate),
-			),
-		))
-	grpc.StatsHandler(&ocgrpc.ServerHandler{})
+		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
+	)
 	gsrv := grpc.NewServer(grpcOpts...)
 	srv, err := newgrpcServer(cfg)
 	if err != nil {
 		return nil, err
 	}
 	api.RegisterLogServer(gsrv, srv)
+	api.RegisterAdminServer(gsrv, srv)
+	api.RegisterACLServer(gsrv, srv)
+	hsrv := cfg.Health
+	if hsrv == nil {
+		hsrv = health.NewServer()
+		for _, service := range []string{LogHealthService, ProduceHealthService, ConsumeHealthService, AdminHealthService} {
+			hsrv.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+		}
+	}
+	healthpb.RegisterHealthServer(gsrv, hsrv)
 	return gsrv, nil
 }
 
+//interceptors returns the interceptors that authenticate requests, audit them and limit them to
+//the quotas of their subjects, in that order. The http server runs the unary ones too
+func interceptors(cfg *Config, logger *zap.Logger) ([]grpc.StreamServerInterceptor, []grpc.UnaryServerInterceptor) {
+	authenticators := cfg.Authenticators
+	if len(authenticators) == 0 {
+		authenticators = []Authenticator{TLSAuthenticator{}}
+	}
+	authFunc := authenticate(authenticators)
+	streamInterceptors := []grpc.StreamServerInterceptor{grpc_auth.StreamServerInterceptor(authFunc)}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{grpc_auth.UnaryServerInterceptor(authFunc)}
+	if cfg.AuditLog != nil {
+		//after authentication, so that the subject is known
+		a := &auditor{log: cfg.AuditLog, logger: logger}
+		streamInterceptors = append(streamInterceptors, a.stream)
+		unaryInterceptors = append(unaryInterceptors, a.unary)
+	}
+	if cfg.Quotas.Enabled() {
+		//a subject has the same quota whether it uses rpcs or http
+		if cfg.limiter == nil {
+			cfg.limiter = newLimiter(cfg.Quotas, cfg.Authorizer)
+		}
+		streamInterceptors = append(streamInterceptors, cfg.limiter.stream)
+		unaryInterceptors = append(unaryInterceptors, cfg.limiter.unary)
+	}
+	return streamInterceptors, unaryInterceptors
+}
+
 //Helpers for authenication
 
-//authenticate is intercpetor that reads the subject out of client's cert and writes to the rpc context
-func authenticate(ctx context.Context) (context.Context, error) {
+//authenticate returns the interceptor that writes the subject of the first of the authenticators
+//that finds credentials to the rpc context
+func authenticate(authenticators []Authenticator) grpc_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		for _, a := range authenticators {
+			subject, ok, err := a.Authenticate(ctx)
+			if err != nil {
+				return ctx, err
+			}
+			if ok {
+				return context.WithValue(ctx, subjectContextKey{}, subject), nil
+			}
+		}
+		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	}
+}
+
+//TLSAuthenticator authenticates clients by their verified certificate
+type TLSAuthenticator struct {
+	//Identity maps certificates to subjects. Defaults to their common name
+	Identity *auth.CertIdentity
+}
+
+func (a TLSAuthenticator) Authenticate(ctx context.Context) (string, bool, error) {
 	peer, ok := peer.FromContext(ctx)
 	if !ok {
-		return ctx, status.New(codes.Unknown, "couldn't find peer info").Err()
+		return "", false, status.New(codes.Unknown, "couldn't find peer info").Err()
 	}
-	if peer.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	tlsInfo, ok := peer.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 {
+		return "", false, nil
 	}
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
-	ctx = context.WithValue(ctx, subjectContextKey{}, subject)
-	return ctx, nil
+	cert := tlsInfo.State.VerifiedChains[0][0]
+	if a.Identity == nil {
+		return cert.Subject.CommonName, true, nil
+	}
+	subject, ok := a.Identity.Subject(cert)
+	if !ok {
+		return "", false, status.Error(codes.Unauthenticated, "client certificate has no identity that maps to a subject")
+	}
+	return subject, true, nil
 }
 
 //subject returns the client cert's subject
@@ -198,3 +680,37 @@ func subject(ctx context.Context) string {
 }
 
 type subjectContextKey struct{}
+
+//commitLog returns the log a request is for and the resource of its records. Requests are for the
+//log of the server unless they name an internal log
+func (s *grpcServer) commitLog(ctx context.Context) (CommitLog, string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	names := md.Get(log.LogMetadataKey)
+	if len(names) == 0 {
+		return s.CommitLog, recordsObject, nil
+	}
+	l, ok := s.Logs[names[0]]
+	if names[0] == AuditLogName && s.AuditLog != nil {
+		l, ok = s.AuditLog, true
+	}
+	if !ok {
+		return nil, "", status.Errorf(codes.NotFound, "no log named %q", names[0])
+	}
+	return l, logObject(ctx), nil
+}
+
+//logObject returns the resource of the records of the log a request is for
+func logObject(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	names := md.Get(log.LogMetadataKey)
+	if len(names) == 0 {
+		return recordsObject
+	}
+	return names[0] + "/records"
+}
+
+//replica reports whether the request comes from a replicator
+func replica(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(log.ReplicaMetadataKey)) > 0
+}
@@ -2,18 +2,31 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/krehermann/proglog/api/v1"
 	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/ca"
 	"github.com/krehermann/proglog/internal/config"
 	"github.com/krehermann/proglog/internal/log"
+	"github.com/krehermann/proglog/internal/testconfig"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -30,32 +43,32 @@ func TestServer(t *testing.T) {
 		"unauthorized fails":                             testUnathorized,
 	} {
 		t.Run(scenario, func(t *testing.T) {
-			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
+			rootConn, nobodyConn, config, teardown := setupTest(t, nil)
 			defer teardown()
-			fn(t, rootClient, nobodyClient, config)
+			fn(t, api.NewLogClient(rootConn), api.NewLogClient(nobodyConn), config)
 		})
 	}
 }
 
 func setupTest(t *testing.T, cfgFn func(*Config)) (
-	rootClient api.LogClient,
-	nobodyClient api.LogClient,
+	rootConn *grpc.ClientConn,
+	nobodyConn *grpc.ClientConn,
 	cfg *Config,
 	teardown func(),
 ) {
 	t.Helper()
+	files := testconfig.New(t)
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	assert.NoError(t, err)
 
 	newClient := func(crtPath, keyPath string) (
 		*grpc.ClientConn,
-		api.LogClient,
 		[]grpc.DialOption,
 	) {
 		clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
 			CertFile: crtPath,
 			KeyFile:  keyPath,
-			CAFile:   config.CAFile,
+			CAFile:   files.CAFile,
 			Server:   false,
 		})
 		assert.NoError(t, err)
@@ -65,23 +78,20 @@ func setupTest(t *testing.T, cfgFn func(*Config)) (
 		cc, err := grpc.Dial(l.Addr().String(),
 			opts...)
 		assert.NoError(t, err)
-		client := api.NewLogClient(cc)
-		return cc, client, opts
+		return cc, opts
 	}
-	var rootConn *grpc.ClientConn
-	rootConn, rootClient, _ = newClient(
-		config.RootClientCertFile,
-		config.RootClientKeyFile,
+	rootConn, _ = newClient(
+		files.RootClientCertFile,
+		files.RootClientKeyFile,
 	)
-	var nobodyConn *grpc.ClientConn
-	nobodyConn, nobodyClient, _ = newClient(
-		config.NobodyClientCertFile,
-		config.NobodyClientKeyFile,
+	nobodyConn, _ = newClient(
+		files.NobodyClientCertFile,
+		files.NobodyClientKeyFile,
 	)
 	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.ServerCertFile,
-		KeyFile:       config.ServerKeyFile,
-		CAFile:        config.CAFile,
+		CertFile:      files.ServerCertFile,
+		KeyFile:       files.ServerKeyFile,
+		CAFile:        files.CAFile,
 		ServerAddress: l.Addr().String(),
 		Server:        true,
 	})
@@ -93,7 +103,7 @@ func setupTest(t *testing.T, cfgFn func(*Config)) (
 	cmtlog, err := log.NewLog(dir, log.Config{})
 	assert.NoError(t, err)
 
-	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
+	authorizer := auth.New(files.ACLModelFile, files.ACLPolicyFile)
 	cfg = &Config{CommitLog: cmtlog, Authorizer: authorizer}
 	if cfgFn != nil {
 		cfgFn(cfg)
@@ -104,7 +114,7 @@ func setupTest(t *testing.T, cfgFn func(*Config)) (
 		srv.Serve(l)
 	}()
 
-	return rootClient, nobodyClient, cfg, func() {
+	return rootConn, nobodyConn, cfg, func() {
 		srv.Stop()
 		rootConn.Close()
 		nobodyConn.Close()
@@ -216,3 +226,250 @@ func testUnathorized(
 	gotCode, wantCode = status.Code(err), codes.PermissionDenied
 	assert.Equal(t, wantCode, gotCode)
 }
+
+//recordingAuthorizer records the requests it authorizes before passing them on
+type recordingAuthorizer struct {
+	Authorizer
+	mu       sync.Mutex
+	requests []string
+}
+
+func (a *recordingAuthorizer) Authorize(subject, object, action string) error {
+	a.mu.Lock()
+	a.requests = append(a.requests, fmt.Sprintf("%s %s %s", subject, action, object))
+	a.mu.Unlock()
+	return a.Authorizer.Authorize(subject, object, action)
+}
+
+func (a *recordingAuthorizer) last() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.requests[len(a.requests)-1]
+}
+
+func (a *recordingAuthorizer) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.requests)
+}
+
+func TestAuthorization(t *testing.T) {
+	authorizer := &recordingAuthorizer{}
+	rootConn, _, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.AdminLog = cfg.CommitLog.(*log.Log)
+		authorizer.Authorizer = cfg.Authorizer
+		cfg.Authorizer = authorizer
+	})
+	defer teardown()
+	client := api.NewLogClient(rootConn)
+	admin := api.NewAdminClient(rootConn)
+	ctx := context.Background()
+	replicaCtx := metadata.AppendToOutgoingContext(ctx, log.ReplicaMetadataKey, "1")
+
+	for _, tc := range []struct {
+		want string
+		call func() error
+	}{
+		{"root produce log/records", func() error {
+			_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}})
+			return err
+		}},
+		{"root consume log/records", func() error {
+			_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+			return err
+		}},
+		{"root replicate log/records", func() error {
+			_, err := client.Consume(replicaCtx, &api.ConsumeRequest{Offset: 0})
+			return err
+		}},
+		{"root consume cluster/servers", func() error {
+			_, err := client.GetServers(ctx, &api.GetServersRequest{})
+			if status.Code(err) == codes.Unimplemented {
+				return nil
+			}
+			return err
+		}},
+		{"root admin log/offsets", func() error {
+			_, err := admin.GetOffsets(ctx, &api.GetOffsetsRequest{})
+			return err
+		}},
+		{"root admin log/size", func() error {
+			_, err := admin.GetSize(ctx, &api.GetSizeRequest{})
+			return err
+		}},
+		{"root admin log/segments", func() error {
+			_, err := admin.ListSegments(ctx, &api.ListSegmentsRequest{})
+			return err
+		}},
+		{"root admin log/records", func() error {
+			_, err := admin.Truncate(ctx, &api.TruncateRequest{Offset: 0})
+			return err
+		}},
+		{"root admin cluster/keyring", func() error {
+			_, err := admin.ListKeys(ctx, &api.ListKeysRequest{})
+			if status.Code(err) == codes.Unimplemented {
+				return nil
+			}
+			return err
+		}},
+	} {
+		require.NoError(t, tc.call(), tc.want)
+		require.Equal(t, tc.want, authorizer.last())
+	}
+
+	//a tail is authorized once, however long it waits for records
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	n := authorizer.count()
+	stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	time.Sleep(10 * consumeStreamPollInterval)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("bar")}})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, n+2, authorizer.count())
+}
+
+func TestAuthenticators(t *testing.T) {
+	files := testconfig.New(t)
+	dir, err := ioutil.TempDir("", "authenticators-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sum := sha256.Sum256([]byte("root-key"))
+	keysFile := filepath.Join(dir, "keys")
+	require.NoError(t, ioutil.WriteFile(keysFile, []byte("root "+hex.EncodeToString(sum[:])+"\n"), 0600))
+	apiKeys, err := auth.NewAPIKeyAuthenticator(keysFile)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:           files.ServerCertFile,
+		KeyFile:            files.ServerKeyFile,
+		CAFile:             files.CAFile,
+		Server:             true,
+		ClientCertOptional: true,
+	})
+	require.NoError(t, err)
+	logDir, err := ioutil.TempDir("", "authenticators-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(logDir)
+	cmtlog, err := log.NewLog(logDir, log.Config{})
+	require.NoError(t, err)
+	srv, err := NewGRPCServer(&Config{
+		CommitLog:      cmtlog,
+		Authorizer:     auth.New(files.ACLModelFile, files.ACLPolicyFile),
+		Authenticators: []Authenticator{TLSAuthenticator{}, apiKeys},
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	dial := func(certFile, keyFile string, opts ...grpc.DialOption) api.LogClient {
+		clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+			CAFile:   files.CAFile,
+		})
+		require.NoError(t, err)
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)))
+		cc, err := grpc.Dial(l.Addr().String(), opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() })
+		return api.NewLogClient(cc)
+	}
+	produce := func(client api.LogClient) error {
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}})
+		return err
+	}
+
+	for scenario, fn := range map[string]func(t *testing.T){
+		"client cert": func(t *testing.T) {
+			require.NoError(t, produce(dial(files.RootClientCertFile, files.RootClientKeyFile)))
+		},
+		"client cert comes first": func(t *testing.T) {
+			client := dial(files.NobodyClientCertFile, files.NobodyClientKeyFile,
+				grpc.WithPerRPCCredentials(auth.APIKeyCredentials{Key: "root-key"}))
+			require.Equal(t, codes.PermissionDenied, status.Code(produce(client)))
+		},
+		"api key without client cert": func(t *testing.T) {
+			client := dial("", "", grpc.WithPerRPCCredentials(auth.APIKeyCredentials{Key: "root-key"}))
+			require.NoError(t, produce(client))
+		},
+		"invalid api key": func(t *testing.T) {
+			client := dial("", "", grpc.WithPerRPCCredentials(auth.APIKeyCredentials{Key: "other-key"}))
+			require.Equal(t, codes.Unauthenticated, status.Code(produce(client)))
+		},
+		"no credentials": func(t *testing.T) {
+			require.Equal(t, codes.PermissionDenied, status.Code(produce(dial("", ""))))
+		},
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	files := testconfig.New(t)
+	//a client CA and a client cert with a SPIFFE ID but no common name, generated for the test
+	clientCA, err := ca.New("test client ca", time.Hour)
+	require.NoError(t, err)
+	clientCert, err := clientCA.Issue(ca.Request{
+		Hosts:  []string{"spiffe://example.org/ns/prod/sa/root"},
+		Client: true,
+	})
+	require.NoError(t, err)
+
+	serverCert, err := tls.LoadX509KeyPair(files.ServerCertFile, files.ServerKeyFile)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.Cert)
+	serverCreds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dir, err := ioutil.TempDir("", "cert-identity-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cmtlog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	identity, err := auth.NewCertIdentity(auth.IdentityConfig{
+		Sources: []auth.IdentitySource{auth.URISAN},
+		Rules: []auth.IdentityRule{{
+			Match:   `spiffe://example\.org/ns/prod/sa/(\w+)`,
+			Subject: "$1",
+		}},
+	})
+	require.NoError(t, err)
+	srv, err := NewGRPCServer(&Config{
+		CommitLog:      cmtlog,
+		Authorizer:     auth.New(files.ACLModelFile, files.ACLPolicyFile),
+		Authenticators: []Authenticator{TLSAuthenticator{Identity: identity}},
+	}, grpc.Creds(serverCreds))
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{CAFile: files.CAFile})
+	require.NoError(t, err)
+	clientTLSConfig.Certificates = []tls.Certificate{clientCert.TLSCertificate()}
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)))
+	require.NoError(t, err)
+	defer cc.Close()
+
+	//the spiffe id maps to root, which may produce
+	_, err = api.NewLogClient(cc).Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}})
+	require.NoError(t, err)
+
+	//a verified cert without a spiffe id has no subject
+	rootCC, _, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Authenticators = []Authenticator{TLSAuthenticator{Identity: identity}}
+	})
+	defer teardown()
+	_, err = api.NewLogClient(rootCC).Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
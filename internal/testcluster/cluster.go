@@ -0,0 +1,430 @@
+//Package testcluster boots in-process clusters of complete proglog nodes so that replication
+//and failover can be tested end to end. Every node runs a log, a gRPC server, membership and a
+//replicator on ephemeral ports, secured with TLS material generated for the cluster.
+package testcluster
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/krehermann/proglog/internal/auth"
+	"github.com/krehermann/proglog/internal/ca"
+	"github.com/krehermann/proglog/internal/config"
+	"github.com/krehermann/proglog/internal/discovery"
+	"github.com/krehermann/proglog/internal/faultnet"
+	"github.com/krehermann/proglog/internal/log"
+	"github.com/krehermann/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+//WaitTimeout is how long the Wait helpers wait for the cluster to settle
+var WaitTimeout = 20 * time.Second
+
+const (
+	aclModel = `[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = g(r.sub, p.sub) && keyMatch(r.obj, p.obj) && (r.act == p.act || p.act == "*")
+`
+	aclPolicy = `p, root, *, *
+`
+)
+
+//Config configures a test cluster
+type Config struct {
+	//Nodes is the number of nodes in the cluster
+	Nodes int
+	//Log configures the log of every node
+	Log log.Config
+	//FailedGracePeriod is how long the nodes give a failed node to come back. See discovery.Config
+	FailedGracePeriod time.Duration
+	//Seed seeds the random faults of the cluster's network
+	Seed int64
+}
+
+//Cluster is a set of nodes that gossip and replicate with each other
+type Cluster struct {
+	Nodes []*Node
+	//Network carries the rpc traffic between the nodes, faults set on it apply to replication
+	Network *faultnet.Network
+
+	t                   *testing.T
+	cfg                 Config
+	dir                 string
+	tls                 *ca.Files
+	aclModelFile        string
+	aclPolicyFile       string
+	serverTLSConfig     *tls.Config
+	rootClientTLSConfig *tls.Config
+}
+
+//Node is a member of the cluster. Its components are replaced when it restarts
+type Node struct {
+	Name       string
+	RPCAddr    string
+	BindAddr   string
+	Dir        string
+	Log        *log.Log
+	Membership *discovery.Membership
+	Replicator *log.Replicator
+
+	server     *grpc.Server
+	localConn  *grpc.ClientConn
+	clientConn *grpc.ClientConn
+	running    bool
+}
+
+//New starts a cluster and waits for its nodes to see each other. The cluster is shut down when the test ends
+func New(t *testing.T, cfg Config) *Cluster {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "testcluster")
+	require.NoError(t, err)
+	c := &Cluster{
+		Network: faultnet.New(cfg.Seed),
+		t:       t,
+		cfg:     cfg,
+		dir:     dir,
+	}
+	t.Cleanup(c.shutdown)
+
+	c.tls, err = ca.Generate(filepath.Join(dir, "tls"), ca.Options{})
+	require.NoError(t, err)
+	c.serverTLSConfig, err = config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      c.tls.ServerCertFile,
+		KeyFile:       c.tls.ServerKeyFile,
+		CAFile:        c.tls.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	c.rootClientTLSConfig = c.clientTLSConfig(c.tls.RootClientCertFile, c.tls.RootClientKeyFile)
+	c.aclModelFile = filepath.Join(dir, "model.conf")
+	c.aclPolicyFile = filepath.Join(dir, "policy.csv")
+	require.NoError(t, ioutil.WriteFile(c.aclModelFile, []byte(aclModel), 0644))
+	require.NoError(t, ioutil.WriteFile(c.aclPolicyFile, []byte(aclPolicy), 0644))
+
+	for i := 0; i < cfg.Nodes; i++ {
+		n := &Node{
+			Name:     fmt.Sprintf("node-%d", i),
+			RPCAddr:  "127.0.0.1:0",
+			BindAddr: fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]),
+			Dir:      filepath.Join(dir, fmt.Sprintf("node-%d", i)),
+		}
+		require.NoError(t, os.Mkdir(n.Dir, 0755))
+		c.Nodes = append(c.Nodes, n)
+		c.start(n)
+	}
+	c.WaitForMembers()
+	return c
+}
+
+//start starts the components of the node, joining the running nodes
+func (c *Cluster) start(n *Node) {
+	t := c.t
+	t.Helper()
+	ln, err := net.Listen("tcp", n.RPCAddr)
+	require.NoError(t, err)
+	if n.RPCAddr != ln.Addr().String() {
+		//first start, the ephemeral port is known now
+		n.RPCAddr = ln.Addr().String()
+		c.Network.Register(n.Name, n.RPCAddr)
+	}
+
+	n.Log, err = log.NewLog(n.Dir, c.cfg.Log)
+	require.NoError(t, err)
+
+	rootCreds := grpc.WithTransportCredentials(credentials.NewTLS(c.rootClientTLSConfig))
+	n.localConn, err = grpc.Dial(n.RPCAddr, rootCreds)
+	require.NoError(t, err)
+	n.clientConn, err = grpc.Dial(n.RPCAddr, rootCreds)
+	require.NoError(t, err)
+	n.Replicator = &log.Replicator{
+		DialOpts:    []grpc.DialOption{rootCreds, grpc.WithContextDialer(c.Network.Dialer(n.Name))},
+		LocalServer: api.NewLogClient(n.localConn),
+		LocalName:   n.Name,
+		LocalLog:    n.Log,
+	}
+
+	var joinAddrs []string
+	for _, other := range c.Nodes {
+		if other.running {
+			joinAddrs = append(joinAddrs, other.BindAddr)
+		}
+	}
+	n.Membership, err = discovery.NewMembership(n.Replicator, discovery.Config{
+		NodeName:          n.Name,
+		BindAddr:          n.BindAddr,
+		Tags:              map[string]string{"rpc_addr": n.RPCAddr},
+		StartJoinAddrs:    joinAddrs,
+		FailedGracePeriod: c.cfg.FailedGracePeriod,
+	})
+	require.NoError(t, err)
+
+	n.server, err = server.NewGRPCServer(&server.Config{
+		CommitLog:   n.Log,
+		Authorizer:  auth.New(c.aclModelFile, c.aclPolicyFile),
+		GetServerer: n.Replicator.Servers(n.Membership),
+	}, grpc.Creds(credentials.NewTLS(c.serverTLSConfig)))
+	require.NoError(t, err)
+	go n.server.Serve(c.Network.Listener(n.Name, ln))
+	n.running = true
+}
+
+//Kill stops the node without leaving the cluster, so the other nodes see it fail
+func (c *Cluster) Kill(i int) {
+	c.t.Helper()
+	n := c.Nodes[i]
+	if !n.running {
+		return
+	}
+	n.running = false
+	n.server.Stop()
+	require.NoError(c.t, n.Membership.Shutdown())
+	require.NoError(c.t, n.Replicator.Close())
+	n.localConn.Close()
+	n.clientConn.Close()
+	require.NoError(c.t, n.Log.Close())
+}
+
+//Restart starts a killed node again with its existing log, at the same addresses
+func (c *Cluster) Restart(i int) {
+	c.t.Helper()
+	n := c.Nodes[i]
+	require.False(c.t, n.running, "%s is running", n.Name)
+	c.start(n)
+}
+
+//Partition cuts replication between the nodes in a and the nodes in b until Heal is called.
+//Gossip is not partitioned, so the nodes still see each other as members. Use Network directly
+//for asymmetric partitions and other faults
+func (c *Cluster) Partition(a, b []int) {
+	for _, i := range a {
+		for _, j := range b {
+			c.Network.Partition(c.Nodes[i].Name, c.Nodes[j].Name)
+			c.Network.Partition(c.Nodes[j].Name, c.Nodes[i].Name)
+		}
+	}
+}
+
+//Heal removes all faults from the network
+func (c *Cluster) Heal() {
+	c.Network.Heal()
+}
+
+//Leader waits until the running nodes agree on the leader, the node that clients produce to, and
+//returns it
+func (c *Cluster) Leader() *Node {
+	c.t.Helper()
+	var leader *Node
+	c.eventually("no leader was elected", func() error {
+		var err error
+		leader, err = c.leader()
+		return err
+	})
+	return leader
+}
+
+//leader returns the running node that leads and that the other running nodes replicate from
+func (c *Cluster) leader() (*Node, error) {
+	var leader *Node
+	for _, n := range c.Nodes {
+		if n.running && n.Replicator.Leading() {
+			if leader != nil {
+				return nil, fmt.Errorf("%s and %s both lead", leader.Name, n.Name)
+			}
+			leader = n
+		}
+	}
+	if leader == nil {
+		return nil, fmt.Errorf("no node leads")
+	}
+	for _, n := range c.Nodes {
+		if n.running && n != leader && n.Replicator.Leader() != leader.Name {
+			return nil, fmt.Errorf("%s follows %q instead of %s", n.Name, n.Replicator.Leader(), leader.Name)
+		}
+	}
+	return leader, nil
+}
+
+//Client returns a client of the node authenticated as the root subject
+func (n *Node) Client() api.LogClient {
+	return api.NewLogClient(n.clientConn)
+}
+
+//Running reports whether the node has been started and not killed
+func (n *Node) Running() bool {
+	return n.running
+}
+
+//Produce produces the values to the node and returns their offsets
+func (c *Cluster) Produce(n *Node, values ...string) []uint64 {
+	c.t.Helper()
+	var offsets []uint64
+	for _, v := range values {
+		res, err := n.Client().Produce(
+			context.Background(),
+			&api.ProduceRequest{Record: &api.Record{Value: []byte(v)}},
+		)
+		require.NoError(c.t, err)
+		offsets = append(offsets, res.Offset)
+	}
+	return offsets
+}
+
+//Records returns the records in the node's log
+func (n *Node) Records() ([]*api.Record, error) {
+	off, err := n.Log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	next, err := n.Log.NextOffset()
+	if err != nil {
+		return nil, err
+	}
+	var records []*api.Record
+	for ; off < next; off++ {
+		r, err := n.Log.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+//WaitForMembers waits until every running node sees exactly the running nodes as alive
+func (c *Cluster) WaitForMembers() {
+	c.t.Helper()
+	want := make(map[string]bool)
+	for _, n := range c.Nodes {
+		if n.running {
+			want[n.Name] = true
+		}
+	}
+	c.eventually("members did not converge", func() error {
+		for _, n := range c.Nodes {
+			if !n.running {
+				continue
+			}
+			alive := 0
+			for _, m := range n.Membership.Members() {
+				if m.Status != serf.StatusAlive {
+					continue
+				}
+				if !want[m.Name] {
+					return fmt.Errorf("%s sees %s alive", n.Name, m.Name)
+				}
+				alive++
+			}
+			if alive != len(want) {
+				return fmt.Errorf("%s sees %d alive members, want %d", n.Name, alive, len(want))
+			}
+		}
+		return nil
+	})
+}
+
+//WaitForConvergence waits until the logs of the given nodes, or of every running node if none
+//are given, hold the same records as the leader's
+func (c *Cluster) WaitForConvergence(nodes ...int) {
+	c.t.Helper()
+	c.eventually("logs did not converge", func() error {
+		leader, err := c.leader()
+		if err != nil {
+			return err
+		}
+		want, err := leader.Records()
+		if err != nil {
+			return err
+		}
+		for _, n := range c.nodes(nodes) {
+			got, err := n.Records()
+			if err != nil {
+				return err
+			}
+			if len(got) != len(want) {
+				return fmt.Errorf("%s has %d records, want %d", n.Name, len(got), len(want))
+			}
+			for i := range want {
+				if string(got[i].Value) != string(want[i].Value) || got[i].Offset != want[i].Offset {
+					return fmt.Errorf("%s diverges at offset %d", n.Name, want[i].Offset)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+//eventually polls cond until it succeeds and fails the test with cond's last error after WaitTimeout
+func (c *Cluster) eventually(msg string, cond func() error) {
+	c.t.Helper()
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			require.FailNow(c.t, msg, err.Error())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+//nodes returns the nodes at the given indexes, or the running nodes if none are given
+func (c *Cluster) nodes(idxs []int) []*Node {
+	var nodes []*Node
+	if len(idxs) == 0 {
+		for _, n := range c.Nodes {
+			if n.running {
+				nodes = append(nodes, n)
+			}
+		}
+		return nodes
+	}
+	for _, i := range idxs {
+		nodes = append(nodes, c.Nodes[i])
+	}
+	return nodes
+}
+
+func (c *Cluster) clientTLSConfig(certFile, keyFile string) *tls.Config {
+	c.t.Helper()
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CAFile:        c.tls.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(c.t, err)
+	return tlsConfig
+}
+
+func (c *Cluster) shutdown() {
+	for i := range c.Nodes {
+		c.Kill(i)
+	}
+	os.RemoveAll(c.dir)
+}
@@ -0,0 +1,117 @@
+package testcluster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/krehermann/proglog/internal/faultnet"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplication(t *testing.T) {
+	c := New(t, Config{Nodes: 3})
+	offsets := c.Produce(c.Leader(), "first", "second", "third")
+	require.Equal(t, []uint64{0, 1, 2}, offsets)
+	c.WaitForConvergence()
+}
+
+func TestRestartFollower(t *testing.T) {
+	c := New(t, Config{Nodes: 3})
+	c.Produce(c.Leader(), "first", "second")
+	c.WaitForConvergence()
+
+	c.Kill(2)
+	c.Produce(c.Leader(), "third", "fourth")
+	c.WaitForConvergence()
+
+	//the restarted node catches up from where its log ends
+	c.Restart(2)
+	c.WaitForMembers()
+	c.Produce(c.Leader(), "fifth")
+	c.WaitForConvergence()
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := New(t, Config{Nodes: 3})
+	c.Produce(c.Leader(), "first", "second")
+	c.WaitForConvergence()
+
+	c.Kill(0)
+	c.WaitForMembers()
+	require.Equal(t, c.Nodes[1], c.Leader())
+	c.Produce(c.Leader(), "third")
+	c.WaitForConvergence()
+}
+
+func TestRestartLeader(t *testing.T) {
+	c := New(t, Config{Nodes: 3})
+	c.Produce(c.Leader(), "first", "second")
+	c.WaitForConvergence()
+
+	c.Kill(0)
+	c.WaitForMembers()
+	c.Produce(c.Leader(), "third")
+	c.WaitForConvergence()
+
+	//the old leader comes back with a shorter log, and catches up before it leads again
+	c.Restart(0)
+	c.WaitForMembers()
+	require.Eventually(t, func() bool {
+		leader, err := c.leader()
+		return err == nil && leader == c.Nodes[0]
+	}, WaitTimeout, 50*time.Millisecond)
+	require.Equal(t, []uint64{3}, c.Produce(c.Leader(), "fourth"))
+	c.WaitForConvergence()
+	records, err := c.Nodes[2].Records()
+	require.NoError(t, err)
+	var values []string
+	for _, record := range records {
+		values = append(values, string(record.Value))
+	}
+	require.Equal(t, []string{"first", "second", "third", "fourth"}, values)
+}
+
+func TestPartition(t *testing.T) {
+	c := New(t, Config{Nodes: 3})
+	c.Produce(c.Leader(), "first")
+	c.WaitForConvergence()
+
+	c.Partition([]int{0}, []int{2})
+	c.Produce(c.Leader(), "second", "third")
+	c.WaitForConvergence(1)
+	records, err := c.Nodes[2].Records()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+
+	c.Heal()
+	c.WaitForConvergence()
+}
+
+func TestConvergesAfterFaults(t *testing.T) {
+	c := New(t, Config{Nodes: 3, Seed: 42})
+	c.Network.Set(faultnet.Any, faultnet.Any, faultnet.Faults{
+		Latency:   5 * time.Millisecond,
+		Jitter:    10 * time.Millisecond,
+		ResetRate: 0.05,
+	})
+	//the leader's traffic to node-2 stalls while node-2 can still reach the leader
+	c.Network.Partition(c.Nodes[0].Name, c.Nodes[2].Name)
+	var values []string
+	for i := 0; i < 20; i++ {
+		values = append(values, fmt.Sprintf("record %d", i))
+	}
+	c.Produce(c.Leader(), values...)
+	c.WaitForConvergence(1)
+
+	c.Heal()
+	c.WaitForConvergence()
+}
+
+func TestConvergesAfterDroppedConnections(t *testing.T) {
+	c := New(t, Config{Nodes: 2, Seed: 7})
+	c.Network.Set(c.Nodes[1].Name, faultnet.Any, faultnet.Faults{DropRate: 0.5})
+	c.Network.Reset(c.Nodes[0].Name, c.Nodes[1].Name)
+	c.Produce(c.Leader(), "first", "second", "third")
+	c.WaitForConvergence()
+}
@@ -0,0 +1,48 @@
+//Package testconfig generates the TLS material and ACL files that tests need in a temporary
+//directory, so that tests don't depend on the files in the config dir
+package testconfig
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/krehermann/proglog/internal/ca"
+	"github.com/stretchr/testify/require"
+)
+
+//Files are the paths of the generated files, named like the files of internal/config
+type Files struct {
+	*ca.Files
+	ACLModelFile  string
+	ACLPolicyFile string
+}
+
+//New issues a CA, a server certificate and the root and nobody client certificates, and copies
+//the ACL model and policy in the test directory of the repo. The files are removed when the test
+//ends
+func New(t testing.TB) *Files {
+	t.Helper()
+	dir := t.TempDir()
+	tlsFiles, err := ca.Generate(dir, ca.Options{})
+	require.NoError(t, err)
+	files := &Files{
+		Files:         tlsFiles,
+		ACLModelFile:  filepath.Join(dir, "model.conf"),
+		ACLPolicyFile: filepath.Join(dir, "policy.csv"),
+	}
+	copyFile(t, "model.conf", files.ACLModelFile)
+	copyFile(t, "policy.csv", files.ACLPolicyFile)
+	return files
+}
+
+//copyFile copies name from the test directory of the repo to dst
+func copyFile(t testing.TB, name, dst string) {
+	t.Helper()
+	_, file, _, ok := runtime.Caller(0)
+	require.True(t, ok)
+	b, err := ioutil.ReadFile(filepath.Join(filepath.Dir(file), "..", "..", "test", name))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(dst, b, 0644))
+}
@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+//JSONExporter writes each span as a JSON object on its own line. It suits local debugging and tests
+type JSONExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	c   io.Closer
+	err error
+}
+
+var _ Exporter = (*JSONExporter)(nil)
+
+//Span is the JSON form of an exported span
+type Span struct {
+	TraceID         string                 `json:"trace_id"`
+	SpanID          string                 `json:"span_id"`
+	ParentSpanID    string                 `json:"parent_span_id,omitempty"`
+	HasRemoteParent bool                   `json:"has_remote_parent,omitempty"`
+	Name            string                 `json:"name"`
+	Kind            string                 `json:"kind,omitempty"`
+	Start           time.Time              `json:"start"`
+	End             time.Time              `json:"end"`
+	StatusCode      int32                  `json:"status_code,omitempty"`
+	StatusMessage   string                 `json:"status_message,omitempty"`
+	Attributes      map[string]interface{} `json:"attributes,omitempty"`
+	Links           []SpanLink             `json:"links,omitempty"`
+}
+
+//SpanLink is the JSON form of a link between spans
+type SpanLink struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+}
+
+//NewJSONExporter returns an exporter that writes spans to w
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc: json.NewEncoder(w)}
+}
+
+//NewFileExporter returns an exporter that appends spans to the file at path, creating it if needed
+func NewFileExporter(path string) (*JSONExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := NewJSONExporter(f)
+	e.c = f
+	return e, nil
+}
+
+//ExportSpan writes s. Write errors are kept and returned by Close, as spans are exported as they end
+func (e *JSONExporter) ExportSpan(s *trace.SpanData) {
+	span := Span{
+		TraceID:         s.TraceID.String(),
+		SpanID:          s.SpanID.String(),
+		HasRemoteParent: s.HasRemoteParent,
+		Name:            s.Name,
+		Start:           s.StartTime,
+		End:             s.EndTime,
+		StatusCode:      s.Code,
+		StatusMessage:   s.Message,
+		Attributes:      s.Attributes,
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		span.ParentSpanID = s.ParentSpanID.String()
+	}
+	switch s.SpanKind {
+	case trace.SpanKindServer:
+		span.Kind = "server"
+	case trace.SpanKindClient:
+		span.Kind = "client"
+	}
+	for _, l := range s.Links {
+		span.Links = append(span.Links, SpanLink{TraceID: l.TraceID.String(), SpanID: l.SpanID.String()})
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	err := e.enc.Encode(span)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+}
+
+//Close closes the file of an exporter created with NewFileExporter and returns the first error
+//writing spans
+func (e *JSONExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.c != nil {
+		err := e.c.Close()
+		if e.err == nil {
+			e.err = err
+		}
+	}
+	return e.err
+}
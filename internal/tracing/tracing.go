@@ -0,0 +1,107 @@
+//Package tracing configures how spans are sampled and exported, and carries trace context in
+//record metadata so that a record can be linked back to the trace it was produced in.
+//
+//Sampling and exporters are process wide, as they are in OpenCensus
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"go.opencensus.io/trace"
+)
+
+//MetadataKey is the record metadata key that holds the trace context, in the W3C traceparent format
+const MetadataKey = "traceparent"
+
+//Exporter receives spans as they end. JSONExporter is an Exporter
+type Exporter = trace.Exporter
+
+//Config configures tracing
+type Config struct {
+	//SampleRate is the fraction of traces started by this process that are sampled, from 0 to 1.
+	//Spans whose parent is sampled, such as those of rpcs from a client that sampled its trace,
+	//are always sampled
+	SampleRate float64
+	//Exporter receives the sampled spans. Spans are not exported when it is nil
+	Exporter Exporter
+}
+
+//Apply applies the sampling rate and registers the exporter. The returned function unregisters
+//the exporter
+func Apply(cfg Config) (stop func()) {
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(cfg.SampleRate)})
+	if cfg.Exporter == nil {
+		return func() {}
+	}
+	trace.RegisterExporter(cfg.Exporter)
+	return func() {
+		trace.UnregisterExporter(cfg.Exporter)
+	}
+}
+
+//Inject stores sc in the metadata of record unless the record already has a trace context,
+//which is the case for replicated records. Only sampled spans are stored, as other spans are not
+//exported and cannot be linked to
+func Inject(record *api.Record, sc trace.SpanContext) {
+	if !sc.IsSampled() {
+		return
+	}
+	if _, ok := record.Metadata[MetadataKey]; ok {
+		return
+	}
+	if record.Metadata == nil {
+		record.Metadata = make(map[string]string)
+	}
+	record.Metadata[MetadataKey] = fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, uint32(sc.TraceOptions))
+}
+
+//Extract returns the trace context in the metadata of record, if it has a valid one
+func Extract(record *api.Record) (trace.SpanContext, bool) {
+	sc := trace.SpanContext{}
+	parts := strings.Split(record.Metadata[MetadataKey], "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return sc, false
+	}
+	for _, field := range []struct {
+		dst []byte
+		src string
+	}{
+		{sc.TraceID[:], parts[1]},
+		{sc.SpanID[:], parts[2]},
+	} {
+		if hex.DecodedLen(len(field.src)) != len(field.dst) {
+			return sc, false
+		}
+		_, err := hex.Decode(field.dst, []byte(field.src))
+		if err != nil {
+			return sc, false
+		}
+	}
+	opts, err := hex.DecodeString(parts[3])
+	if err != nil || len(opts) != 1 {
+		return sc, false
+	}
+	sc.TraceOptions = trace.TraceOptions(opts[0])
+	if sc.TraceID == (trace.TraceID{}) || sc.SpanID == (trace.SpanID{}) {
+		return sc, false
+	}
+	return sc, true
+}
+
+//Link returns a link from a span to the span that produced record, so that consumers can refer
+//to the trace a record came from with span.AddLink
+func Link(record *api.Record) (trace.Link, bool) {
+	sc, ok := Extract(record)
+	if !ok {
+		return trace.Link{}, false
+	}
+	return trace.Link{
+		TraceID:    sc.TraceID,
+		SpanID:     sc.SpanID,
+		Type:       trace.LinkTypeParent,
+		Attributes: map[string]interface{}{"offset": int64(record.Offset)},
+	}, true
+}
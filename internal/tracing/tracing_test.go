@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	api "github.com/krehermann/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+)
+
+func TestMetadata(t *testing.T) {
+	sc := trace.SpanContext{
+		TraceID:      trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SpanID:       trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		TraceOptions: 1,
+	}
+	for scenario, fn := range map[string]func(t *testing.T){
+		"round trip": func(t *testing.T) {
+			record := &api.Record{Value: []byte("foo")}
+			Inject(record, sc)
+			require.Equal(t, "00-0102030405060708090a0b0c0d0e0f10-0102030405060708-01", record.Metadata[MetadataKey])
+			got, ok := Extract(record)
+			require.True(t, ok)
+			require.Equal(t, sc, got)
+		},
+		"unsampled spans are not injected": func(t *testing.T) {
+			record := &api.Record{}
+			unsampled := sc
+			unsampled.TraceOptions = 0
+			Inject(record, unsampled)
+			require.Empty(t, record.Metadata)
+		},
+		"replicated records keep their trace context": func(t *testing.T) {
+			record := &api.Record{Metadata: map[string]string{MetadataKey: "00-0102030405060708090a0b0c0d0e0f10-0102030405060708-01"}}
+			other := sc
+			other.SpanID = trace.SpanID{8}
+			Inject(record, other)
+			got, ok := Extract(record)
+			require.True(t, ok)
+			require.Equal(t, sc, got)
+		},
+		"invalid trace contexts are ignored": func(t *testing.T) {
+			for _, v := range []string{
+				"",
+				"01-0102030405060708090a0b0c0d0e0f10-0102030405060708-01",
+				"00-0102-0102030405060708-01",
+				"00-0102030405060708090a0b0c0d0e0f10-zz02030405060708-01",
+				"00-00000000000000000000000000000000-0102030405060708-01",
+				"00-0102030405060708090a0b0c0d0e0f10-0102030405060708",
+			} {
+				_, ok := Extract(&api.Record{Metadata: map[string]string{MetadataKey: v}})
+				require.False(t, ok, v)
+			}
+		},
+		"link": func(t *testing.T) {
+			record := &api.Record{Offset: 3}
+			Inject(record, sc)
+			link, ok := Link(record)
+			require.True(t, ok)
+			require.Equal(t, sc.TraceID, link.TraceID)
+			require.Equal(t, sc.SpanID, link.SpanID)
+			require.Equal(t, int64(3), link.Attributes["offset"])
+		},
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	exporter := NewJSONExporter(buf)
+	stop := Apply(Config{SampleRate: 0, Exporter: exporter})
+
+	ctx, parent := trace.StartSpan(context.Background(), "parent", trace.WithSampler(trace.AlwaysSample()))
+	_, child := trace.StartSpan(ctx, "child")
+	child.AddAttributes(trace.StringAttribute("key", "value"))
+	child.End()
+	parent.End()
+	//not sampled
+	_, other := trace.StartSpan(context.Background(), "other")
+	other.End()
+	stop()
+	_, after := trace.StartSpan(context.Background(), "after", trace.WithSampler(trace.AlwaysSample()))
+	after.End()
+	require.NoError(t, exporter.Close())
+
+	var spans []Span
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var s Span
+		require.NoError(t, dec.Decode(&s))
+		spans = append(spans, s)
+	}
+	require.Len(t, spans, 2)
+	require.Equal(t, "child", spans[0].Name)
+	require.Equal(t, parent.SpanContext().TraceID.String(), spans[0].TraceID)
+	require.Equal(t, parent.SpanContext().SpanID.String(), spans[0].ParentSpanID)
+	require.Equal(t, "value", spans[0].Attributes["key"])
+	require.Equal(t, "parent", spans[1].Name)
+	require.Empty(t, spans[1].ParentSpanID)
+}